@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"learning-web-chatboard4/common"
+	"learning-web-chatboard4/common/models"
+	"learning-web-chatboard4/rabbitrpc"
+	"time"
+)
+
+const (
+	defaultUserSearchSize = 20
+	maxUserSearchSize     = 100
+)
+
+// admin console, every function needs admin scope
+
+// matches part of name or email, empty query lists newest users
+func searchUsers(ctx context.Context, search *models.UserSearch,
+) (*models.UserPage, error) {
+	_, err := rabbitrpc.RequireScope(ctx, models.ScopeAdmin)
+	if err != nil {
+		return nil, err
+	}
+
+	users, err := searchUsersSQL(search)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &models.UserPage{
+		Users: make([]models.User, 0, len(users)),
+	}
+	for _, user := range users {
+		page.Users = append(page.Users, *publicUser(&user))
+	}
+	return page, nil
+}
+
+func searchUsersSQL(search *models.UserSearch) (users []models.User, err error) {
+	limit := search.Limit
+	if limit <= 0 || limit > maxUserSearchSize {
+		limit = defaultUserSearchSize
+	}
+
+	sess := dbEngine.
+		Table(usersTable).
+		Desc("id").
+		Limit(limit)
+	if !common.IsEmpty(search.Query) {
+		pattern := "%" + escapeLike(search.Query) + "%"
+		sess = sess.Where("name ILIKE ? OR email ILIKE ?", pattern, pattern)
+	}
+	err = sess.Find(&users)
+	return
+}
+
+// query is taken literally
+func escapeLike(query string) string {
+	escaped := make([]rune, 0, len(query))
+	for _, r := range query {
+		if r == '%' || r == '_' || r == '\\' {
+			escaped = append(escaped, '\\')
+		}
+		escaped = append(escaped, r)
+	}
+	return string(escaped)
+}
+
+// without secrets
+func publicUser(user *models.User) *models.User {
+	return &models.User{
+		Id:            user.Id,
+		UuId:          user.UuId,
+		Name:          user.Name,
+		Email:         user.Email,
+		Role:          user.Role,
+		NumErrors:     user.NumErrors,
+		Locked:        user.Locked,
+		LockedAt:      user.LockedAt,
+		VerifiedAt:    user.VerifiedAt,
+		TotpEnabledAt: user.TotpEnabledAt,
+		CreatedAt:     user.CreatedAt,
+	}
+}
+
+// admin can't lock out or demote themselves
+func readOtherUserInternal(ctx context.Context, email string,
+) (user *models.User, err error) {
+	caller, err := rabbitrpc.RequireScope(ctx, models.ScopeAdmin)
+	if err != nil {
+		return
+	}
+	if caller.Email == email {
+		err = rabbitrpc.NewError(
+			rabbitrpc.CodeInvalidArgument,
+			"can't change own account",
+		)
+		return
+	}
+	user, err = readUserByEmailInternal(email)
+	if err != nil {
+		return
+	}
+	common.LogInfo(logger).Printf(
+		"admin %s changes user %s\n",
+		caller.Email,
+		user.Email,
+	)
+	return
+}
+
+func unlockUser(ctx context.Context, user *models.User) (*models.User, error) {
+	found, err := readOtherUserInternal(ctx, user.Email)
+	if err != nil {
+		return nil, err
+	}
+
+	found.Locked = 0
+	found.LockedAt = time.Time{}
+	found.NumErrors = 0
+	found.TotpNumErrors = 0
+	err = updateUserSQL(found, lockCols...)
+	if err != nil {
+		return nil, err
+	}
+	// clients locked out by password mismatches too
+	clearThrottleInternal(found.Email)
+	recordLoginInternal(ctx, found.Id, found.Email, models.LoginUnlockedByAdmin)
+
+	return publicUser(found), nil
+}
+
+// takes effect when access tokens are renewed
+func setRole(ctx context.Context, user *models.User) (*models.User, error) {
+	found, err := readOtherUserInternal(ctx, user.Email)
+	if err != nil {
+		return nil, err
+	}
+	if !models.IsRole(user.Role) {
+		return nil, rabbitrpc.NewError(
+			rabbitrpc.CodeInvalidArgument,
+			"unknown role",
+		)
+	}
+
+	found.Role = user.Role
+	// refresh tokens are kept, new access token has new scopes
+	found.TokensNotBefore = tokensNotBefore(time.Now())
+	err = updateUserSQL(found, "role", "tokens_not_before")
+	if err != nil {
+		return nil, err
+	}
+
+	return publicUser(found), nil
+}
+
+// every session of the user is logged out
+func forceLogout(ctx context.Context, user *models.User) (*models.User, error) {
+	found, err := readOtherUserInternal(ctx, user.Email)
+	if err != nil {
+		return nil, err
+	}
+
+	err = revokeAllTokensInternal(found)
+	if err != nil {
+		return nil, err
+	}
+
+	return publicUser(found), nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"learning-web-chatboard4/common"
+	"learning-web-chatboard4/common/models"
+	"learning-web-chatboard4/rabbitrpc"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	defaultLoginsSize = 20
+	maxLoginsSize     = 100
+	maxUserAgentSize  = 255
+)
+
+// audit trail of authentication attempts.
+// failing to record never fails the login itself
+func recordLoginInternal(ctx context.Context, userId uint, email, result string) {
+	client := rabbitrpc.ClientFrom(ctx)
+	login := &models.Login{
+		UserId:    userId,
+		Email:     email,
+		Result:    result,
+		IP:        client.IP,
+		UserAgent: truncate(client.UserAgent, maxUserAgentSize),
+		CreatedAt: time.Now(),
+	}
+	err := createLoginSQL(login)
+	if err != nil {
+		common.LogError(logger).Printf(
+			"recording login of %s failed: %s\n",
+			email,
+			err.Error(),
+		)
+	}
+}
+
+func truncate(s string, size int) string {
+	if len(s) <= size {
+		return s
+	}
+	s = s[:size]
+	// don't cut a character in half
+	for !utf8.ValidString(s) {
+		s = s[:len(s)-1]
+	}
+	return s
+}
+
+func createLoginSQL(login *models.Login) (err error) {
+	_, err = dbEngine.
+		Table(loginsTable).
+		InsertOne(login)
+	return
+}
+
+// recent sign-in activity of the caller
+func readLoginActivity(ctx context.Context, query *models.LoginQuery,
+) (*models.LoginPage, error) {
+	caller, err := rabbitrpc.RequireScope(ctx, models.ScopeRead)
+	if err != nil {
+		return nil, err
+	}
+
+	logins, err := readLoginsSQL(&models.LoginQuery{
+		Email: caller.Email,
+		Limit: query.Limit,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &models.LoginPage{Logins: logins}, nil
+}
+
+// admin only, empty email lists every attempt
+func readLogins(ctx context.Context, query *models.LoginQuery,
+) (*models.LoginPage, error) {
+	_, err := rabbitrpc.RequireScope(ctx, models.ScopeAdmin)
+	if err != nil {
+		return nil, err
+	}
+
+	logins, err := readLoginsSQL(query)
+	if err != nil {
+		return nil, err
+	}
+	return &models.LoginPage{Logins: logins}, nil
+}
+
+// email is matched as is, attempts with unknown email are included
+func readLoginsSQL(query *models.LoginQuery) (logins []models.Login, err error) {
+	limit := query.Limit
+	if limit <= 0 || limit > maxLoginsSize {
+		limit = defaultLoginsSize
+	}
+
+	sess := dbEngine.
+		Table(loginsTable).
+		Desc("id").
+		Limit(limit)
+	if !common.IsEmpty(query.Email) {
+		sess = sess.Where("email = ?", query.Email)
+	}
+	err = sess.Find(&logins)
+	if logins == nil {
+		logins = []models.Login{}
+	}
+	return
+}
@@ -1,11 +1,17 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"learning-web-chatboard4/common"
 	"learning-web-chatboard4/common/models"
 	"learning-web-chatboard4/jose"
+	"learning-web-chatboard4/mailer"
+	"learning-web-chatboard4/password"
 	"learning-web-chatboard4/rabbitrpc"
+	"learning-web-chatboard4/session"
 	"log"
+	"time"
 
 	"xorm.io/xorm"
 )
@@ -16,16 +22,40 @@ var dbEngine *xorm.Engine
 var config *common.Configuration
 var logger *log.Logger
 var server *rabbitrpc.RabbitClient
+var rpcRouter *rabbitrpc.Router
+var mailSender mailer.Sender
+var hasher *password.Hasher
 
 func main() {
 	var err error
 
+	rotateKeys := flag.Bool(
+		"rotate-keys",
+		false,
+		"add a new jose key and exit, restart servers to use it",
+	)
+	grantAdmin := flag.String(
+		"grant-admin",
+		"",
+		"give admin role to the user of this email and exit",
+	)
+	flag.Parse()
+
 	// config
 	config, err = common.LoadConfig()
 	if err != nil {
 		log.Fatalln(err.Error())
 	}
 
+	if *rotateKeys {
+		kid, err := jose.RotateKeys(config.JoseKeysDir)
+		if err != nil {
+			log.Fatalln(err.Error())
+		}
+		log.Printf("new key: %s\n", kid)
+		return
+	}
+
 	//log
 	logger, err = common.OpenLogger(
 		config.LogToFile,
@@ -45,14 +75,78 @@ func main() {
 		common.LogError(logger).Fatalln(err.Error())
 	}
 
+	if len(*grantAdmin) > 0 {
+		err = setRoleInternal(*grantAdmin, models.RoleAdmin)
+		if err != nil {
+			common.LogError(logger).Fatalln(err.Error())
+		}
+		common.LogInfo(logger).Printf("%s is admin now\n", *grantAdmin)
+		return
+	}
+
 	//jose
-	err = jose.StartJoseMaker("chatboard4-authentication-server")
+	err = jose.StartJoseMaker(
+		"chatboard4-authentication-server",
+		config.JoseKeysDir,
+	)
 	if err != nil {
 		common.LogError(logger).Fatalln(err.Error())
 	}
 	jose.AddKnownAudience(audienceName)
+	jose.SetRevocationCheck(isTokenRevoked)
+
+	//password
+	hasher, err = password.NewHasher(
+		password.Params{
+			Algorithm:     config.PasswordAlgorithm,
+			Argon2Memory:  config.PasswordArgon2Memory,
+			Argon2Time:    config.PasswordArgon2Time,
+			Argon2Threads: config.PasswordArgon2Threads,
+			BcryptCost:    config.PasswordBcryptCost,
+		},
+	)
+	if err != nil {
+		common.LogError(logger).Fatalln(err.Error())
+	}
+
+	//throttle, shares redis with sessions
+	limiter, err = session.OpenLimiter(
+		session.StoreOptions{
+			Kind:   config.SessionStore,
+			DbName: config.DbName,
+			Redis: session.RedisOptions{
+				Address:     config.RedisAddress,
+				DB:          config.RedisDB,
+				MaxIdle:     config.RedisMaxIdle,
+				MaxActive:   config.RedisMaxActive,
+				IdleTimeout: time.Duration(config.RedisIdleTimeout) * time.Second,
+			},
+		},
+	)
+	if err != nil {
+		common.LogError(logger).Fatalln(err.Error())
+	}
+
+	//mail
+	mailSender, err = mailer.NewSender(
+		mailer.Options{
+			Kind:         config.MailSender,
+			From:         config.MailFrom,
+			Dir:          config.MailDir,
+			SMTPAddress:  config.SMTPAddress,
+			SMTPUserName: config.SMTPUserName,
+		},
+		logger,
+	)
+	if err != nil {
+		common.LogError(logger).Fatalln(err.Error())
+	}
 
 	//rabbit
+	err = registerFunctions()
+	if err != nil {
+		common.LogError(logger).Fatalln(err.Error())
+	}
 	server = rabbitrpc.NewRPCServer(
 		rabbitrpc.DefaultRabbitURL,
 		config.UsersResQName,
@@ -63,73 +157,66 @@ func main() {
 		config.UsersServerKey,
 		onRequestReceived,
 	)
-	defer server.Publisher.Done()
-	defer server.Subscriber.Done()
-
-	select {
-	case <-server.Publisher.CTX.Done():
-		break
-	case <-server.Subscriber.CTX.Done():
-		break
-	}
-}
-
-func onRequestReceived(raws rabbitrpc.Raws) {
-	go func() {
-		var err *rabbitrpc.RabbitRPCError
-		envelop, err := rabbitrpc.FromBin(raws.Body)
-		if err != nil {
-			common.SendError(server, err, raws.CorrelationId)
-			return
-		}
 
-		err = routingRequest(envelop, raws.CorrelationId)
-		if err != nil {
-			common.SendError(server, err, raws.CorrelationId)
-		}
-	}()
+	shutdownCTX, stop := common.NotifyShutdown()
+	defer stop()
+	<-shutdownCTX.Done()
+	shutdown()
 }
 
-func routingRequest(envelop *rabbitrpc.Envelope, corrId string,
-) (err *rabbitrpc.RabbitRPCError) {
-	// check data type
-	switch envelop.DataTypeName {
-
-	case "User":
-		var user models.User
-		err = envelop.Extract(&user)
-		if err != nil {
-			return
-		}
-
-		// check function name
-		switch envelop.FunctionToCall {
-		case "createUser":
-			createUser(&user, corrId)
-		case "readUser":
-			readUser(&user, corrId)
-		case "lockUser":
-			lockUser(&user, corrId)
-		default:
-			err = rabbitrpc.ErrorFunctionNotFound
-		}
+func shutdown() {
+	common.LogInfo(logger).Println("shutting down...")
+	ctx, cancel := context.WithTimeout(
+		context.Background(),
+		common.ShutdownTimeout,
+	)
+	defer cancel()
 
-	case "Token":
-		var token common.Token
-		err = envelop.Extract(&token)
-		if err != nil {
-			return
-		}
+	err := rpcRouter.Shutdown(ctx, server)
+	if err != nil {
+		common.LogWarning(logger).Println(err.Error())
+	}
+	err = limiter.Close()
+	if err != nil {
+		common.LogWarning(logger).Println(err.Error())
+	}
+	err = dbEngine.Close()
+	if err != nil {
+		common.LogWarning(logger).Println(err.Error())
+	}
+	common.LogInfo(logger).Println("bye")
+}
 
-		switch envelop.FunctionToCall {
-		case "verifyToken":
-			verifyToken(&token, corrId)
-		default:
-			err = rabbitrpc.ErrorFunctionNotFound
-		}
+func onRequestReceived(raws rabbitrpc.Raws) {
+	rpcRouter.Dispatch(server, raws)
+}
 
-	default:
-		err = rabbitrpc.ErrorTypeNotFound
-	}
-	return
+func registerFunctions() error {
+	rpcRouter = rabbitrpc.NewRouter(func(err error) {
+		common.LogError(logger).Println(err.Error())
+	})
+
+	rabbitrpc.Register(rpcRouter, "createUser", createUser)
+	rabbitrpc.Register(rpcRouter, "readUser", readUser)
+	rabbitrpc.Register(rpcRouter, "lockUser", lockUser)
+	rabbitrpc.Register(rpcRouter, "unlockUser", unlockUser)
+	rabbitrpc.Register(rpcRouter, "searchUsers", searchUsers)
+	rabbitrpc.Register(rpcRouter, "setRole", setRole)
+	rabbitrpc.Register(rpcRouter, "forceLogout", forceLogout)
+	rabbitrpc.Register(rpcRouter, "readLogins", readLogins)
+	rabbitrpc.Register(rpcRouter, "readLoginActivity", readLoginActivity)
+	rabbitrpc.Register(rpcRouter, "verifyToken", verifyToken)
+	rabbitrpc.Register(rpcRouter, "refreshToken", refreshToken)
+	rabbitrpc.Register(rpcRouter, "revokeToken", revokeToken)
+	rabbitrpc.Register(rpcRouter, "revokeAllTokens", revokeAllTokens)
+	rabbitrpc.Register(rpcRouter, "requestPasswordReset", requestPasswordReset)
+	rabbitrpc.Register(rpcRouter, "resetPassword", resetPassword)
+	rabbitrpc.Register(rpcRouter, "verifyEmail", verifyEmail)
+	rabbitrpc.Register(rpcRouter, "resendVerification", resendVerification)
+	rabbitrpc.Register(rpcRouter, "verifyTotp", verifyTotp)
+	rabbitrpc.Register(rpcRouter, "beginTotp", beginTotp)
+	rabbitrpc.Register(rpcRouter, "enableTotp", enableTotp)
+	rabbitrpc.Register(rpcRouter, "disableTotp", disableTotp)
+
+	return rpcRouter.Check()
 }
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"learning-web-chatboard4/common"
+	"learning-web-chatboard4/common/models"
+	"learning-web-chatboard4/mailer"
+	"learning-web-chatboard4/rabbitrpc"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	randomTokenSize = 32
+	resetTokenExp   = time.Minute * 30
+	resetPath       = "/user/reset"
+	// against flooding an address with mails,
+	// unknown emails are counted too
+	resetRequestWindow = time.Hour
+	maxResetsPerEmail  = 3
+	maxResetsPerIP     = 10
+)
+
+var errorInvalidResetToken = rabbitrpc.NewError(
+	rabbitrpc.CodeInvalidArgument,
+	"reset token is invalid or expired",
+)
+
+// always succeeds for unknown email,
+// so it can't be used for finding registered addresses
+func requestPasswordReset(ctx context.Context, user *models.User,
+) (*common.SimpleMessage, error) {
+	err := requestPasswordResetInternal(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	return &common.SimpleMessage{
+		Message: "requested",
+	}, nil
+}
+
+func requestPasswordResetInternal(ctx context.Context, user *models.User) (err error) {
+	if common.IsEmpty(user.Email) {
+		err = rabbitrpc.NewError(rabbitrpc.CodeInvalidArgument, "need email")
+		return
+	}
+	err = limitResetRequestInternal(ctx, user.Email)
+	if err != nil {
+		return
+	}
+
+	found := &models.User{Email: user.Email}
+	err = readUserSQL(found)
+	if rabbitrpc.CodeOf(err) == rabbitrpc.CodeNotFound {
+		common.LogWarning(logger).Printf(
+			"password reset for unknown email %s\n",
+			user.Email,
+		)
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	token, err := newRandomToken()
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	err = createPasswordResetSQL(&models.PasswordReset{
+		UserId:    found.Id,
+		TokenHash: hashToken(token),
+		ExpiresAt: now.Add(resetTokenExp),
+		CreatedAt: now,
+	})
+	if err != nil {
+		return
+	}
+
+	err = mailSender.Send(ctx, mailer.Message{
+		To:      found.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf(
+			"Hi %s,\n\n"+
+				"Open the link below to set a new password.\n"+
+				"%s\n\n"+
+				"The link expires in %d minutes and can be used once.\n"+
+				"If you did not request this, just ignore this mail.\n",
+			found.Name,
+			resetLink(token),
+			int(resetTokenExp/time.Minute),
+		),
+	})
+	return
+}
+
+func limitResetRequestInternal(ctx context.Context, email string) (err error) {
+	ip := rabbitrpc.ClientFrom(ctx).IP
+	if !common.IsEmpty(ip) {
+		err = limitRequestInternal(
+			"reset-ip:"+ip,
+			maxResetsPerIP,
+			resetRequestWindow,
+		)
+		if err != nil {
+			return
+		}
+	}
+	err = limitRequestInternal(
+		"reset-email:"+strings.ToLower(email),
+		maxResetsPerEmail,
+		resetRequestWindow,
+	)
+	return
+}
+
+// for reset and refresh tokens
+func newRandomToken() (token string, err error) {
+	bytes := make([]byte, randomTokenSize)
+	_, err = rand.Read(bytes)
+	if err != nil {
+		return
+	}
+	token = base64.RawURLEncoding.EncodeToString(bytes)
+	return
+}
+
+// token has enough entropy, plain sha256 is enough
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func resetLink(token string) string {
+	return fmt.Sprintf(
+		"%s%s?token=%s",
+		config.PublicURL,
+		resetPath,
+		url.QueryEscape(token),
+	)
+}
+
+func createPasswordResetSQL(reset *models.PasswordReset) (err error) {
+	affected, err := dbEngine.
+		Table(passwordResetsTable).
+		InsertOne(reset)
+	if err == nil && affected != 1 {
+		err = fmt.Errorf(
+			"something wrong. returned value was %d",
+			affected,
+		)
+	}
+	return
+}
+
+// sets new password, clears lock state and login throttle of the user,
+// and revokes every token of the user.
+// lock by admin is kept on purpose, a moderation decision should not be
+// undone by anyone who can read mails of the account. admin unlocks it
+// with unlockUser
+func resetPassword(ctx context.Context, newPw *models.NewPassword,
+) (*common.SimpleMessage, error) {
+	err := resetPasswordInternal(newPw)
+	if err != nil {
+		return nil, err
+	}
+
+	return &common.SimpleMessage{
+		Message: "password updated",
+	}, nil
+}
+
+func resetPasswordInternal(newPw *models.NewPassword) (err error) {
+	if common.IsEmpty(newPw.Token, newPw.Password) {
+		err = rabbitrpc.NewError(
+			rabbitrpc.CodeInvalidArgument,
+			"need token and password",
+		)
+		return
+	}
+
+	// hashing password is expensive, invalid token is refused before it.
+	// token is checked again in the transaction
+	tokenHash := hashToken(newPw.Token)
+	err = readPasswordResetSQL(tokenHash, &models.PasswordReset{})
+	if err != nil {
+		return
+	}
+	hashed, err := hasher.Hash(newPw.Password)
+	if err != nil {
+		return
+	}
+	user, err := resetPasswordSQL(tokenHash, hashed)
+	if err != nil {
+		return
+	}
+	clearThrottleInternal(user.Email)
+	// sessions with old password are logged out
+	err = revokeAllTokensInternal(user)
+	return
+}
+
+// unused and unexpired reset of tokenHash
+const validResetCond = "token_hash = ? AND used_at IS NULL AND expires_at > ?"
+
+func readPasswordResetSQL(tokenHash string, reset *models.PasswordReset) (err error) {
+	ok, err := dbEngine.
+		Table(passwordResetsTable).
+		Where(validResetCond, tokenHash, time.Now()).
+		Get(reset)
+	if err == nil && !ok {
+		err = errorInvalidResetToken
+	}
+	return
+}
+
+// token is used once, every reset of the user is consumed at once.
+// lock by admin is kept
+func resetPasswordSQL(tokenHash, hashedPw string) (user *models.User, err error) {
+	sess := dbEngine.NewSession()
+	defer sess.Close()
+
+	err = sess.Begin()
+	if err != nil {
+		return
+	}
+
+	now := time.Now()
+	reset := &models.PasswordReset{}
+	ok, err := sess.
+		Table(passwordResetsTable).
+		Where(validResetCond, tokenHash, now).
+		ForUpdate().
+		Get(reset)
+	if err == nil && !ok {
+		err = errorInvalidResetToken
+	}
+	if err != nil {
+		sess.Rollback()
+		return
+	}
+
+	user = &models.User{}
+	ok, err = sess.
+		Table(usersTable).
+		ID(reset.UserId).
+		ForUpdate().
+		Get(user)
+	if err == nil && !ok {
+		err = rabbitrpc.NewError(rabbitrpc.CodeNotFound, "no such user")
+	}
+	if err != nil {
+		sess.Rollback()
+		return
+	}
+
+	cols := []string{"password", "num_errors", "totp_num_errors"}
+	user.Password = hashedPw
+	user.NumErrors = 0
+	user.TotpNumErrors = 0
+	if user.Locked != lockedByAdmin {
+		user.Locked = 0
+		user.LockedAt = time.Time{}
+		cols = append(cols, "locked", "locked_at")
+	}
+	affected, err := sess.
+		Table(usersTable).
+		ID(user.Id).
+		Cols(cols...).
+		Update(user)
+	if err == nil && affected != 1 {
+		err = fmt.Errorf(
+			"something wrong. returned value was %d",
+			affected,
+		)
+	}
+	if err != nil {
+		sess.Rollback()
+		return
+	}
+
+	_, err = sess.
+		Table(passwordResetsTable).
+		Where("user_id = ? AND used_at IS NULL", reset.UserId).
+		Cols("used_at").
+		Update(&models.PasswordReset{UsedAt: now})
+	if err != nil {
+		sess.Rollback()
+		return
+	}
+
+	err = sess.Commit()
+	return
+}
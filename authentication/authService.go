@@ -1,36 +1,63 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"learning-web-chatboard4/common"
 	"learning-web-chatboard4/common/models"
 	"learning-web-chatboard4/jose"
+	"learning-web-chatboard4/password"
+	"learning-web-chatboard4/rabbitrpc"
 	"time"
 )
 
 const (
-	usersTable  = "users"
-	loginsTable = "logins"
+	usersTable          = "users"
+	loginsTable         = "logins"
+	passwordResetsTable = "password_resets"
+	recoveryCodesTable  = "recovery_codes"
+	refreshTokensTable  = "refresh_tokens"
+	revokedTokensTable  = "revoked_tokens"
 )
 
 const (
-	numStretching      = 10000
-	pwSaltSize    uint = 20
-	maxNumError        = 10
-	lockDuration       = time.Minute * 30
+	// failures of the pair of email and client ip before the client
+	// is locked out of the account for lockDuration
+	maxNumError  = 10
+	lockDuration = time.Minute * 30
+	// password mismatches of the account in a row from every client
+	// before the account is hard locked.
+	// cleared by correct password, password reset and unlock by admin
+	maxNumErrorHard = 100
 )
 
-func createUser(user *models.User, corrId string) {
+// values of users.locked
+const (
+	// by totp mismatches, unlocked after lockDuration
+	lockedByErrors = 1
+	// not unlocked after lockDuration
+	lockedByAdmin = 2
+	// by maxNumErrorHard, only unlocked by password reset or admin
+	lockedByPasswordErrors = 3
+)
+
+func createUser(ctx context.Context, user *models.User) (*models.User, error) {
 	err := createUserInternal(user)
 	if err != nil {
-		common.HandleError(server, logger, err.Error(), corrId)
-		return
+		return nil, err
+	}
+	err = sendVerificationInternal(ctx, user)
+	if err != nil {
+		common.LogError(logger).Printf(
+			"verification mail to %s failed: %s\n",
+			user.Email,
+			err.Error(),
+		)
 	}
 	user.Password = ""
-	user.Salt = ""
 
-	common.SendOK(server, user, "User", corrId)
+	return user, nil
 }
 
 func createUserInternal(user *models.User) (err error) {
@@ -39,23 +66,29 @@ func createUserInternal(user *models.User) (err error) {
 		user.Email,
 		user.Password,
 	) {
-		err = errors.New("contains empty string")
+		err = rabbitrpc.NewError(
+			rabbitrpc.CodeInvalidArgument,
+			"contains empty string",
+		)
 		return
 	}
 
-	user.Salt, err = common.GenerateRandomString(pwSaltSize)
-	if err != nil {
-		return
-	}
-	user.Password, err = common.ProcessPassword(user.Password)
+	user.Password, err = hasher.Hash(user.Password)
 	if err != nil {
 		return
 	}
 
+	// other roles are given by admin
+	user.Role = models.RoleMember
 	user.UuId = common.NewUuIdString()
 	user.CreatedAt = time.Now()
 	err = createUserSQL(user)
-
+	if common.IsUniqueViolation(err) {
+		err = rabbitrpc.NewError(
+			rabbitrpc.CodeConflict,
+			"name or email is already used",
+		)
+	}
 	return
 }
 
@@ -72,77 +105,196 @@ func createUserSQL(user *models.User) (err error) {
 	return
 }
 
-func readUser(user *models.User, corrId string) {
-	token, err := readUserInternal(user)
+func readUser(ctx context.Context, user *models.User) (*models.User, error) {
+	err := readUserInternal(ctx, user)
 	if err != nil {
-		common.HandleError(server, logger, err.Error(), corrId)
-		return
+		return nil, err
 	}
 
-	// not saved in database
-	user.Token = token
 	user.Password = ""
-	user.Salt = ""
 
-	common.SendOK(server, user, "User", corrId)
+	return user, nil
 }
 
-// actualy authentication process
-func readUserInternal(user *models.User) (token string, err error) {
+// actualy authentication process, tokens are set to user.
+// with two factor, user.TotpTicket is set instead.
+// every attempt is recorded into logins
+func readUserInternal(ctx context.Context, user *models.User) (err error) {
 	if common.IsEmpty(user.Email, user.Password) {
-		err = errors.New("need email and password")
+		err = rabbitrpc.NewError(
+			rabbitrpc.CodeInvalidArgument,
+			"need email and password",
+		)
+		return
+	}
+	err = checkThrottleInternal(ctx, user.Email)
+	if err != nil {
+		return
+	}
+	failures, err := checkPairLockInternal(ctx, user.Email)
+	if err != nil {
 		return
 	}
+
 	pw := user.Password
 	user.Password = ""
 	err = readUserSQL(user)
+	if rabbitrpc.CodeOf(err) == rabbitrpc.CodeNotFound {
+		hitThrottleInternal(ctx, user.Email)
+		recordLoginInternal(ctx, 0, user.Email, models.LoginUnknownUser)
+		// don't tell which of email or password is wrong
+		err = rabbitrpc.NewError(
+			rabbitrpc.CodeUnauthenticated,
+			"email or password mismatch",
+		)
+	}
 	if err != nil {
 		return
 	}
 
-	// if so this user is locked
-	if user.Locked > 0 {
-		if user.LockedAt.Add(lockDuration).After(time.Now()) {
-			// within lock duration
-			err = errors.New("user locked")
-			return
-		} else {
-			// unlock user
-			user.Locked = 0
-			user.LockedAt = time.Time{}
-			user.NumErrors = 0
-			err = updateUserSQL(user)
-			if err != nil {
-				return
-			}
-			common.LogWarning(logger).Printf("user %s unlocked\n", user.Email)
-		}
+	err = checkLockInternal(ctx, user)
+	if err != nil {
+		return
 	}
 
-	err = common.CheckPassword(pw, user.Password)
-	if err != nil {
-		// count pw mismatch
+	needsRehash, err := hasher.Verify(pw, user.Password)
+	if errors.Is(err, password.ErrMismatch) {
+		// count pw mismatch, client is locked out after maxNumError
+		// and account is hard locked after maxNumErrorHard
+		hitThrottleInternal(ctx, user.Email)
 		user.NumErrors++
 		common.LogWarning(logger).Printf("user num error: %v\n", user.NumErrors)
-		if user.NumErrors > maxNumError {
-			// lock user
-			user.Locked = 1
-			user.LockedAt = time.Now()
-			common.LogWarning(logger).Printf("user %s locked\n", user.Email)
+		result := models.LoginPasswordMismatch
+		if failures+1 > maxNumError {
+			common.LogWarning(logger).Printf(
+				"user %s locked out for %s\n",
+				user.Email,
+				rabbitrpc.ClientFrom(ctx).IP,
+			)
+			result = models.LoginLockedOut
 		}
-		err = updateUserSQL(user)
+		cols := []string{"num_errors"}
+		if user.NumErrors >= maxNumErrorHard {
+			lockInternal(user, lockedByPasswordErrors)
+			cols = lockCols
+			result = models.LoginLockedOut
+		}
+		recordLoginInternal(ctx, user.Id, user.Email, result)
+		err = updateUserSQL(user, cols...)
+		if err != nil {
+			return
+		}
+		err = rabbitrpc.NewError(
+			rabbitrpc.CodeUnauthenticated,
+			"email or password mismatch",
+		)
+		return
+	}
+	if err != nil {
+		return
+	}
+	resetThrottleInternal(ctx, user.Email)
+	if user.NumErrors > 0 {
+		user.NumErrors = 0
+		err = updateUserSQL(user, "num_errors")
 		if err != nil {
 			return
 		}
-		err = errors.New("password mismatch")
+	}
+	if needsRehash {
+		rehashPasswordInternal(user, pw)
+	}
+
+	// second step is verifyTotp
+	if user.IsTotpEnabled() {
+		user.TotpTicket, err = jose.MakeSignedToken(
+			totpTicketPurpose,
+			user.UuId,
+			totpTicketExp,
+		)
+		if err == nil {
+			recordLoginInternal(ctx, user.Id, user.Email, models.LoginTotpRequired)
+		}
+		return
+	}
+
+	err = issueTokensInternal(user)
+	if err == nil {
+		recordLoginInternal(ctx, user.Id, user.Email, models.LoginSucceeded)
+	}
+	return
+}
+
+// hash with outdated algorithm or parameters is replaced,
+// login goes on even if it fails
+func rehashPasswordInternal(user *models.User, pw string) {
+	hashed, err := hasher.Hash(pw)
+	if err == nil {
+		user.Password = hashed
+		err = updateUserSQL(user, "password")
+	}
+	if err != nil {
+		common.LogError(logger).Printf(
+			"rehashing password of %s failed: %s\n",
+			user.Email,
+			err.Error(),
+		)
+		return
+	}
+	common.LogInfo(logger).Printf("password of %s is rehashed\n", user.Email)
+}
+
+// returns error while locked, unlocks user after lock duration
+func checkLockInternal(ctx context.Context, user *models.User) (err error) {
+	if user.Locked == 0 {
+		return
+	}
+	if user.Locked == lockedByAdmin ||
+		user.Locked == lockedByPasswordErrors ||
+		user.LockedAt.Add(lockDuration).After(time.Now()) {
+		// within lock duration
+		recordLoginInternal(ctx, user.Id, user.Email, models.LoginLocked)
+		err = rabbitrpc.NewError(rabbitrpc.CodeLocked, "user locked")
+		return
+	}
+
+	// unlock user
+	user.Locked = 0
+	user.LockedAt = time.Time{}
+	user.NumErrors = 0
+	user.TotpNumErrors = 0
+	err = updateUserSQL(user, lockCols...)
+	if err != nil {
+		return
+	}
+	common.LogWarning(logger).Printf("user %s unlocked\n", user.Email)
+	recordLoginInternal(ctx, user.Id, user.Email, models.LoginUnlocked)
+	return
+}
+
+// caller updates lockCols
+func lockInternal(user *models.User, locked uint) {
+	user.Locked = locked
+	user.LockedAt = time.Now()
+	common.LogWarning(logger).Printf("user %s locked\n", user.Email)
+}
+
+// access token and refresh token of new family, not saved in users
+func issueTokensInternal(user *models.User) (err error) {
+	user.Token, err = issueAccessTokenInternal(user)
+	if err != nil {
 		return
 	}
+	user.RefreshToken, err = createRefreshTokenInternal(user.Id)
+	return
+}
 
+func issueAccessTokenInternal(user *models.User) (token string, err error) {
 	clm, err := jose.NewClaims(user.Email, audienceName)
 	if err != nil {
 		return
 	}
-	scp := jose.NewScope()
+	scp := jose.NewScope(user.Scopes()...)
 	token, err = jose.MakeJWT(clm, scp)
 	return
 }
@@ -153,14 +305,19 @@ func readUserSQL(user *models.User) (err error) {
 		Table(usersTable).
 		Get(user)
 	if err == nil && !ok {
-		err = errors.New("no such user")
+		err = rabbitrpc.NewError(rabbitrpc.CodeNotFound, "no such user")
 	}
 	return
 }
 
-func updateUserSQL(user *models.User) (err error) {
+// columns of lock state
+var lockCols = []string{"num_errors", "totp_num_errors", "locked", "locked_at"}
+
+// cols are needed for updating to zero values
+func updateUserSQL(user *models.User, cols ...string) (err error) {
 	affected, err := dbEngine.Table(usersTable).
 		ID(user.Id).
+		Cols(cols...).
 		Update(user)
 	if err == nil && affected != 1 {
 		err = fmt.Errorf(
@@ -171,52 +328,69 @@ func updateUserSQL(user *models.User) (err error) {
 	return
 }
 
-func lockUser(user *models.User, corrId string) {
-	err := lockUserInternal(user)
+// locked by admin until unlockUser, logged out everywhere
+func lockUser(ctx context.Context, user *models.User) (*models.User, error) {
+	found, err := readOtherUserInternal(ctx, user.Email)
 	if err != nil {
-		common.HandleError(server, logger, err.Error(), corrId)
-		return
+		return nil, err
 	}
+	err = lockUserInternal(found)
+	if err != nil {
+		return nil, err
+	}
+	recordLoginInternal(ctx, found.Id, found.Email, models.LoginLockedByAdmin)
 
-	common.LogWarning(logger).Printf("user %s is locked", user.Email)
-
-	user.Password = ""
-	user.Salt = ""
+	common.LogWarning(logger).Printf("user %s is locked", found.Email)
 
-	common.SendOK(server, user, "User", corrId)
+	return publicUser(found), nil
 }
 
 func lockUserInternal(user *models.User) (err error) {
-	if common.IsEmpty(user.Email) {
-		err = errors.New("need email")
+	user.Locked = lockedByAdmin
+	user.LockedAt = time.Now()
+	err = updateUserSQL(user, lockCols...)
+	if err != nil {
 		return
 	}
-	user.Password = ""
+	err = revokeAllTokensInternal(user)
+	return
+}
 
-	err = readUserSQL(user)
+// new role is in tokens issued after this
+func setRoleInternal(email, role string) (err error) {
+	if !models.IsRole(role) {
+		err = rabbitrpc.NewError(rabbitrpc.CodeInvalidArgument, "unknown role")
+		return
+	}
+	user, err := readUserByEmailInternal(email)
 	if err != nil {
 		return
 	}
-
-	user.Locked = 1
-	user.LockedAt = time.Now()
-	err = updateUserSQL(user)
+	user.Role = role
+	err = updateUserSQL(user, "role")
 	return
 }
 
-func verifyToken(token *common.Token, corrId string) (err error) {
-	err = jose.VerifyJWT(
+// returns owner of the token as caller, without user id
+func verifyToken(ctx context.Context, token *common.Token,
+) (*rabbitrpc.Caller, error) {
+	scopes, err := jose.VerifyJWT(
 		token.Raw,
 		token.UserEmail,
 		audienceName,
 	)
+	if errors.Is(err, jose.ErrRevocationCheckFailed) {
+		return nil, err
+	}
 	if err != nil {
-		common.HandleError(server, logger, err.Error(), corrId)
+		return nil, rabbitrpc.NewError(
+			rabbitrpc.CodeUnauthenticated,
+			err.Error(),
+		)
 	}
 
-	msg := common.SimpleMessage{
-		Message: "verified",
-	}
-	common.SendOK(server, &msg, "SimpleMessage", corrId)
-	return
+	return &rabbitrpc.Caller{
+		Email:  token.UserEmail,
+		Scopes: scopes,
+	}, nil
 }
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"learning-web-chatboard4/common"
+	"learning-web-chatboard4/common/models"
+	"learning-web-chatboard4/rabbitrpc"
+	"learning-web-chatboard4/session"
+	"strings"
+	"time"
+)
+
+// soft throttling of logins. failures are counted by the pair of email and
+// client ip, and by client ip in a sliding window, attempts are refused with
+// progressive delays without checking password. unlike users.locked it is
+// not stored in users and ends by itself, so it slows guessing down
+// without locking the account.
+// delays and lock out of the pair only stop the client which failed,
+// so others can't keep the owner from logging in.
+// failures of an email from every client are only logged
+const (
+	throttleWindow = time.Minute * 15
+	// failures before delays start
+	pairSoftLimit = 3
+	ipSoftLimit   = 10
+	// failures from an ip before it is refused until window passes,
+	// against credential stuffing across many accounts
+	ipHardLimit = 100
+	// failures of an email from every client before it is logged
+	// as being attacked
+	emailAlertLimit   = 50
+	throttleBaseDelay = time.Second
+	throttleMaxDelay  = time.Minute * 5
+)
+
+var limiter session.Limiter
+
+func emailThrottleKey(email string) string {
+	return "login-email:" + strings.ToLower(email)
+}
+
+func ipThrottleKey(ip string) string {
+	return "login-ip:" + ip
+}
+
+func pairThrottleKey(ctx context.Context, email string) string {
+	return pairThrottlePrefix(email) + rabbitrpc.ClientFrom(ctx).IP
+}
+
+// email has no '|' after '@', so prefix of an email doesn't match others
+func pairThrottlePrefix(email string) string {
+	return "login-pair:" + strings.ToLower(email) + "|"
+}
+
+// returns failures of the email from the client ip within lockDuration,
+// and locked error over maxNumError
+func checkPairLockInternal(ctx context.Context, email string,
+) (failures int, err error) {
+	hits, err := limiter.Peek(pairThrottleKey(ctx, email), lockDuration)
+	if err != nil {
+		common.LogError(logger).Println(err.Error())
+		err = nil
+		return
+	}
+	failures = hits.Count
+	if failures > maxNumError {
+		recordLoginInternal(ctx, 0, email, models.LoginLocked)
+		err = rabbitrpc.NewError(rabbitrpc.CodeLocked, "user locked")
+	}
+	return
+}
+
+// returns rate limited error while the client should wait.
+// limiter errors are only logged, logins are not stopped by them
+func checkThrottleInternal(ctx context.Context, email string) (err error) {
+	wait, err := throttleWaitInternal(ctx, email)
+	if err != nil {
+		common.LogError(logger).Println(err.Error())
+		err = nil
+		return
+	}
+	if wait <= 0 {
+		return
+	}
+
+	recordLoginInternal(ctx, 0, email, models.LoginThrottled)
+	err = rabbitrpc.NewError(
+		rabbitrpc.CodeRateLimited,
+		fmt.Sprintf(
+			"too many attempts, try again in %d seconds",
+			int(wait.Seconds())+1,
+		),
+	)
+	return
+}
+
+func throttleWaitInternal(ctx context.Context, email string,
+) (wait time.Duration, err error) {
+	hits, err := limiter.Peek(emailThrottleKey(email), throttleWindow)
+	if err != nil {
+		return
+	}
+	if hits.Count >= emailAlertLimit {
+		common.LogWarning(logger).Printf(
+			"%d failures of %s within %s\n",
+			hits.Count,
+			email,
+			throttleWindow,
+		)
+	}
+
+	hits, err = limiter.Peek(pairThrottleKey(ctx, email), throttleWindow)
+	if err != nil {
+		return
+	}
+	wait = delayOf(hits, pairSoftLimit)
+
+	ip := rabbitrpc.ClientFrom(ctx).IP
+	if common.IsEmpty(ip) {
+		return
+	}
+	hits, err = limiter.Peek(ipThrottleKey(ip), throttleWindow)
+	if err != nil {
+		return
+	}
+	if hits.Count >= ipHardLimit {
+		// refused until failures of the ip leave the window
+		wait = time.Until(hits.Last.Add(throttleWindow))
+		return
+	}
+	if ipWait := delayOf(hits, ipSoftLimit); ipWait > wait {
+		wait = ipWait
+	}
+	return
+}
+
+// base delay doubles for each failure over softLimit, from the last failure
+func delayOf(hits session.Hits, softLimit int) time.Duration {
+	if hits.Count < softLimit {
+		return 0
+	}
+	delay := throttleMaxDelay
+	if over := hits.Count - softLimit; over < 16 {
+		delay = throttleBaseDelay << over
+	}
+	if delay > throttleMaxDelay {
+		delay = throttleMaxDelay
+	}
+	return time.Until(hits.Last.Add(delay))
+}
+
+// failed password or unknown email
+func hitThrottleInternal(ctx context.Context, email string) {
+	err := limiter.Hit(emailThrottleKey(email), throttleWindow)
+	if err != nil {
+		common.LogError(logger).Println(err.Error())
+	}
+	err = limiter.Hit(pairThrottleKey(ctx, email), lockDuration)
+	if err != nil {
+		common.LogError(logger).Println(err.Error())
+	}
+
+	ip := rabbitrpc.ClientFrom(ctx).IP
+	if common.IsEmpty(ip) {
+		return
+	}
+	err = limiter.Hit(ipThrottleKey(ip), throttleWindow)
+	if err != nil {
+		common.LogError(logger).Println(err.Error())
+	}
+}
+
+// correct password clears failures of the email, not of the ip,
+// or one known account would let ip try others
+func resetThrottleInternal(ctx context.Context, email string) {
+	err := limiter.Reset(emailThrottleKey(email))
+	if err != nil {
+		common.LogError(logger).Println(err.Error())
+	}
+	err = limiter.Reset(pairThrottleKey(ctx, email))
+	if err != nil {
+		common.LogError(logger).Println(err.Error())
+	}
+}
+
+// failures of the email from every client are cleared,
+// for unlock by admin and password reset
+func clearThrottleInternal(email string) {
+	err := limiter.Reset(emailThrottleKey(email))
+	if err != nil {
+		common.LogError(logger).Println(err.Error())
+	}
+	err = limiter.ResetPrefix(pairThrottlePrefix(email))
+	if err != nil {
+		common.LogError(logger).Println(err.Error())
+	}
+}
+
+// counts a request of key, rate limited error when limit is reached
+// within window. limiter errors are only logged
+func limitRequestInternal(key string, limit int, window time.Duration) (err error) {
+	hits, err := limiter.Peek(key, window)
+	if err != nil {
+		common.LogError(logger).Println(err.Error())
+		err = nil
+		return
+	}
+	if hits.Count >= limit {
+		err = rabbitrpc.NewError(rabbitrpc.CodeRateLimited, "too many requests")
+		return
+	}
+
+	err = limiter.Hit(key, window)
+	if err != nil {
+		common.LogError(logger).Println(err.Error())
+		err = nil
+	}
+	return
+}
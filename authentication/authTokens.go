@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"learning-web-chatboard4/common"
+	"learning-web-chatboard4/common/models"
+	"learning-web-chatboard4/jose"
+	"learning-web-chatboard4/rabbitrpc"
+	"time"
+)
+
+const (
+	refreshTokenExp = time.Hour * 24
+	// parallel requests of one browser may refresh with same token,
+	// reuse within this is not taken as theft
+	refreshReuseGrace = time.Second * 10
+)
+
+var errorInvalidRefreshToken = rabbitrpc.NewError(
+	rabbitrpc.CodeUnauthenticated,
+	"refresh token is invalid or expired",
+)
+
+// starts new family
+func createRefreshTokenInternal(userId uint) (token string, err error) {
+	token, err = newRandomToken()
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	err = createRefreshTokenSQL(&models.RefreshToken{
+		UserId:    userId,
+		TokenHash: hashToken(token),
+		Family:    common.NewUuIdString(),
+		ExpiresAt: now.Add(refreshTokenExp),
+		CreatedAt: now,
+	})
+	return
+}
+
+func createRefreshTokenSQL(refresh *models.RefreshToken) (err error) {
+	affected, err := dbEngine.
+		Table(refreshTokensTable).
+		InsertOne(refresh)
+	if err == nil && affected != 1 {
+		err = fmt.Errorf(
+			"something wrong. returned value was %d",
+			affected,
+		)
+	}
+	return
+}
+
+// token.Refresh is exchanged for new access token and refresh token
+func refreshToken(ctx context.Context, token *common.Token) (*models.User, error) {
+	user, err := refreshTokenInternal(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.User{
+		Id:         user.Id,
+		UuId:       user.UuId,
+		Name:       user.Name,
+		Email:      user.Email,
+		VerifiedAt: user.VerifiedAt,
+		// not saved in database
+		Token:        user.Token,
+		RefreshToken: user.RefreshToken,
+	}, nil
+}
+
+func refreshTokenInternal(ctx context.Context, token *common.Token,
+) (user *models.User, err error) {
+	if common.IsEmpty(token.Refresh) {
+		err = rabbitrpc.NewError(
+			rabbitrpc.CodeInvalidArgument,
+			"need refresh token",
+		)
+		return
+	}
+
+	next, err := newRandomToken()
+	if err != nil {
+		return
+	}
+	userId, err := rotateRefreshTokenSQL(hashToken(token.Refresh), hashToken(next))
+	if err != nil {
+		return
+	}
+
+	user = &models.User{Id: userId}
+	err = readUserSQL(user)
+	if err != nil {
+		return
+	}
+	// refresh can't be used to stay logged in while locked
+	err = checkLockInternal(ctx, user)
+	if err != nil {
+		return
+	}
+
+	user.Token, err = issueAccessTokenInternal(user)
+	if err != nil {
+		return
+	}
+	user.RefreshToken = next
+	return
+}
+
+// used token is replaced with nextHash in same family.
+// reused token is taken as stolen and the family is revoked
+func rotateRefreshTokenSQL(tokenHash, nextHash string) (userId uint, err error) {
+	sess := dbEngine.NewSession()
+	defer sess.Close()
+
+	err = sess.Begin()
+	if err != nil {
+		return
+	}
+
+	now := time.Now()
+	refresh := &models.RefreshToken{}
+	ok, err := sess.
+		Table(refreshTokensTable).
+		Where("token_hash = ?", tokenHash).
+		ForUpdate().
+		Get(refresh)
+	if err == nil && (!ok ||
+		!refresh.RevokedAt.IsZero() ||
+		refresh.ExpiresAt.Before(now)) {
+		err = errorInvalidRefreshToken
+	}
+	if err != nil {
+		sess.Rollback()
+		return
+	}
+
+	if !refresh.UsedAt.IsZero() {
+		sess.Rollback()
+		err = errorInvalidRefreshToken
+		if now.Sub(refresh.UsedAt) < refreshReuseGrace {
+			return
+		}
+		common.LogWarning(logger).Printf(
+			"refresh token reused, revoking family %s of user %d\n",
+			refresh.Family,
+			refresh.UserId,
+		)
+		_, revokeErr := dbEngine.
+			Table(refreshTokensTable).
+			Where("family = ? AND revoked_at IS NULL", refresh.Family).
+			Cols("revoked_at").
+			Update(&models.RefreshToken{RevokedAt: now})
+		if revokeErr != nil {
+			err = revokeErr
+		}
+		return
+	}
+
+	_, err = sess.
+		Table(refreshTokensTable).
+		ID(refresh.Id).
+		Cols("used_at").
+		Update(&models.RefreshToken{UsedAt: now})
+	if err != nil {
+		sess.Rollback()
+		return
+	}
+
+	_, err = sess.
+		Table(refreshTokensTable).
+		InsertOne(&models.RefreshToken{
+			UserId:    refresh.UserId,
+			TokenHash: nextHash,
+			Family:    refresh.Family,
+			ExpiresAt: now.Add(refreshTokenExp),
+			CreatedAt: now,
+		})
+	if err != nil {
+		sess.Rollback()
+		return
+	}
+
+	err = sess.Commit()
+	userId = refresh.UserId
+	return
+}
+
+// revokes access token in token.Raw and family of token.Refresh, for logout
+func revokeToken(ctx context.Context, token *common.Token,
+) (*common.SimpleMessage, error) {
+	err := revokeTokenInternal(token)
+	if err != nil {
+		return nil, err
+	}
+
+	return &common.SimpleMessage{
+		Message: "revoked",
+	}, nil
+}
+
+func revokeTokenInternal(token *common.Token) (err error) {
+	if !common.IsEmpty(token.Raw) {
+		// expired or broken token can't be used anyway
+		clm, _, readErr := jose.ReadJWT(token.Raw)
+		if readErr == nil && clm.Expiry != nil {
+			err = revokeAccessTokenSQL(clm.ID, clm.Expiry.Time())
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	if !common.IsEmpty(token.Refresh) {
+		err = revokeRefreshFamilySQL(hashToken(token.Refresh))
+	}
+	return
+}
+
+// expired rows are not needed for checking, removed here
+func revokeAccessTokenSQL(jti string, expiresAt time.Time) (err error) {
+	now := time.Now()
+	_, err = dbEngine.
+		Table(revokedTokensTable).
+		Where("expires_at < ?", now).
+		Delete(&models.RevokedToken{})
+	if err != nil {
+		return
+	}
+
+	_, err = dbEngine.
+		Table(revokedTokensTable).
+		InsertOne(&models.RevokedToken{
+			Jti:       jti,
+			ExpiresAt: expiresAt,
+			CreatedAt: now,
+		})
+	if common.IsUniqueViolation(err) {
+		// already revoked
+		err = nil
+	}
+	return
+}
+
+func revokeRefreshFamilySQL(tokenHash string) (err error) {
+	_, err = dbEngine.Exec(
+		`UPDATE refresh_tokens SET revoked_at = $1
+		 WHERE revoked_at IS NULL AND family IN
+		   (SELECT family FROM refresh_tokens WHERE token_hash = $2)`,
+		time.Now(),
+		tokenHash,
+	)
+	return
+}
+
+// log out everywhere. access tokens issued before now and
+// every refresh token of the caller are revoked
+func revokeAllTokens(ctx context.Context, user *models.User,
+) (*common.SimpleMessage, error) {
+	caller, err := rabbitrpc.RequireScope(ctx, models.ScopeRead)
+	if err != nil {
+		return nil, err
+	}
+	err = revokeAllTokensInternal(&models.User{Email: caller.Email})
+	if err != nil {
+		return nil, err
+	}
+
+	return &common.SimpleMessage{
+		Message: "revoked",
+	}, nil
+}
+
+func revokeAllTokensInternal(user *models.User) (err error) {
+	found, err := readUserByEmailInternal(user.Email)
+	if err != nil {
+		return
+	}
+
+	now := time.Now()
+	found.TokensNotBefore = tokensNotBefore(now)
+	err = updateUserSQL(found, "tokens_not_before")
+	if err != nil {
+		return
+	}
+
+	_, err = dbEngine.
+		Table(refreshTokensTable).
+		Where("user_id = ? AND revoked_at IS NULL", found.Id).
+		Cols("revoked_at").
+		Update(&models.RefreshToken{RevokedAt: now})
+	if err != nil {
+		return
+	}
+	common.LogInfo(logger).Printf(
+		"all tokens of user %s are revoked\n",
+		found.Email,
+	)
+	return
+}
+
+// jose.RevocationCheck, subject is email
+func isTokenRevoked(jti, subject string, issuedAt time.Time) (revoked bool, err error) {
+	revoked, err = dbEngine.
+		Table(revokedTokensTable).
+		Where("jti = ?", jti).
+		Exist(&models.RevokedToken{})
+	if err != nil || revoked {
+		return
+	}
+
+	revoked, err = dbEngine.
+		Table(usersTable).
+		Where("email = ? AND tokens_not_before > ?", subject, issuedAt).
+		Exist(&models.User{})
+	return
+}
+
+// jwt iat has seconds only, tokens_not_before is truncated the same way.
+// token issued in the same second is accepted, so a new login right after
+// revocation is not refused
+func tokensNotBefore(now time.Time) time.Time {
+	return now.Truncate(time.Second)
+}
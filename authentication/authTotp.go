@@ -0,0 +1,479 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"learning-web-chatboard4/common"
+	"learning-web-chatboard4/common/models"
+	"learning-web-chatboard4/jose"
+	"learning-web-chatboard4/rabbitrpc"
+	"learning-web-chatboard4/totp"
+	"strings"
+	"time"
+)
+
+const (
+	totpIssuer        = "KEIJIBAN"
+	totpTicketPurpose = "login-totp"
+	totpTicketExp     = time.Minute * 5
+	maxTotpErrors     = 5
+	numRecoveryCodes  = 10
+	recoveryCodeSize  = 10
+	// xxxx-xxxx-xxxx-xxxx
+	recoveryGroupSize = 4
+)
+
+var recoveryEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+var errorInvalidTotpTicket = rabbitrpc.NewError(
+	rabbitrpc.CodeUnauthenticated,
+	"login expired, log in again",
+)
+
+var errorInvalidTotpCode = rabbitrpc.NewError(
+	rabbitrpc.CodeUnauthenticated,
+	"invalid code",
+)
+
+// second step of login, ticket is what readUser returned
+func verifyTotp(ctx context.Context, login *models.TotpCode) (*models.User, error) {
+	user, err := verifyTotpInternal(ctx, login)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.User{
+		Id:         user.Id,
+		UuId:       user.UuId,
+		Name:       user.Name,
+		Email:      user.Email,
+		VerifiedAt: user.VerifiedAt,
+		// not saved in database
+		Token:        user.Token,
+		RefreshToken: user.RefreshToken,
+	}, nil
+}
+
+func verifyTotpInternal(ctx context.Context, login *models.TotpCode,
+) (user *models.User, err error) {
+	if common.IsEmpty(login.Ticket, login.Code) {
+		err = rabbitrpc.NewError(
+			rabbitrpc.CodeInvalidArgument,
+			"need ticket and code",
+		)
+		return
+	}
+	uuid, err := jose.VerifySignedToken(login.Ticket, totpTicketPurpose)
+	if err != nil {
+		common.LogWarning(logger).Println(err.Error())
+		err = errorInvalidTotpTicket
+		return
+	}
+
+	user = &models.User{UuId: uuid}
+	err = readUserSQL(user)
+	if rabbitrpc.CodeOf(err) == rabbitrpc.CodeNotFound {
+		err = errorInvalidTotpTicket
+	}
+	if err != nil {
+		return
+	}
+	if !user.IsTotpEnabled() {
+		err = errorInvalidTotpTicket
+		return
+	}
+
+	err = checkLockInternal(ctx, user)
+	if err != nil {
+		return
+	}
+
+	err = checkTotpCodeInternal(ctx, user, login.Code)
+	if err != nil {
+		return
+	}
+
+	err = issueTokensInternal(user)
+	if err == nil {
+		recordLoginInternal(ctx, user.Id, user.Email, models.LoginSucceeded)
+	}
+	return
+}
+
+// code is totp or recovery code.
+// mismatch is counted and locks user like password mismatch
+func checkTotpCodeInternal(ctx context.Context, user *models.User, code string,
+) (err error) {
+	ok, err := matchTotpCodeInternal(user, code)
+	if err != nil {
+		return
+	}
+	if !ok {
+		user.TotpNumErrors++
+		common.LogWarning(logger).Printf(
+			"user totp num error: %v\n",
+			user.TotpNumErrors,
+		)
+		result := models.LoginTotpMismatch
+		if user.TotpNumErrors > maxTotpErrors {
+			lockInternal(user, lockedByErrors)
+			result = models.LoginLockedOut
+		}
+		recordLoginInternal(ctx, user.Id, user.Email, result)
+		err = updateUserSQL(user, lockCols...)
+		if err != nil {
+			return
+		}
+		err = errorInvalidTotpCode
+		return
+	}
+
+	user.TotpNumErrors = 0
+	err = updateUserSQL(user, "totp_num_errors", "totp_last_step")
+	return
+}
+
+// updates user.TotpLastStep when totp matched
+func matchTotpCodeInternal(user *models.User, code string) (ok bool, err error) {
+	code = normalizeCode(code)
+	if len(code) == totp.Digits {
+		var step int64
+		step, ok, err = totp.Validate(
+			user.TotpSecret,
+			code,
+			time.Now(),
+			user.TotpLastStep,
+		)
+		if ok {
+			user.TotpLastStep = step
+		}
+		return
+	}
+
+	ok, err = useRecoveryCodeSQL(user.Id, hashRecoveryCode(code))
+	if ok {
+		common.LogWarning(logger).Printf(
+			"user %s used a recovery code\n",
+			user.Email,
+		)
+	}
+	return
+}
+
+// new secret is stored but not used until enableTotp.
+// pending secret is returned again, so reloading keeps the qr code valid
+func beginTotp(ctx context.Context, user *models.User,
+) (*models.TotpEnrollment, error) {
+	enrollment, err := beginTotpInternal(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return enrollment, nil
+}
+
+func beginTotpInternal(ctx context.Context) (enrollment *models.TotpEnrollment, err error) {
+	found, err := readCallerInternal(ctx)
+	if err != nil {
+		return
+	}
+	if found.IsTotpEnabled() {
+		enrollment = &models.TotpEnrollment{Enabled: true}
+		return
+	}
+
+	if common.IsEmpty(found.TotpSecret) {
+		found.TotpSecret, err = totp.GenerateSecret()
+		if err != nil {
+			return
+		}
+		err = updateUserSQL(found, "totp_secret")
+		if err != nil {
+			return
+		}
+	}
+
+	enrollment = &models.TotpEnrollment{
+		Secret: found.TotpSecret,
+		URI:    totp.URI(totpIssuer, found.Email, found.TotpSecret),
+	}
+	return
+}
+
+// code from the app confirms the secret was saved,
+// recovery codes are returned only here
+func enableTotp(ctx context.Context, login *models.TotpCode,
+) (*models.TotpEnrollment, error) {
+	codes, err := enableTotpInternal(ctx, login)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.TotpEnrollment{
+		Enabled:       true,
+		RecoveryCodes: codes,
+	}, nil
+}
+
+func enableTotpInternal(ctx context.Context, login *models.TotpCode,
+) (codes []string, err error) {
+	if common.IsEmpty(login.Code) {
+		err = rabbitrpc.NewError(rabbitrpc.CodeInvalidArgument, "need code")
+		return
+	}
+	user, err := readCallerInternal(ctx)
+	if err != nil {
+		return
+	}
+	if user.IsTotpEnabled() {
+		err = rabbitrpc.NewError(
+			rabbitrpc.CodeConflict,
+			"two factor is already enabled",
+		)
+		return
+	}
+	if common.IsEmpty(user.TotpSecret) {
+		err = rabbitrpc.NewError(
+			rabbitrpc.CodeInvalidArgument,
+			"two factor setup is not started",
+		)
+		return
+	}
+
+	step, ok, err := totp.Validate(
+		user.TotpSecret,
+		normalizeCode(login.Code),
+		time.Now(),
+		user.TotpLastStep,
+	)
+	if err != nil {
+		return
+	}
+	if !ok {
+		err = errorInvalidTotpCode
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return
+	}
+	user.TotpEnabledAt = time.Now()
+	user.TotpLastStep = step
+	user.TotpNumErrors = 0
+	err = enableTotpSQL(user, hashes)
+	return
+}
+
+// code is needed so stolen session can't turn two factor off
+func disableTotp(ctx context.Context, login *models.TotpCode,
+) (*common.SimpleMessage, error) {
+	err := disableTotpInternal(ctx, login)
+	if err != nil {
+		return nil, err
+	}
+
+	return &common.SimpleMessage{
+		Message: "two factor disabled",
+	}, nil
+}
+
+func disableTotpInternal(ctx context.Context, login *models.TotpCode) (err error) {
+	if common.IsEmpty(login.Code) {
+		err = rabbitrpc.NewError(rabbitrpc.CodeInvalidArgument, "need code")
+		return
+	}
+	user, err := readCallerInternal(ctx)
+	if err != nil {
+		return
+	}
+	if !user.IsTotpEnabled() {
+		return
+	}
+
+	err = checkLockInternal(ctx, user)
+	if err != nil {
+		return
+	}
+	err = checkTotpCodeInternal(ctx, user, login.Code)
+	if err != nil {
+		return
+	}
+
+	err = disableTotpSQL(user)
+	return
+}
+
+// logged in user making the request, email in request body is not trusted
+func readCallerInternal(ctx context.Context) (user *models.User, err error) {
+	caller, err := rabbitrpc.RequireScope(ctx, models.ScopeRead)
+	if err != nil {
+		return
+	}
+	user, err = readUserByEmailInternal(caller.Email)
+	return
+}
+
+func readUserByEmailInternal(email string) (user *models.User, err error) {
+	if common.IsEmpty(email) {
+		err = rabbitrpc.NewError(rabbitrpc.CodeInvalidArgument, "need email")
+		return
+	}
+	user = &models.User{Email: email}
+	err = readUserSQL(user)
+	return
+}
+
+// recovery codes
+
+func newRecoveryCodes() (codes, hashes []string, err error) {
+	for i := 0; i < numRecoveryCodes; i++ {
+		bytes := make([]byte, recoveryCodeSize)
+		_, err = rand.Read(bytes)
+		if err != nil {
+			return
+		}
+		code := recoveryEncoding.EncodeToString(bytes)
+		codes = append(codes, formatRecoveryCode(code))
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return
+}
+
+func formatRecoveryCode(code string) string {
+	var groups []string
+	for len(code) > recoveryGroupSize {
+		groups = append(groups, code[:recoveryGroupSize])
+		code = code[recoveryGroupSize:]
+	}
+	groups = append(groups, code)
+	return strings.Join(groups, "-")
+}
+
+// users type codes with spaces, hyphens and lower case
+func normalizeCode(code string) string {
+	code = strings.ToUpper(code)
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, code)
+}
+
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// marks the code used, false if not found or already used
+func useRecoveryCodeSQL(userId uint, codeHash string) (ok bool, err error) {
+	affected, err := dbEngine.
+		Table(recoveryCodesTable).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userId, codeHash).
+		Cols("used_at").
+		Update(&models.RecoveryCode{UsedAt: time.Now()})
+	ok = err == nil && affected == 1
+	return
+}
+
+// old recovery codes are replaced
+func enableTotpSQL(user *models.User, hashes []string) (err error) {
+	sess := dbEngine.NewSession()
+	defer sess.Close()
+
+	err = sess.Begin()
+	if err != nil {
+		return
+	}
+
+	_, err = sess.
+		Table(recoveryCodesTable).
+		Where("user_id = ?", user.Id).
+		Delete(&models.RecoveryCode{})
+	if err != nil {
+		sess.Rollback()
+		return
+	}
+
+	now := time.Now()
+	codes := make([]*models.RecoveryCode, 0, len(hashes))
+	for _, hash := range hashes {
+		codes = append(codes, &models.RecoveryCode{
+			UserId:    user.Id,
+			CodeHash:  hash,
+			CreatedAt: now,
+		})
+	}
+	_, err = sess.
+		Table(recoveryCodesTable).
+		Insert(&codes)
+	if err != nil {
+		sess.Rollback()
+		return
+	}
+
+	affected, err := sess.
+		Table(usersTable).
+		ID(user.Id).
+		Cols("totp_enabled_at", "totp_last_step", "totp_num_errors").
+		Update(user)
+	if err == nil && affected != 1 {
+		err = fmt.Errorf(
+			"something wrong. returned value was %d",
+			affected,
+		)
+	}
+	if err != nil {
+		sess.Rollback()
+		return
+	}
+
+	err = sess.Commit()
+	return
+}
+
+func disableTotpSQL(user *models.User) (err error) {
+	sess := dbEngine.NewSession()
+	defer sess.Close()
+
+	err = sess.Begin()
+	if err != nil {
+		return
+	}
+
+	_, err = sess.
+		Table(recoveryCodesTable).
+		Where("user_id = ?", user.Id).
+		Delete(&models.RecoveryCode{})
+	if err != nil {
+		sess.Rollback()
+		return
+	}
+
+	user.TotpSecret = ""
+	user.TotpEnabledAt = time.Time{}
+	user.TotpLastStep = 0
+	user.TotpNumErrors = 0
+	affected, err := sess.
+		Table(usersTable).
+		ID(user.Id).
+		Cols("totp_secret", "totp_enabled_at", "totp_last_step", "totp_num_errors").
+		Update(user)
+	if err == nil && affected != 1 {
+		err = fmt.Errorf(
+			"something wrong. returned value was %d",
+			affected,
+		)
+	}
+	if err != nil {
+		sess.Rollback()
+		return
+	}
+
+	err = sess.Commit()
+	return
+}
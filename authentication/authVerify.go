@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"learning-web-chatboard4/common"
+	"learning-web-chatboard4/common/models"
+	"learning-web-chatboard4/jose"
+	"learning-web-chatboard4/mailer"
+	"learning-web-chatboard4/rabbitrpc"
+	"net/url"
+	"time"
+)
+
+const (
+	verifyPurpose        = "verify-email"
+	verifyTokenExp       = time.Hour * 24
+	verifyPath           = "/user/verify"
+	verifyResendInterval = time.Minute * 5
+	// against flooding many addresses with mails from one client
+	verifyResendWindow = time.Hour
+	maxResendsPerIP    = 10
+)
+
+var errorInvalidVerifyToken = rabbitrpc.NewError(
+	rabbitrpc.CodeInvalidArgument,
+	"verification link is invalid or expired",
+)
+
+// mail is sent after user is stored,
+// failing to send is logged and can be retried with resend
+func sendVerificationInternal(ctx context.Context, user *models.User) (err error) {
+	token, err := jose.MakeSignedToken(
+		verifyPurpose,
+		user.UuId,
+		verifyTokenExp,
+	)
+	if err != nil {
+		return
+	}
+
+	err = mailSender.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf(
+			"Hi %s,\n\n"+
+				"Open the link below to verify your email address.\n"+
+				"%s\n\n"+
+				"The link expires in %d hours.\n",
+			user.Name,
+			verifyLink(token),
+			int(verifyTokenExp/time.Hour),
+		),
+	})
+	if err != nil {
+		return
+	}
+
+	user.VerificationSentAt = time.Now()
+	err = updateUserSQL(user, "verification_sent_at")
+	return
+}
+
+func verifyLink(token string) string {
+	return fmt.Sprintf(
+		"%s%s?token=%s",
+		config.PublicURL,
+		verifyPath,
+		url.QueryEscape(token),
+	)
+}
+
+// returns verified user without secrets
+func verifyEmail(ctx context.Context, token *common.Token) (*models.User, error) {
+	user, err := verifyEmailInternal(token)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.User{
+		Id:         user.Id,
+		UuId:       user.UuId,
+		Name:       user.Name,
+		Email:      user.Email,
+		VerifiedAt: user.VerifiedAt,
+	}, nil
+}
+
+func verifyEmailInternal(token *common.Token) (user *models.User, err error) {
+	if common.IsEmpty(token.Raw) {
+		err = errorInvalidVerifyToken
+		return
+	}
+	uuid, err := jose.VerifySignedToken(token.Raw, verifyPurpose)
+	if err != nil {
+		common.LogWarning(logger).Println(err.Error())
+		err = errorInvalidVerifyToken
+		return
+	}
+
+	user = &models.User{UuId: uuid}
+	err = readUserSQL(user)
+	if rabbitrpc.CodeOf(err) == rabbitrpc.CodeNotFound {
+		err = errorInvalidVerifyToken
+	}
+	if err != nil {
+		return
+	}
+
+	// link can be opened twice
+	if user.IsVerified() {
+		return
+	}
+	// ScopeVerified is in access tokens issued after this
+	user.VerifiedAt = time.Now()
+	err = updateUserSQL(user, "verified_at")
+	return
+}
+
+// unknown, verified or recently mailed email is also ok,
+// so it can't be used for finding registered addresses
+func resendVerification(ctx context.Context, user *models.User,
+) (*common.SimpleMessage, error) {
+	err := resendVerificationInternal(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	return &common.SimpleMessage{
+		Message: "requested",
+	}, nil
+}
+
+func resendVerificationInternal(ctx context.Context, user *models.User) (err error) {
+	if common.IsEmpty(user.Email) {
+		err = rabbitrpc.NewError(rabbitrpc.CodeInvalidArgument, "need email")
+		return
+	}
+	// counted before the email is looked up, same for every email
+	ip := rabbitrpc.ClientFrom(ctx).IP
+	if !common.IsEmpty(ip) {
+		err = limitRequestInternal(
+			"verify-ip:"+ip,
+			maxResendsPerIP,
+			verifyResendWindow,
+		)
+		if err != nil {
+			return
+		}
+	}
+
+	found := &models.User{Email: user.Email}
+	err = readUserSQL(found)
+	if rabbitrpc.CodeOf(err) == rabbitrpc.CodeNotFound {
+		err = nil
+		return
+	}
+	if err != nil || found.IsVerified() {
+		return
+	}
+
+	if time.Since(found.VerificationSentAt) < verifyResendInterval {
+		common.LogWarning(logger).Printf(
+			"verification mail to %s was sent recently\n",
+			found.Email,
+		)
+		return
+	}
+	err = sendVerificationInternal(ctx, found)
+	return
+}
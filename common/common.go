@@ -1,25 +1,29 @@
 package common
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"math/big"
 	"os"
+	"os/signal"
 	"runtime"
+	"syscall"
+	"time"
 	"unicode/utf8"
 
-	"learning-web-chatboard4/rabbitrpc"
-
 	"github.com/google/uuid"
-	_ "github.com/lib/pq"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/lib/pq"
 	"xorm.io/xorm"
 )
 
 type Configuration struct {
 	AddressRouter string `json:"address_router"`
+	// ips or cidrs whose X-Forwarded-For is believed, empty trusts none
+	TrustedProxies []string `json:"trusted_proxies"`
 
 	UsersExchangeName string `json:"Users_exchange_name"`
 	UsersReqQName     string `json:"users_req_q_name"`
@@ -39,14 +43,35 @@ type Configuration struct {
 	TopicsResQName     string `json:"topics_res_q_name"`
 	TopicsClientKey    string `json:"topics_client_key"`
 
-	UseSecureCookie    bool   `json:"use_secure_cookie"`
-	SetHttpOnlyCookie  bool   `json:"set_http_only_cookie"`
-	DbName             string `json:"db_name"`
-	ShowSQL            bool   `json:"show_sql"`
-	LogToFile          bool   `json:"log_to_file"`
-	LogFileNameRouter  string `json:"log_file_name_router"`
-	LogFileNameUsers   string `json:"log_file_name_users"`
-	LogFileNameThreads string `json:"log_file_name_threads"`
+	UseSecureCookie     bool   `json:"use_secure_cookie"`
+	SetHttpOnlyCookie   bool   `json:"set_http_only_cookie"`
+	DbName              string `json:"db_name"`
+	ShowSQL             bool   `json:"show_sql"`
+	LogToFile           bool   `json:"log_to_file"`
+	LogFileNameRouter   string `json:"log_file_name_router"`
+	LogFileNameUsers    string `json:"log_file_name_users"`
+	LogFileNameThreads  string `json:"log_file_name_threads"`
+	LogFileNameSessions string `json:"log_file_name_sessions"`
+	JoseKeysDir         string `json:"jose_keys_dir"`
+	CookieKeysFile      string `json:"cookie_keys_file"`
+	SessionStore        string `json:"session_store"`
+	RedisAddress        string `json:"redis_address"`
+	RedisDB             int    `json:"redis_db"`
+	RedisMaxIdle        int    `json:"redis_max_idle"`
+	RedisMaxActive      int    `json:"redis_max_active"`
+	RedisIdleTimeout    int    `json:"redis_idle_timeout_sec"`
+	PublicURL           string `json:"public_url"`
+	MailSender          string `json:"mail_sender"`
+	MailFrom            string `json:"mail_from"`
+	MailDir             string `json:"mail_dir"`
+	SMTPAddress         string `json:"smtp_address"`
+	SMTPUserName        string `json:"smtp_user_name"`
+	// argon2id or bcrypt, zero values are defaults of password package
+	PasswordAlgorithm     string `json:"password_algorithm"`
+	PasswordArgon2Memory  uint32 `json:"password_argon2_memory_kib"`
+	PasswordArgon2Time    uint32 `json:"password_argon2_time"`
+	PasswordArgon2Threads uint8  `json:"password_argon2_threads"`
+	PasswordBcryptCost    int    `json:"password_bcrypt_cost"`
 }
 
 type SimpleMessage struct {
@@ -56,6 +81,7 @@ type SimpleMessage struct {
 type Token struct {
 	UserEmail string `json:"user_email"`
 	Raw       string `json:"raw"`
+	Refresh   string `json:"refresh"`
 }
 
 const runeSource = "aA1bB2cC3dD4eE5fFgGhHiIjJkKlLm0MnNoOpPqQrRsStTuUvV6wW7xX8yY9zZ"
@@ -66,6 +92,12 @@ const (
 	DbParameter    = "dbname=%s user=%s password=%s host=localhost port=5432 sslmode=disable"
 )
 
+// postgres error code for unique_violation
+const pqUniqueViolation = "23505"
+
+// how long services wait for running requests when shutting down
+const ShutdownTimeout = time.Second * 15
+
 const (
 	LogInfoPrefix    = "[INFO]"
 	LogWarningPrefix = "[WARNING]"
@@ -114,6 +146,15 @@ func OpenDb(
 	return
 }
 
+// returned ctx is done when SIGINT or SIGTERM is received
+func NotifyShutdown() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(
+		context.Background(),
+		os.Interrupt,
+		syscall.SIGTERM,
+	)
+}
+
 // Logging
 
 func OpenLogger(logToFile bool, logFileName string) (logger *log.Logger, err error) {
@@ -159,36 +200,6 @@ func LogError(logger *log.Logger) *log.Logger {
 
 // helpers
 
-// func ProcessPassword(pw, salt string, numStretching int) (hashed string) {
-// 	// see these pkgs
-// 	// https://pkg.go.dev/golang.org/x/crypto/bcrypt
-// 	// https://pkg.go.dev/golang.org/x/crypto/scrypt
-
-// 	asBytes := []byte(fmt.Sprint(salt, pw))
-// 	hash := sha256.New()
-// 	for i := 0; i < numStretching; i++ {
-// 		asBytes = hash.Sum(asBytes)
-// 	}
-// 	hashed = fmt.Sprintf("%x", asBytes)
-
-// 	return
-// }
-
-func ProcessPassword(pw string) (hashed string, err error) {
-	var bytes []byte
-	bytes, err = bcrypt.GenerateFromPassword([]byte(pw), bcrypt.DefaultCost+2)
-	if err != nil {
-		return
-	}
-	hashed = string(bytes)
-	return
-}
-
-func CheckPassword(pw, hashed string) (err error) {
-	err = bcrypt.CompareHashAndPassword([]byte(hashed), []byte(pw))
-	return
-}
-
 func GenerateRandomString(length uint) (str string, err error) {
 	var i uint
 	maxEx := int64(len(runeSource))
@@ -209,6 +220,11 @@ func NewUuIdString() string {
 	return raw.String()
 }
 
+func IsUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == pqUniqueViolation
+}
+
 func IsEmpty(str ...string) bool {
 	for _, s := range str {
 		if utf8.RuneCountInString(s) == 0 {
@@ -217,66 +233,3 @@ func IsEmpty(str ...string) bool {
 	}
 	return false
 }
-
-// rabbit response
-
-func HandleError(
-	server *rabbitrpc.RabbitClient,
-	logger *log.Logger,
-	loggerErrorMsg string,
-	corrId string,
-) {
-	LogError(logger).Println(loggerErrorMsg)
-	SendError(
-		server,
-		&rabbitrpc.RabbitRPCError{
-			What: "internal server error",
-		},
-		corrId,
-	)
-}
-
-func SendError(
-	server *rabbitrpc.RabbitClient,
-	e *rabbitrpc.RabbitRPCError,
-	corrId string,
-) {
-	bin, err := rabbitrpc.MakeBin(
-		0,
-		rabbitrpc.StatusError,
-		"",
-		rabbitrpc.ErrorTypeName,
-		e,
-	)
-	if err != nil {
-		panic(err)
-	}
-
-	server.Publisher.Ch <- rabbitrpc.Raws{
-		Body:          bin,
-		CorrelationId: corrId,
-	}
-}
-
-func SendOK(
-	server *rabbitrpc.RabbitClient,
-	dataPtr interface{},
-	dataName string,
-	corrId string,
-) {
-	bin, err := rabbitrpc.MakeBin(
-		0,
-		rabbitrpc.StatusOK,
-		"",
-		dataName,
-		dataPtr,
-	)
-	if err != nil {
-		panic(err)
-	}
-
-	server.Publisher.Ch <- rabbitrpc.Raws{
-		Body:          bin,
-		CorrelationId: corrId,
-	}
-}
@@ -5,31 +5,182 @@ import (
 	"time"
 )
 
+const (
+	RoleMember    = "member"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+const (
+	ScopeRead     = "read"
+	ScopeWrite    = "write"
+	ScopeModerate = "moderate"
+	ScopeAdmin    = "admin"
+	// not of a role, given while email address is verified
+	ScopeVerified = "verified"
+)
+
+var roleScopes = map[string][]string{
+	RoleMember:    {ScopeRead, ScopeWrite},
+	RoleModerator: {ScopeRead, ScopeWrite, ScopeModerate},
+	RoleAdmin:     {ScopeRead, ScopeWrite, ScopeModerate, ScopeAdmin},
+}
+
 type User struct {
 	Id        uint      `xorm:"pk autoincr 'id'" json:"id"`
 	UuId      string    `xorm:"not null unique 'uu_id'" json:"uuid"`
 	Name      string    `xorm:"not null unique 'name'" json:"name"`
 	Email     string    `xorm:"not null unique 'email'" json:"email"`
 	Password  string    `xorm:"not null 'password'" json:"password"`
-	Salt      string    `xorm:"not null 'salt'" json:"salt"`
 	Token     string    `xorm:"TEXT 'token'" json:"token"`
 	NumErrors uint      `xorm:"num_errors" json:"num_errors"`
 	Locked    uint      `xorm:"locked" json:"locked"`
 	LockedAt  time.Time `xorm:"not null 'locked_at'" json:"locked_at"`
+	// one of Role constants
+	Role string `xorm:"role" json:"role"`
+	// zero until email address is verified
+	VerifiedAt         time.Time `xorm:"verified_at" json:"verified_at"`
+	VerificationSentAt time.Time `xorm:"verification_sent_at" json:"-"`
+	// two factor, secret is stored before enabled
+	TotpSecret    string    `xorm:"totp_secret" json:"-"`
+	TotpEnabledAt time.Time `xorm:"totp_enabled_at" json:"totp_enabled_at"`
+	TotpNumErrors uint      `xorm:"totp_num_errors" json:"-"`
+	TotpLastStep  int64     `xorm:"totp_last_step" json:"-"`
+	// not saved, given instead of token until second step
+	TotpTicket string `xorm:"-" json:"totp_ticket"`
+	// not saved, token is access token
+	RefreshToken string `xorm:"-" json:"refresh_token"`
+	// tokens issued before are revoked, for logging out everywhere
+	TokensNotBefore time.Time `xorm:"tokens_not_before" json:"-"`
+	CreatedAt       time.Time `xorm:"not null 'created_at'" json:"created_at"`
+}
+
+// UserSearch matches part of name or email
+type UserSearch struct {
+	Query string `json:"query"`
+	Limit int    `json:"limit"`
+}
+
+type UserPage struct {
+	Users []User `json:"users"`
+}
+
+// results of Login
+const (
+	LoginSucceeded        = "succeeded"
+	LoginTotpRequired     = "totp_required"
+	LoginUnknownUser      = "unknown_user"
+	LoginPasswordMismatch = "password_mismatch"
+	LoginTotpMismatch     = "totp_mismatch"
+	// refused without checking password, account is not locked
+	LoginThrottled = "throttled"
+	// rejected while locked
+	LoginLocked = "locked"
+	// mismatch which locked the user
+	LoginLockedOut       = "locked_out"
+	LoginUnlocked        = "unlocked"
+	LoginLockedByAdmin   = "locked_by_admin"
+	LoginUnlockedByAdmin = "unlocked_by_admin"
+)
+
+// Login is an authentication attempt or lock event.
+// UserId is zero for unknown email
+type Login struct {
+	Id        uint      `xorm:"pk autoincr 'id'" json:"id"`
+	UserId    uint      `xorm:"user_id" json:"user_id"`
+	Email     string    `xorm:"not null 'email'" json:"email"`
+	Result    string    `xorm:"not null 'result'" json:"result"`
+	IP        string    `xorm:"ip" json:"ip"`
+	UserAgent string    `xorm:"user_agent" json:"user_agent"`
 	CreatedAt time.Time `xorm:"not null 'created_at'" json:"created_at"`
 }
 
+// newest first, Email can be unknown address
+type LoginQuery struct {
+	Email string `json:"email"`
+	Limit int    `json:"limit"`
+}
+
+type LoginPage struct {
+	Logins []Login `json:"logins"`
+}
+
+// token itself is only in mail, hash of it is stored
+type PasswordReset struct {
+	Id        uint      `xorm:"pk autoincr 'id'" json:"id"`
+	UserId    uint      `xorm:"not null 'user_id'" json:"user_id"`
+	TokenHash string    `xorm:"not null unique 'token_hash'" json:"-"`
+	ExpiresAt time.Time `xorm:"not null 'expires_at'" json:"expires_at"`
+	UsedAt    time.Time `xorm:"used_at" json:"used_at"`
+	CreatedAt time.Time `xorm:"not null 'created_at'" json:"created_at"`
+}
+
+// token from reset mail and password to set
+type NewPassword struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// RefreshToken is rotated on every use, tokens of one login share Family.
+// reusing a used token revokes the family
+type RefreshToken struct {
+	Id        uint      `xorm:"pk autoincr 'id'" json:"id"`
+	UserId    uint      `xorm:"not null 'user_id'" json:"user_id"`
+	TokenHash string    `xorm:"not null unique 'token_hash'" json:"-"`
+	Family    string    `xorm:"not null 'family'" json:"family"`
+	ExpiresAt time.Time `xorm:"not null 'expires_at'" json:"expires_at"`
+	UsedAt    time.Time `xorm:"used_at" json:"used_at"`
+	RevokedAt time.Time `xorm:"revoked_at" json:"revoked_at"`
+	CreatedAt time.Time `xorm:"not null 'created_at'" json:"created_at"`
+}
+
+// RevokedToken is access token revoked before expiry
+type RevokedToken struct {
+	Jti       string    `xorm:"pk 'jti'" json:"jti"`
+	ExpiresAt time.Time `xorm:"not null 'expires_at'" json:"expires_at"`
+	CreatedAt time.Time `xorm:"not null 'created_at'" json:"created_at"`
+}
+
+// RecoveryCode is one time code for two factor login without device
+type RecoveryCode struct {
+	Id        uint      `xorm:"pk autoincr 'id'" json:"id"`
+	UserId    uint      `xorm:"not null 'user_id'" json:"user_id"`
+	CodeHash  string    `xorm:"not null 'code_hash'" json:"-"`
+	UsedAt    time.Time `xorm:"used_at" json:"used_at"`
+	CreatedAt time.Time `xorm:"not null 'created_at'" json:"created_at"`
+}
+
+// Ticket from first login step, empty for logged in caller.
+// Code is totp or recovery code
+type TotpCode struct {
+	Ticket string `json:"ticket"`
+	Code   string `json:"code"`
+}
+
+// secret is shown until enabled, recovery codes only once when enabled
+type TotpEnrollment struct {
+	Enabled       bool     `json:"enabled"`
+	Secret        string   `json:"secret"`
+	URI           string   `json:"uri"`
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
 type Session struct {
-	UuId       string    `xorm:"not null unique 'uu_id'" json:"uuid"`
-	State      string    `xorm:"TEXT 'state'" json:"state"`
-	TopicId    uint      `xorm:"topic_id" json:"topic_id"`
-	TopicUuId  string    `xorm:"topic_uu_id" json:"topic_uuid"`
-	Token      string    `xorm:"TEXT 'token'" json:"token"`
-	UserName   string    `xorm:"user_name" json:"user_name"`
-	UserEmail  string    `xorm:"user_email" json:"user_email"`
-	UserId     uint      `xorm:"user_id" json:"user_id"`
-	LastUpdate time.Time `xorm:"not null 'last_update'" json:"last_update"`
-	CreatedAt  time.Time `xorm:"not null 'created_at'" json:"created_at"`
+	UuId      string `xorm:"not null unique 'uu_id'" json:"uuid"`
+	State     string `xorm:"TEXT 'state'" json:"state"`
+	TopicId   uint   `xorm:"topic_id" json:"topic_id"`
+	TopicUuId string `xorm:"topic_uu_id" json:"topic_uuid"`
+	Token     string `xorm:"TEXT 'token'" json:"token"`
+	UserName  string `xorm:"user_name" json:"user_name"`
+	UserEmail string `xorm:"user_email" json:"user_email"`
+	UserId    uint   `xorm:"user_id" json:"user_id"`
+	// copied at login, updated when verified in this session
+	UserVerified bool `xorm:"user_verified" json:"user_verified"`
+	// waiting for second login step
+	TotpTicket   string    `xorm:"TEXT 'totp_ticket'" json:"totp_ticket"`
+	RefreshToken string    `xorm:"TEXT 'refresh_token'" json:"refresh_token"`
+	LastUpdate   time.Time `xorm:"not null 'last_update'" json:"last_update"`
+	CreatedAt    time.Time `xorm:"not null 'created_at'" json:"created_at"`
 }
 
 type Topic struct {
@@ -40,6 +191,8 @@ type Topic struct {
 	Owner      string    `xorm:"owner" json:"owner"`
 	UserId     uint      `xorm:"user_id" json:"user_id"`
 	LastUpdate time.Time `xorm:"not null 'last_update'" json:"last_update"`
+	EditedAt   time.Time `xorm:"edited_at" json:"edited_at"`
+	DeletedAt  time.Time `xorm:"deleted 'deleted_at'" json:"-"`
 	CreatedAt  time.Time `xorm:"not null 'created_at'" json:"created_at"`
 }
 
@@ -50,9 +203,79 @@ type Reply struct {
 	Contributor string    `xorm:"contributor" json:"contributor"`
 	UserId      uint      `xorm:"user_id" json:"user_id"`
 	TopicId     uint      `xorm:"topic_id" json:"topic_id"`
+	EditedAt    time.Time `xorm:"edited_at" json:"edited_at"`
+	DeletedAt   time.Time `xorm:"deleted 'deleted_at'" json:"-"`
 	CreatedAt   time.Time `xorm:"not null 'created_at'" json:"created_at"`
 }
 
+const (
+	ReportTopic = "topic"
+	ReportReply = "reply"
+)
+
+const (
+	ResolutionDismissed = "dismissed"
+	ResolutionDeleted   = "deleted"
+)
+
+// Report is a topic or reply reported to moderators.
+// Kind is one of Report constants, Resolution is empty while open
+type Report struct {
+	Id         uint      `xorm:"pk autoincr 'id'" json:"id"`
+	Kind       string    `xorm:"not null 'kind'" json:"kind"`
+	TargetUuId string    `xorm:"not null 'target_uu_id'" json:"target_uuid"`
+	UserId     uint      `xorm:"not null 'user_id'" json:"user_id"`
+	Reason     string    `xorm:"TEXT 'reason'" json:"reason"`
+	Resolution string    `xorm:"resolution" json:"resolution"`
+	ResolvedBy uint      `xorm:"resolved_by" json:"resolved_by"`
+	ResolvedAt time.Time `xorm:"resolved_at" json:"resolved_at"`
+	CreatedAt  time.Time `xorm:"not null 'created_at'" json:"created_at"`
+}
+
+// open reports of one content, Topic or Reply is nil if already deleted
+type ReportedItem struct {
+	Kind            string    `xorm:"kind" json:"kind"`
+	TargetUuId      string    `xorm:"target_uu_id" json:"target_uuid"`
+	NumReports      int       `xorm:"num_reports" json:"num_reports"`
+	FirstReportedAt time.Time `xorm:"first_reported_at" json:"first_reported_at"`
+	Topic           *Topic    `xorm:"-" json:"topic"`
+	Reply           *Reply    `xorm:"-" json:"reply"`
+}
+
+type ModerationQueue struct {
+	Items []ReportedItem `json:"items"`
+}
+
+// cursor is given by previous page, empty for first page.
+// TopicId is used only for replies
+type PageRequest struct {
+	TopicId uint   `json:"topic_id"`
+	Cursor  string `json:"cursor"`
+	Limit   int    `json:"limit"`
+}
+
+// Next is empty at last page
+type TopicPage struct {
+	Topics []Topic `json:"topics"`
+	Next   string  `json:"next"`
+}
+
+type ReplyPage struct {
+	Replies []Reply `json:"replies"`
+	Next    string  `json:"next"`
+}
+
+func (login *Login) When() string {
+	return login.CreatedAt.Format("2006/Jan/2 at 3:04pm")
+}
+
+func (login *Login) IsFailure() bool {
+	return login.Result != LoginSucceeded &&
+		login.Result != LoginTotpRequired &&
+		login.Result != LoginUnlocked &&
+		login.Result != LoginUnlockedByAdmin
+}
+
 func (topic *Topic) When() string {
 	return topic.CreatedAt.Format("2006/Jan/2 at 3:04pm")
 }
@@ -61,6 +284,57 @@ func (reply *Reply) When() string {
 	return reply.CreatedAt.Format("2006/Jan/2 at 3:04pm")
 }
 
+// unknown role has no scope
+func ScopesOf(role string) []string {
+	// users created before roles
+	if len(role) == 0 {
+		role = RoleMember
+	}
+	return roleScopes[role]
+}
+
+// scopes of role, with ScopeVerified for verified user
+func (user *User) Scopes() []string {
+	scopes := append([]string{}, ScopesOf(user.Role)...)
+	if user.IsVerified() {
+		scopes = append(scopes, ScopeVerified)
+	}
+	return scopes
+}
+
+func IsRole(role string) bool {
+	_, ok := roleScopes[role]
+	return ok
+}
+
+func (user *User) IsLocked() bool {
+	return user.Locked > 0
+}
+
+func (user *User) IsVerified() bool {
+	return !user.VerifiedAt.IsZero()
+}
+
+func (user *User) IsTotpEnabled() bool {
+	return !user.TotpEnabledAt.IsZero()
+}
+
+func (topic *Topic) IsEdited() bool {
+	return !topic.EditedAt.IsZero()
+}
+
+func (reply *Reply) IsEdited() bool {
+	return !reply.EditedAt.IsZero()
+}
+
 func (topic *Topic) AsURL() string {
 	return base64.URLEncoding.EncodeToString([]byte(topic.UuId))
 }
+
+func (reply *Reply) AsURL() string {
+	return base64.URLEncoding.EncodeToString([]byte(reply.UuId))
+}
+
+func (item *ReportedItem) AsURL() string {
+	return base64.URLEncoding.EncodeToString([]byte(item.TargetUuId))
+}
@@ -1,8 +1,8 @@
 package main
 
 import (
+	"context"
 	"learning-web-chatboard4/common"
-	"learning-web-chatboard4/common/models"
 	"learning-web-chatboard4/rabbitrpc"
 	"log"
 
@@ -13,6 +13,7 @@ var dbEngine *xorm.Engine
 var config *common.Configuration
 var logger *log.Logger
 var server *rabbitrpc.RabbitClient
+var rpcRouter *rabbitrpc.Router
 
 func main() {
 	var err error
@@ -43,6 +44,10 @@ func main() {
 	}
 
 	//rabbit
+	err = registerFunctions()
+	if err != nil {
+		common.LogError(logger).Fatalln(err.Error())
+	}
 	server = rabbitrpc.NewRPCServer(
 		rabbitrpc.DefaultRabbitURL,
 		config.TopicsResQName,
@@ -53,78 +58,54 @@ func main() {
 		config.TopicsServerKey,
 		onRequestReceived,
 	)
-	defer server.Publisher.Done()
-	defer server.Subscriber.Done()
 
-	select {
-	case <-server.Publisher.CTX.Done():
-		break
-	case <-server.Subscriber.CTX.Done():
-		break
-	}
+	shutdownCTX, stop := common.NotifyShutdown()
+	defer stop()
+	<-shutdownCTX.Done()
+	shutdown()
 }
 
-func onRequestReceived(raws rabbitrpc.Raws) {
-	go func() {
-		var err *rabbitrpc.RabbitRPCError
-		envelop, err := rabbitrpc.FromBin(raws.Body)
-		if err != nil {
-			common.SendError(server, err, raws.CorrelationId)
-			return
-		}
+func shutdown() {
+	common.LogInfo(logger).Println("shutting down...")
+	ctx, cancel := context.WithTimeout(
+		context.Background(),
+		common.ShutdownTimeout,
+	)
+	defer cancel()
 
-		err = routingRequest(envelop, raws.CorrelationId)
-		if err != nil {
-			common.SendError(server, err, raws.CorrelationId)
-		}
-	}()
+	err := rpcRouter.Shutdown(ctx, server)
+	if err != nil {
+		common.LogWarning(logger).Println(err.Error())
+	}
+	err = dbEngine.Close()
+	if err != nil {
+		common.LogWarning(logger).Println(err.Error())
+	}
+	common.LogInfo(logger).Println("bye")
 }
 
-func routingRequest(envelop *rabbitrpc.Envelope, corrId string,
-) (err *rabbitrpc.RabbitRPCError) {
-	switch envelop.DataTypeName {
-
-	case "Topic":
-		var topic models.Topic
-		err = envelop.Extract(&topic)
-		if err != nil {
-			return
-		}
-
-		switch envelop.FunctionToCall {
-
-		case "createTopic":
-			createTopic(&topic, corrId)
-		case "readATopic":
-			readATopic(&topic, corrId)
-		case "readRepliesInTopic":
-			readRepliesInTopic(&topic, corrId)
-		case "readTopics":
-			readTopics(corrId)
-		case "updat	eTopic":
-			updateTopic(&topic, corrId)
-		case "incrementTopic":
-			incrementTopic(&topic, corrId)
-		default:
-			err = rabbitrpc.ErrorFunctionNotFound
-		}
-
-	case "Reply":
-		var reply models.Reply
-		err = envelop.Extract(&reply)
-		if err != nil {
-			return
-		}
-
-		switch envelop.FunctionToCall {
-		case "createReply":
-			createReply(&reply, corrId)
-		default:
-			err = rabbitrpc.ErrorFunctionNotFound
-		}
+func onRequestReceived(raws rabbitrpc.Raws) {
+	rpcRouter.Dispatch(server, raws)
+}
 
-	default:
-		err = rabbitrpc.ErrorTypeNotFound
-	}
-	return
+func registerFunctions() error {
+	rpcRouter = rabbitrpc.NewRouter(func(err error) {
+		common.LogError(logger).Println(err.Error())
+	})
+
+	rabbitrpc.Register(rpcRouter, "createTopic", createTopic)
+	rabbitrpc.Register(rpcRouter, "readATopic", readATopic)
+	rabbitrpc.Register(rpcRouter, "readRepliesInTopic", readRepliesInTopic)
+	rabbitrpc.Register(rpcRouter, "readTopics", readTopics)
+	rabbitrpc.Register(rpcRouter, "updateTopic", updateTopic)
+	rabbitrpc.Register(rpcRouter, "deleteTopic", deleteTopic)
+	rabbitrpc.Register(rpcRouter, "createReply", createReply)
+	rabbitrpc.Register(rpcRouter, "readAReply", readAReply)
+	rabbitrpc.Register(rpcRouter, "updateReply", updateReply)
+	rabbitrpc.Register(rpcRouter, "deleteReply", deleteReply)
+	rabbitrpc.Register(rpcRouter, "reportContent", reportContent)
+	rabbitrpc.Register(rpcRouter, "readModerationQueue", readModerationQueue)
+	rabbitrpc.Register(rpcRouter, "resolveReports", resolveReports)
+
+	return rpcRouter.Check()
 }
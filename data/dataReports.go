@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"learning-web-chatboard4/common"
+	"learning-web-chatboard4/common/models"
+	"learning-web-chatboard4/rabbitrpc"
+	"time"
+	"unicode/utf8"
+)
+
+const reportsTable = "reports"
+
+const (
+	maxReasonLen        = 500
+	defaultQueueSize    = 20
+	maxQueueSize        = 100
+	firstReportedColumn = "first_reported_at"
+)
+
+// any logged in user can report a topic or reply
+func reportContent(ctx context.Context, report *models.Report,
+) (*models.Report, error) {
+	caller, err := rabbitrpc.RequireScope(ctx, models.ScopeWrite)
+	if err != nil {
+		return nil, err
+	}
+	report.UserId = caller.UserId
+
+	err = reportContentInternal(report)
+	if err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+func reportContentInternal(report *models.Report) (err error) {
+	if common.IsEmpty(report.TargetUuId) ||
+		utf8.RuneCountInString(report.Reason) > maxReasonLen {
+		err = rabbitrpc.NewError(
+			rabbitrpc.CodeInvalidArgument,
+			"need target and short reason",
+		)
+		return
+	}
+	_, _, err = readReportTargetInternal(report.Kind, report.TargetUuId)
+	if err != nil {
+		return
+	}
+
+	// same user reporting twice is counted once
+	exists, err := dbEngine.
+		Table(reportsTable).
+		Where(
+			"kind = ? AND target_uu_id = ? AND user_id = ? AND resolved_at IS NULL",
+			report.Kind,
+			report.TargetUuId,
+			report.UserId,
+		).
+		Exist(&models.Report{})
+	if err != nil || exists {
+		return
+	}
+
+	report.Resolution = ""
+	report.ResolvedBy = 0
+	report.CreatedAt = time.Now()
+	err = createReportSQL(report)
+	return
+}
+
+func createReportSQL(report *models.Report) (err error) {
+	affected, err := dbEngine.
+		Table(reportsTable).
+		InsertOne(report)
+	if err == nil && affected != 1 {
+		err = fmt.Errorf(
+			"something wrong. returned value was %d",
+			affected,
+		)
+	}
+	return
+}
+
+// returns one of topic or reply
+func readReportTargetInternal(kind, uuid string,
+) (topic *models.Topic, reply *models.Reply, err error) {
+	switch kind {
+	case models.ReportTopic:
+		topic = &models.Topic{UuId: uuid}
+		err = readATopicInternal(topic)
+	case models.ReportReply:
+		reply = &models.Reply{UuId: uuid}
+		err = readAReplyInternal(reply)
+	default:
+		err = rabbitrpc.NewError(
+			rabbitrpc.CodeInvalidArgument,
+			"unknown kind of report",
+		)
+	}
+	return
+}
+
+// open reports grouped by content, oldest first
+func readModerationQueue(ctx context.Context, page *models.PageRequest,
+) (*models.ModerationQueue, error) {
+	_, err := rabbitrpc.RequireScope(ctx, models.ScopeModerate)
+	if err != nil {
+		return nil, err
+	}
+
+	queue, err := readModerationQueueInternal(page)
+	if err != nil {
+		return nil, err
+	}
+
+	return queue, nil
+}
+
+func readModerationQueueInternal(page *models.PageRequest,
+) (queue *models.ModerationQueue, err error) {
+	limit := page.Limit
+	if limit <= 0 || limit > maxQueueSize {
+		limit = defaultQueueSize
+	}
+
+	items, err := readModerationQueueSQL(limit)
+	if err != nil {
+		return
+	}
+
+	queue = &models.ModerationQueue{
+		Items: make([]models.ReportedItem, 0, len(items)),
+	}
+	for _, item := range items {
+		item.Topic, item.Reply, err = readReportTargetInternal(
+			item.Kind,
+			item.TargetUuId,
+		)
+		// already deleted by owner, shown without content
+		if rabbitrpc.CodeOf(err) == rabbitrpc.CodeNotFound {
+			item.Topic, item.Reply, err = nil, nil, nil
+		}
+		if err != nil {
+			return
+		}
+		queue.Items = append(queue.Items, item)
+	}
+	return
+}
+
+func readModerationQueueSQL(limit int) (items []models.ReportedItem, err error) {
+	err = dbEngine.SQL(
+		`SELECT kind, target_uu_id,
+		   COUNT(*) AS num_reports,
+		   MIN(created_at) AS `+firstReportedColumn+`
+		 FROM reports
+		 WHERE resolved_at IS NULL
+		 GROUP BY kind, target_uu_id
+		 ORDER BY `+firstReportedColumn+`
+		 LIMIT $1`,
+		limit,
+	).Find(&items)
+	return
+}
+
+// every open report of the content is resolved at once,
+// content is deleted when resolution is deleted
+func resolveReports(ctx context.Context, report *models.Report,
+) (*models.Report, error) {
+	caller, err := rabbitrpc.RequireScope(ctx, models.ScopeModerate)
+	if err != nil {
+		return nil, err
+	}
+
+	err = resolveReportsInternal(report, caller)
+	if err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+func resolveReportsInternal(report *models.Report, caller *rabbitrpc.Caller,
+) (err error) {
+	switch report.Resolution {
+	case models.ResolutionDismissed:
+	case models.ResolutionDeleted:
+		err = deleteReportTargetInternal(report, caller)
+		if err != nil {
+			return
+		}
+	default:
+		err = rabbitrpc.NewError(
+			rabbitrpc.CodeInvalidArgument,
+			"unknown resolution",
+		)
+		return
+	}
+
+	report.ResolvedBy = caller.UserId
+	report.ResolvedAt = time.Now()
+	err = resolveReportsSQL(report)
+	return
+}
+
+// deleted already is fine
+func deleteReportTargetInternal(report *models.Report, caller *rabbitrpc.Caller,
+) (err error) {
+	switch report.Kind {
+	case models.ReportTopic:
+		err = deleteTopicInternal(
+			&models.Topic{UuId: report.TargetUuId},
+			caller,
+		)
+	case models.ReportReply:
+		err = deleteReplyInternal(
+			&models.Reply{UuId: report.TargetUuId},
+			caller,
+		)
+	default:
+		err = rabbitrpc.NewError(
+			rabbitrpc.CodeInvalidArgument,
+			"unknown kind of report",
+		)
+	}
+	if rabbitrpc.CodeOf(err) == rabbitrpc.CodeNotFound {
+		err = nil
+	}
+	return
+}
+
+func resolveReportsSQL(report *models.Report) (err error) {
+	_, err = dbEngine.
+		Table(reportsTable).
+		Where(
+			"kind = ? AND target_uu_id = ? AND resolved_at IS NULL",
+			report.Kind,
+			report.TargetUuId,
+		).
+		Cols("resolution", "resolved_by", "resolved_at").
+		Update(report)
+	return
+}
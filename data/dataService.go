@@ -1,10 +1,15 @@
 package main
 
 import (
+	"context"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"learning-web-chatboard4/common"
 	"learning-web-chatboard4/common/models"
+	"learning-web-chatboard4/rabbitrpc"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -12,21 +17,51 @@ const (
 	topicsTable      = "topics"
 	repliesTable     = "replies"
 	descendingUpdate = "last_update"
+	ascendingCreate  = "created_at"
 )
 
-func createTopic(topic *models.Topic, corrId string) {
-	err := createTopicInternal(topic)
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// caller who can post, with verified email
+func requireVerifiedWriter(ctx context.Context) (caller *rabbitrpc.Caller, err error) {
+	caller, err = rabbitrpc.RequireScope(ctx, models.ScopeWrite)
 	if err != nil {
-		common.HandleError(server, logger, err.Error(), corrId)
 		return
 	}
+	if !caller.HasScope(models.ScopeVerified) {
+		err = rabbitrpc.NewError(
+			rabbitrpc.CodePermissionDenied,
+			"email address is not verified",
+		)
+	}
+	return
+}
 
-	common.SendOK(server, topic, "Topic", corrId)
+func createTopic(ctx context.Context, topic *models.Topic) (*models.Topic, error) {
+	caller, err := requireVerifiedWriter(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// posted as caller whatever requested
+	topic.UserId = caller.UserId
+
+	err = createTopicInternal(topic)
+	if err != nil {
+		return nil, err
+	}
+
+	return topic, nil
 }
 
 func createTopicInternal(topic *models.Topic) (err error) {
 	if common.IsEmpty(topic.Topic, topic.Owner) {
-		err = errors.New("contains empty string")
+		err = rabbitrpc.NewError(
+			rabbitrpc.CodeInvalidArgument,
+			"contains empty string",
+		)
 		return
 	}
 	now := time.Now()
@@ -40,7 +75,7 @@ func createTopicInternal(topic *models.Topic) (err error) {
 func createTopicSQL(topic *models.Topic) (err error) {
 	affected, err := dbEngine.
 		Table(topicsTable).
-		InsertOne(&topic)
+		InsertOne(topic)
 	if err == nil && affected != 1 {
 		err = fmt.Errorf(
 			"something wrong. returned value was %d",
@@ -50,14 +85,19 @@ func createTopicSQL(topic *models.Topic) (err error) {
 	return
 }
 
-func createReply(reply *models.Reply, corrId string) {
-	err := createReplyInternal(reply)
+func createReply(ctx context.Context, reply *models.Reply) (*models.Reply, error) {
+	caller, err := requireVerifiedWriter(ctx)
 	if err != nil {
-		common.HandleError(server, logger, err.Error(), corrId)
-		return
+		return nil, err
 	}
+	reply.UserId = caller.UserId
 
-	common.SendOK(server, reply, "Reply", corrId)
+	err = createReplyInternal(reply)
+	if err != nil {
+		return nil, err
+	}
+
+	return reply, nil
 }
 
 func createReplyInternal(reply *models.Reply) (err error) {
@@ -65,7 +105,10 @@ func createReplyInternal(reply *models.Reply) (err error) {
 		reply.Body,
 		reply.Contributor,
 	) {
-		err = errors.New("contains empty string")
+		err = rabbitrpc.NewError(
+			rabbitrpc.CodeInvalidArgument,
+			"contains empty string",
+		)
 		return
 	}
 	reply.UuId = common.NewUuIdString()
@@ -74,8 +117,17 @@ func createReplyInternal(reply *models.Reply) (err error) {
 	return
 }
 
+// inserts reply and increments counter of the topic at once
 func createReplySQL(reply *models.Reply) (err error) {
-	affected, err := dbEngine.
+	sess := dbEngine.NewSession()
+	defer sess.Close()
+
+	err = sess.Begin()
+	if err != nil {
+		return
+	}
+
+	affected, err := sess.
 		Table(repliesTable).
 		InsertOne(reply)
 	if err == nil && affected != 1 {
@@ -84,22 +136,45 @@ func createReplySQL(reply *models.Reply) (err error) {
 			affected,
 		)
 	}
+	if err != nil {
+		sess.Rollback()
+		return
+	}
+
+	// increment in sql, concurrent replies don't lose counts
+	affected, err = sess.
+		Table(topicsTable).
+		ID(reply.TopicId).
+		Incr("num_replies").
+		Cols("last_update").
+		Update(&models.Topic{LastUpdate: reply.CreatedAt})
+	if err == nil && affected != 1 {
+		err = rabbitrpc.NewError(rabbitrpc.CodeNotFound, "no such thread")
+	}
+	if err != nil {
+		sess.Rollback()
+		return
+	}
+
+	err = sess.Commit()
 	return
 }
 
-func readATopic(topic *models.Topic, corrId string) {
+func readATopic(ctx context.Context, topic *models.Topic) (*models.Topic, error) {
 	err := readATopicInternal(topic)
 	if err != nil {
-		common.HandleError(server, logger, err.Error(), corrId)
-		return
+		return nil, err
 	}
 
-	common.SendOK(server, topic, "Topic", corrId)
+	return topic, nil
 }
 
 func readATopicInternal(topic *models.Topic) (err error) {
 	if common.IsEmpty(topic.UuId) {
-		err = errors.New("need uuid for finding thread")
+		err = rabbitrpc.NewError(
+			rabbitrpc.CodeInvalidArgument,
+			"need uuid for finding thread",
+		)
 		return
 	}
 	err = readATopicSQL(topic)
@@ -111,39 +186,88 @@ func readATopicSQL(topic *models.Topic) (err error) {
 		Table(topicsTable).
 		Get(topic)
 	if err == nil && !ok {
-		err = errors.New("no such thread")
+		err = rabbitrpc.NewError(rabbitrpc.CodeNotFound, "no such thread")
 	}
 	return
 }
 
-func updateTopic(topic *models.Topic, corrId string) {
-	err := updateTopicInternal(topic)
+func updateTopic(ctx context.Context, topic *models.Topic) (*models.Topic, error) {
+	caller, err := rabbitrpc.RequireScope(ctx, models.ScopeWrite)
 	if err != nil {
-		common.HandleError(server, logger, err.Error(), corrId)
-		return
+		return nil, err
+	}
+
+	err = updateTopicInternal(topic, caller)
+	if err != nil {
+		return nil, err
 	}
 
-	common.SendOK(server, topic, "Topic", corrId)
+	return topic, nil
 }
 
-func updateTopicInternal(topic *models.Topic) (err error) {
+// only owner can edit
+func updateTopicInternal(topic *models.Topic, caller *rabbitrpc.Caller) (err error) {
 	if common.IsEmpty(
 		topic.UuId,
 		topic.Topic,
-		topic.Owner,
 	) {
-		err = errors.New("contains empty string")
+		err = rabbitrpc.NewError(
+			rabbitrpc.CodeInvalidArgument,
+			"contains empty string",
+		)
+		return
+	}
+
+	stored, err := readOwnTopic(topic, caller, "")
+	if err != nil {
+		return
+	}
+	stored.Topic = topic.Topic
+	stored.EditedAt = time.Now()
+	err = updateTopicSQL(stored, "topic", "edited_at")
+	if err != nil {
 		return
 	}
-	topic.LastUpdate = time.Now()
-	err = updateTopicSQL(topic)
+	*topic = *stored
 	return
 }
 
-func updateTopicSQL(topic *models.Topic) (err error) {
+// reads stored topic and checks it is owned by caller.
+// caller with overrideScope can also touch it, if not empty
+func readOwnTopic(
+	topic *models.Topic,
+	caller *rabbitrpc.Caller,
+	overrideScope string,
+) (stored *models.Topic, err error) {
+	stored = &models.Topic{UuId: topic.UuId}
+	err = readATopicInternal(stored)
+	if err != nil {
+		return
+	}
+	if stored.UserId == caller.UserId {
+		return
+	}
+	if len(overrideScope) > 0 && caller.HasScope(overrideScope) {
+		common.LogInfo(logger).Printf(
+			"topic %s of user %d is touched by %s\n",
+			stored.UuId,
+			stored.UserId,
+			caller.Email,
+		)
+		return
+	}
+	err = rabbitrpc.NewError(
+		rabbitrpc.CodePermissionDenied,
+		"not an owner of the thread",
+	)
+	return
+}
+
+func updateTopicSQL(topic *models.Topic, cols ...string) (err error) {
 	affected, err := dbEngine.
 		Table(topicsTable).
 		ID(topic.Id).
+		Cols(cols...).
 		Update(topic)
 	if err == nil && affected != 1 {
 		err = fmt.Errorf(
@@ -154,60 +278,390 @@ func updateTopicSQL(topic *models.Topic) (err error) {
 	return
 }
 
-func incrementTopic(topic *models.Topic, corrId string) {
-	err := incrementTopicInternal(topic)
+func deleteTopic(ctx context.Context, topic *models.Topic) (*models.Topic, error) {
+	caller, err := rabbitrpc.RequireScope(ctx, models.ScopeWrite)
+	if err != nil {
+		return nil, err
+	}
+
+	err = deleteTopicInternal(topic, caller)
+	if err != nil {
+		return nil, err
+	}
+
+	return topic, nil
+}
+
+// owner or moderator can delete, stays in database as deleted
+func deleteTopicInternal(topic *models.Topic, caller *rabbitrpc.Caller) (err error) {
+	stored, err := readOwnTopic(topic, caller, models.ScopeModerate)
+	if err != nil {
+		return
+	}
+	err = deleteTopicSQL(stored)
 	if err != nil {
-		common.HandleError(server, logger, err.Error(), corrId)
 		return
 	}
+	*topic = *stored
+	return
+}
 
-	common.SendOK(server, topic, "Topic", corrId)
+func deleteTopicSQL(topic *models.Topic) (err error) {
+	affected, err := dbEngine.
+		Table(topicsTable).
+		ID(topic.Id).
+		Delete(&models.Topic{})
+	if err == nil && affected != 1 {
+		err = fmt.Errorf(
+			"something wrong. returned value was %d",
+			affected,
+		)
+	}
+	return
 }
 
-func incrementTopicInternal(topic *models.Topic) (err error) {
-	err = readATopicInternal(topic)
+func readAReply(ctx context.Context, reply *models.Reply) (*models.Reply, error) {
+	err := readAReplyInternal(reply)
 	if err != nil {
+		return nil, err
+	}
+
+	return reply, nil
+}
+
+func readAReplyInternal(reply *models.Reply) (err error) {
+	if common.IsEmpty(reply.UuId) {
+		err = rabbitrpc.NewError(
+			rabbitrpc.CodeInvalidArgument,
+			"need uuid for finding reply",
+		)
 		return
 	}
+	err = readAReplySQL(reply)
+	return
+}
 
-	topic.NumReplies++
-	err = updateTopicInternal(topic)
+func readAReplySQL(reply *models.Reply) (err error) {
+	ok, err := dbEngine.
+		Table(repliesTable).
+		Get(reply)
+	if err == nil && !ok {
+		err = rabbitrpc.NewError(rabbitrpc.CodeNotFound, "no such reply")
+	}
 	return
 }
 
-func readRepliesInTopic(topic *models.Topic, corrId string) {
-	// is there a way to check valid id before?
-	replies, err := readRepliesInTopicSQL(topic)
+// reads stored reply and checks it is owned by caller.
+// caller with overrideScope can also touch it, if not empty
+func readOwnReply(
+	reply *models.Reply,
+	caller *rabbitrpc.Caller,
+	overrideScope string,
+) (stored *models.Reply, err error) {
+	stored = &models.Reply{UuId: reply.UuId}
+	err = readAReplyInternal(stored)
 	if err != nil {
-		common.HandleError(server, logger, err.Error(), corrId)
 		return
 	}
+	if stored.UserId == caller.UserId {
+		return
+	}
+	if len(overrideScope) > 0 && caller.HasScope(overrideScope) {
+		common.LogInfo(logger).Printf(
+			"reply %s of user %d is touched by %s\n",
+			stored.UuId,
+			stored.UserId,
+			caller.Email,
+		)
+		return
+	}
+	err = rabbitrpc.NewError(
+		rabbitrpc.CodePermissionDenied,
+		"not an owner of the reply",
+	)
+	return
+}
 
-	common.SendOK(server, &replies, "ReplySlice", corrId)
+func updateReply(ctx context.Context, reply *models.Reply) (*models.Reply, error) {
+	caller, err := rabbitrpc.RequireScope(ctx, models.ScopeWrite)
+	if err != nil {
+		return nil, err
+	}
+
+	err = updateReplyInternal(reply, caller)
+	if err != nil {
+		return nil, err
+	}
+
+	return reply, nil
 }
 
-func readRepliesInTopicSQL(topic *models.Topic) (posts []models.Reply, err error) {
-	err = dbEngine.
+// only owner can edit
+func updateReplyInternal(reply *models.Reply, caller *rabbitrpc.Caller) (err error) {
+	if common.IsEmpty(
+		reply.UuId,
+		reply.Body,
+	) {
+		err = rabbitrpc.NewError(
+			rabbitrpc.CodeInvalidArgument,
+			"contains empty string",
+		)
+		return
+	}
+
+	stored, err := readOwnReply(reply, caller, "")
+	if err != nil {
+		return
+	}
+	stored.Body = reply.Body
+	stored.EditedAt = time.Now()
+	err = updateReplySQL(stored, "body", "edited_at")
+	if err != nil {
+		return
+	}
+	*reply = *stored
+	return
+}
+
+func updateReplySQL(reply *models.Reply, cols ...string) (err error) {
+	affected, err := dbEngine.
 		Table(repliesTable).
-		Where("topic_id = ?", topic.Id).
-		Find(&posts)
+		ID(reply.Id).
+		Cols(cols...).
+		Update(reply)
+	if err == nil && affected != 1 {
+		err = fmt.Errorf(
+			"something wrong. returned value was %d",
+			affected,
+		)
+	}
 	return
 }
 
-func readTopics(corrId string) {
-	topics, err := readTopicsSQL()
+func deleteReply(ctx context.Context, reply *models.Reply) (*models.Reply, error) {
+	caller, err := rabbitrpc.RequireScope(ctx, models.ScopeWrite)
+	if err != nil {
+		return nil, err
+	}
+
+	err = deleteReplyInternal(reply, caller)
+	if err != nil {
+		return nil, err
+	}
+
+	return reply, nil
+}
+
+// owner or moderator can delete, stays in database as deleted
+func deleteReplyInternal(reply *models.Reply, caller *rabbitrpc.Caller) (err error) {
+	stored, err := readOwnReply(reply, caller, models.ScopeModerate)
 	if err != nil {
-		common.HandleError(server, logger, err.Error(), corrId)
 		return
-	} else {
-		common.SendOK(server, &topics, "TopicSlice", corrId)
 	}
+	err = deleteReplySQL(stored)
+	if err != nil {
+		return
+	}
+	*reply = *stored
+	return
 }
 
-func readTopicsSQL() (topics []models.Topic, err error) {
-	err = dbEngine.
+// deletes reply and decrements counter of the topic at once
+func deleteReplySQL(reply *models.Reply) (err error) {
+	sess := dbEngine.NewSession()
+	defer sess.Close()
+
+	err = sess.Begin()
+	if err != nil {
+		return
+	}
+
+	affected, err := sess.
+		Table(repliesTable).
+		ID(reply.Id).
+		Delete(&models.Reply{})
+	if err == nil && affected != 1 {
+		err = fmt.Errorf(
+			"something wrong. returned value was %d",
+			affected,
+		)
+	}
+	if err != nil {
+		sess.Rollback()
+		return
+	}
+
+	_, err = sess.
 		Table(topicsTable).
-		Desc(descendingUpdate).
+		ID(reply.TopicId).
+		Decr("num_replies").
+		Update(&models.Topic{})
+	if err != nil {
+		sess.Rollback()
+		return
+	}
+
+	err = sess.Commit()
+	return
+}
+
+func readRepliesInTopic(ctx context.Context, page *models.PageRequest,
+) (*models.ReplyPage, error) {
+	// is there a way to check valid id before?
+	replies, next, err := readRepliesInTopicInternal(page)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.ReplyPage{
+		Replies: replies,
+		Next:    next,
+	}, nil
+}
+
+// oldest first
+func readRepliesInTopicInternal(page *models.PageRequest,
+) (replies []models.Reply, next string, err error) {
+	limit, after, err := parsePageRequest(page)
+	if err != nil {
+		return
+	}
+	replies, err = readRepliesInTopicSQL(page.TopicId, after, limit+1)
+	if err != nil {
+		return
+	}
+
+	if len(replies) > limit {
+		replies = replies[:limit]
+		last := replies[limit-1]
+		next = encodeCursor(pageCursor{last.CreatedAt, last.Id})
+	}
+	return
+}
+
+func readRepliesInTopicSQL(
+	topicId uint,
+	after *pageCursor,
+	limit int,
+) (replies []models.Reply, err error) {
+	sess := dbEngine.
+		Table(repliesTable).
+		Where("topic_id = ?", topicId)
+	if after != nil {
+		sess = sess.And("(created_at, id) > (?, ?)", after.at, after.id)
+	}
+	err = sess.
+		Asc(ascendingCreate, "id").
+		Limit(limit).
+		Find(&replies)
+	return
+}
+
+func readTopics(ctx context.Context, page *models.PageRequest,
+) (*models.TopicPage, error) {
+	topics, next, err := readTopicsInternal(page)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.TopicPage{
+		Topics: topics,
+		Next:   next,
+	}, nil
+}
+
+// recently updated first
+func readTopicsInternal(page *models.PageRequest,
+) (topics []models.Topic, next string, err error) {
+	limit, before, err := parsePageRequest(page)
+	if err != nil {
+		return
+	}
+	topics, err = readTopicsSQL(before, limit+1)
+	if err != nil {
+		return
+	}
+
+	if len(topics) > limit {
+		topics = topics[:limit]
+		last := topics[limit-1]
+		next = encodeCursor(pageCursor{last.LastUpdate, last.Id})
+	}
+	return
+}
+
+func readTopicsSQL(before *pageCursor, limit int,
+) (topics []models.Topic, err error) {
+	sess := dbEngine.Table(topicsTable)
+	if before != nil {
+		sess = sess.Where("(last_update, id) < (?, ?)", before.at, before.id)
+	}
+	err = sess.
+		Desc(descendingUpdate, "id").
+		Limit(limit).
 		Find(&topics)
 	return
 }
+
+// pagination
+
+// position of the last row in previous page
+type pageCursor struct {
+	at time.Time
+	id uint
+}
+
+func encodeCursor(cursor pageCursor) string {
+	return base64.URLEncoding.EncodeToString(
+		[]byte(fmt.Sprintf("%d.%d", cursor.at.UnixNano(), cursor.id)),
+	)
+}
+
+func decodeCursor(encoded string) (cursor *pageCursor, err error) {
+	bytes, err := base64.URLEncoding.DecodeString(encoded)
+	if err != nil {
+		return
+	}
+	nanoStr, idStr, ok := strings.Cut(string(bytes), ".")
+	if !ok {
+		err = errors.New("separator not found")
+		return
+	}
+	nano, err := strconv.ParseInt(nanoStr, 10, 64)
+	if err != nil {
+		return
+	}
+	id, err := strconv.ParseUint(idStr, 10, 0)
+	if err != nil {
+		return
+	}
+	cursor = &pageCursor{
+		at: time.Unix(0, nano),
+		id: uint(id),
+	}
+	return
+}
+
+// cursor is nil for first page
+func parsePageRequest(page *models.PageRequest,
+) (limit int, cursor *pageCursor, err error) {
+	limit = page.Limit
+	if limit <= 0 {
+		limit = defaultPageSize
+	}
+	if limit > maxPageSize {
+		limit = maxPageSize
+	}
+
+	if common.IsEmpty(page.Cursor) {
+		return
+	}
+	cursor, err = decodeCursor(page.Cursor)
+	if err != nil {
+		err = rabbitrpc.NewError(
+			rabbitrpc.CodeInvalidArgument,
+			"invalid cursor",
+		)
+	}
+	return
+}
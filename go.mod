@@ -9,6 +9,10 @@ require (
 	github.com/google/uuid v1.0.0
 	github.com/lib/pq v1.10.2
 	github.com/rabbitmq/amqp091-go v1.3.4
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
+	golang.org/x/crypto v0.0.0-20220411220226-7b82a4e95df4
+	golang.org/x/exp v0.0.0-20220414153411-bcd21879b8fd
+	gopkg.in/square/go-jose.v2 v2.6.0
 	xorm.io/xorm v1.2.5
 )
 
@@ -26,11 +30,8 @@ require (
 	github.com/modern-go/reflect2 v1.0.1 // indirect
 	github.com/syndtr/goleveldb v1.0.0 // indirect
 	github.com/ugorji/go/codec v1.1.7 // indirect
-	golang.org/x/crypto v0.0.0-20220411220226-7b82a4e95df4 // indirect
-	golang.org/x/exp v0.0.0-20220414153411-bcd21879b8fd // indirect
 	golang.org/x/sys v0.0.0-20211019181941-9d821ace8654 // indirect
 	golang.org/x/text v0.3.7 // indirect
-	gopkg.in/square/go-jose.v2 v2.6.0 // indirect
 	gopkg.in/yaml.v2 v2.2.8 // indirect
 	xorm.io/builder v0.3.9 // indirect
 )
@@ -0,0 +1,249 @@
+package jose
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+)
+
+// keys are stored as JWK set files, one file for each generation.
+// a generation has a rsa key for encryption and a hs256 key for signing,
+// both have same kid. kid starts with unix time of creation,
+// the newest generation is current and others are previous
+
+const (
+	keyFileExt  = ".jwk.json"
+	keyFileMode = 0600
+	keyDirMode  = 0700
+
+	useEncryption = "enc"
+	useSignature  = "sig"
+)
+
+type keyPair struct {
+	kid          string
+	createdAt    time.Time
+	privateKey   *rsa.PrivateKey
+	signatureKey []byte
+}
+
+// newest first
+type keyRing struct {
+	keys []*keyPair
+}
+
+func (ring *keyRing) current() *keyPair {
+	return ring.keys[0]
+}
+
+func (ring *keyRing) find(kid string) (pair *keyPair, ok bool) {
+	for _, pair = range ring.keys {
+		if pair.kid == kid {
+			ok = true
+			return
+		}
+	}
+	pair = nil
+	return
+}
+
+func newKeyPair() (pair *keyPair, err error) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, rsaKeySize)
+	if err != nil {
+		return
+	}
+	signatureKey := make([]byte, hs256KeySize)
+	_, err = rand.Read(signatureKey)
+	if err != nil {
+		return
+	}
+	suffix := make([]byte, 4)
+	_, err = rand.Read(suffix)
+	if err != nil {
+		return
+	}
+
+	now := time.Now()
+	pair = &keyPair{
+		kid:          fmt.Sprintf("%d-%x", now.Unix(), suffix),
+		createdAt:    time.Unix(now.Unix(), 0),
+		privateKey:   privateKey,
+		signatureKey: signatureKey,
+	}
+	return
+}
+
+func (pair *keyPair) fileName() string {
+	return pair.kid + keyFileExt
+}
+
+func (pair *keyPair) save(dir string) (err error) {
+	bin, err := json.MarshalIndent(
+		jose.JSONWebKeySet{
+			Keys: []jose.JSONWebKey{
+				{
+					Key:       pair.privateKey,
+					KeyID:     pair.kid,
+					Algorithm: string(jose.RSA_OAEP_256),
+					Use:       useEncryption,
+				},
+				{
+					Key:       pair.signatureKey,
+					KeyID:     pair.kid,
+					Algorithm: string(jose.HS256),
+					Use:       useSignature,
+				},
+			},
+		},
+		"",
+		"  ",
+	)
+	if err != nil {
+		return
+	}
+
+	// write and rename, never leave half written key
+	path := filepath.Join(dir, pair.fileName())
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, bin, keyFileMode)
+	if err != nil {
+		return
+	}
+	err = os.Rename(tmp, path)
+	return
+}
+
+func loadKeyPair(path string) (pair *keyPair, err error) {
+	bin, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	set := jose.JSONWebKeySet{}
+	err = json.Unmarshal(bin, &set)
+	if err != nil {
+		return
+	}
+
+	kid := strings.TrimSuffix(filepath.Base(path), keyFileExt)
+	createdAt, err := timeFromKid(kid)
+	if err != nil {
+		return
+	}
+	pair = &keyPair{
+		kid:       kid,
+		createdAt: createdAt,
+	}
+	for _, k := range set.Keys {
+		if k.KeyID != kid {
+			err = fmt.Errorf("%s: kid %s does not match file", path, k.KeyID)
+			return
+		}
+		switch k.Use {
+		case useEncryption:
+			privateKey, ok := k.Key.(*rsa.PrivateKey)
+			if !ok {
+				err = fmt.Errorf("%s: encryption key is not rsa private key", path)
+				return
+			}
+			pair.privateKey = privateKey
+		case useSignature:
+			signatureKey, ok := k.Key.([]byte)
+			if !ok || uint(len(signatureKey)) < hs256KeySize {
+				err = fmt.Errorf("%s: invalid signature key", path)
+				return
+			}
+			pair.signatureKey = signatureKey
+		}
+	}
+	if pair.privateKey == nil || pair.signatureKey == nil {
+		err = fmt.Errorf("%s: key is missing", path)
+	}
+	return
+}
+
+func timeFromKid(kid string) (t time.Time, err error) {
+	unixStr, _, ok := strings.Cut(kid, "-")
+	if !ok {
+		err = fmt.Errorf("invalid kid: %s", kid)
+		return
+	}
+	unix, err := strconv.ParseInt(unixStr, 10, 64)
+	if err != nil {
+		return
+	}
+	t = time.Unix(unix, 0)
+	return
+}
+
+func loadKeyRing(dir string) (ring *keyRing, err error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+keyFileExt))
+	if err != nil {
+		return
+	}
+
+	ring = &keyRing{}
+	for _, path := range paths {
+		var pair *keyPair
+		pair, err = loadKeyPair(path)
+		if err != nil {
+			return
+		}
+		ring.keys = append(ring.keys, pair)
+	}
+	sort.Slice(ring.keys, func(i, j int) bool {
+		return ring.keys[i].createdAt.After(ring.keys[j].createdAt)
+	})
+	return
+}
+
+// RotateKeys adds a new current key into dir.
+// previous keys are kept while tokens issued with them can be alive,
+// so running servers should be restarted to pick up the new key
+func RotateKeys(dir string) (kid string, err error) {
+	err = os.MkdirAll(dir, keyDirMode)
+	if err != nil {
+		return
+	}
+
+	ring, err := loadKeyRing(dir)
+	if err != nil {
+		return
+	}
+	pair, err := newKeyPair()
+	if err != nil {
+		return
+	}
+	if len(ring.keys) > 0 && !pair.createdAt.After(ring.current().createdAt) {
+		err = errors.New("current key is too new to rotate")
+		return
+	}
+	err = pair.save(dir)
+	if err != nil {
+		return
+	}
+	kid = pair.kid
+
+	// key is retired when next one is created,
+	// tokens signed with it expire within keyRetention after that
+	retiredAt := pair.createdAt
+	for _, old := range ring.keys {
+		if time.Since(retiredAt) > keyRetention {
+			err = os.Remove(filepath.Join(dir, old.fileName()))
+			if err != nil {
+				return
+			}
+		}
+		retiredAt = old.createdAt
+	}
+	return
+}
@@ -0,0 +1,155 @@
+package jose
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// key pair as if created at t
+func newKeyPairAt(t *testing.T, createdAt time.Time) *keyPair {
+	t.Helper()
+	pair, err := newKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pair.kid = fmt.Sprintf("%d-test", createdAt.Unix())
+	pair.createdAt = time.Unix(createdAt.Unix(), 0)
+	return pair
+}
+
+func TestKeyPairSaveLoad(t *testing.T) {
+	dir := t.TempDir()
+	pair := newKeyPairAt(t, time.Now())
+	if err := pair.save(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(filepath.Join(dir, pair.fileName()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != keyFileMode {
+		t.Errorf("key file mode = %o, want %o", mode, keyFileMode)
+	}
+
+	loaded, err := loadKeyPair(filepath.Join(dir, pair.fileName()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.kid != pair.kid || !loaded.createdAt.Equal(pair.createdAt) {
+		t.Errorf("loaded %s at %v, want %s at %v",
+			loaded.kid, loaded.createdAt, pair.kid, pair.createdAt)
+	}
+	if !loaded.privateKey.Equal(pair.privateKey) {
+		t.Error("loaded private key differs")
+	}
+	if string(loaded.signatureKey) != string(pair.signatureKey) {
+		t.Error("loaded signature key differs")
+	}
+}
+
+func TestLoadKeyPairRejectsRenamedFile(t *testing.T) {
+	dir := t.TempDir()
+	pair := newKeyPairAt(t, time.Now())
+	if err := pair.save(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	// kid in file no longer matches its name
+	renamed := filepath.Join(dir, "1-other"+keyFileExt)
+	err := os.Rename(filepath.Join(dir, pair.fileName()), renamed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = loadKeyPair(renamed); err == nil {
+		t.Error("renamed key file was loaded")
+	}
+}
+
+func TestKeyRingNewestFirst(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	oldest := newKeyPairAt(t, now.Add(-time.Hour*2))
+	newest := newKeyPairAt(t, now)
+	middle := newKeyPairAt(t, now.Add(-time.Hour))
+	for _, pair := range []*keyPair{oldest, newest, middle} {
+		if err := pair.save(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ring, err := loadKeyRing(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ring.keys) != 3 {
+		t.Fatalf("ring has %d keys, want 3", len(ring.keys))
+	}
+	if ring.current().kid != newest.kid {
+		t.Errorf("current = %s, want %s", ring.current().kid, newest.kid)
+	}
+	if ring.keys[2].kid != oldest.kid {
+		t.Errorf("last = %s, want %s", ring.keys[2].kid, oldest.kid)
+	}
+	if _, ok := ring.find(middle.kid); !ok {
+		t.Errorf("%s not found", middle.kid)
+	}
+	if _, ok := ring.find("1-unknown"); ok {
+		t.Error("unknown kid found")
+	}
+}
+
+func TestRotateKeysRemovesExpired(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	// retired by previous, tokens signed with it have expired
+	expired := newKeyPairAt(t, now.Add(-keyRetention*3))
+	// retired just now by the new key, tokens may still be alive
+	previous := newKeyPairAt(t, now.Add(-keyRetention*2))
+	for _, pair := range []*keyPair{expired, previous} {
+		if err := pair.save(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	kid, err := RotateKeys(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ring, err := loadKeyRing(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ring.current().kid != kid {
+		t.Errorf("current = %s, want %s", ring.current().kid, kid)
+	}
+	if _, ok := ring.find(previous.kid); !ok {
+		t.Error("previous key was removed")
+	}
+	if _, ok := ring.find(expired.kid); ok {
+		t.Error("expired key was kept")
+	}
+}
+
+func TestRotateKeysRefusesNewerCurrent(t *testing.T) {
+	dir := t.TempDir()
+	// clock went back after current was created
+	current := newKeyPairAt(t, time.Now().Add(time.Hour))
+	if err := current.save(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := RotateKeys(dir); err == nil {
+		t.Error("rotated with key older than current")
+	}
+	ring, err := loadKeyRing(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ring.keys) != 1 || ring.current().kid != current.kid {
+		t.Error("key was added by refused rotation")
+	}
+}
@@ -1,10 +1,8 @@
 package jose
 
 import (
-	"crypto/rand"
-	"crypto/rsa"
 	"errors"
-	"learning-web-chatboard4/common"
+	"fmt"
 	"log"
 	"os"
 	"strings"
@@ -20,34 +18,45 @@ type Scope struct {
 	Scopes []string
 }
 
+const headerKeyID jose.HeaderKey = "kid"
+
 const (
 	rsaKeySize        = 2048
 	hs256KeySize uint = 64
-	jwtExp            = time.Hour * 24
+	// access token, renewed with refresh token
+	jwtExp = time.Minute * 15
+	// longest lifetime of tokens signed by a key, including mail links
+	keyRetention = time.Hour * 24
 )
 
+// returns true if token of jti is revoked,
+// or subject logged out everywhere after issuedAt
+type RevocationCheck func(jti, subject string, issuedAt time.Time) (bool, error)
+
+// token may be valid, but revocation state could not be read
+var ErrRevocationCheckFailed = errors.New("revocation check failed")
+
 var joseMaker struct {
 	isInitialized bool
 	logger        *log.Logger
 
-	privateKey   *rsa.PrivateKey
-	publicKey    *rsa.PublicKey
-	signatureKey []byte
+	keys *keyRing
 
 	encrypter jose.Encrypter
 	singner   jose.Signer
 
 	issuer         string
 	knownAudiences jwt.Audience
+
+	isRevoked RevocationCheck
 }
 
-func StartJoseMaker(issuer string) (err error) {
+// keys are loaded from keysDir, first key is generated if there is none
+func StartJoseMaker(issuer, keysDir string) (err error) {
 	if joseMaker.isInitialized {
 		return
 	}
 
-	joseMaker.isInitialized = true
-
 	joseMaker.logger = log.New(
 		os.Stdout,
 		"[JOSE] ",
@@ -56,18 +65,36 @@ func StartJoseMaker(issuer string) (err error) {
 
 	joseMaker.issuer = issuer
 
-	joseMaker.privateKey, err = rsa.GenerateKey(rand.Reader, rsaKeySize)
+	joseMaker.keys, err = loadKeyRing(keysDir)
 	if err != nil {
 		return
 	}
-	joseMaker.publicKey = &joseMaker.privateKey.PublicKey
+	if len(joseMaker.keys.keys) == 0 {
+		var kid string
+		kid, err = RotateKeys(keysDir)
+		if err != nil {
+			return
+		}
+		joseMaker.logger.Printf("generated first key: %s\n", kid)
+		joseMaker.keys, err = loadKeyRing(keysDir)
+		if err != nil {
+			return
+		}
+	}
+	current := joseMaker.keys.current()
+	joseMaker.logger.Printf(
+		"current key: %s, %d keys in ring\n",
+		current.kid,
+		len(joseMaker.keys.keys),
+	)
 
 	// use rsa for future development
 	joseMaker.encrypter, err = jose.NewEncrypter(
 		jose.A256GCM,
 		jose.Recipient{
 			Algorithm: jose.RSA_OAEP_256,
-			Key:       joseMaker.publicKey,
+			Key:       &current.privateKey.PublicKey,
+			KeyID:     current.kid,
 		},
 		(&jose.EncrypterOptions{}).WithType("JWT").WithContentType("JWT"),
 	)
@@ -75,24 +102,21 @@ func StartJoseMaker(issuer string) (err error) {
 		return
 	}
 
-	var sKey string
-	sKey, err = common.GenerateRandomString(hs256KeySize)
-	if err != nil {
-		return
-	}
-	joseMaker.signatureKey = []byte(sKey)
-
+	// symmetric signer does not put kid by itself
 	joseMaker.singner, err = jose.NewSigner(
 		jose.SigningKey{
 			Algorithm: jose.HS256,
-			Key:       joseMaker.signatureKey,
+			Key:       current.signatureKey,
 		},
-		(&jose.SignerOptions{}).WithType("JWT"),
+		(&jose.SignerOptions{}).
+			WithType("JWT").
+			WithHeader(headerKeyID, current.kid),
 	)
 	if err != nil {
 		return
 	}
 
+	joseMaker.isInitialized = true
 	return
 }
 
@@ -100,6 +124,11 @@ func AddKnownAudience(audience string) {
 	joseMaker.knownAudiences = append(joseMaker.knownAudiences, audience)
 }
 
+// check is called by VerifyJWT after other checks passed
+func SetRevocationCheck(check RevocationCheck) {
+	joseMaker.isRevoked = check
+}
+
 func NewClaims(subject, audience string) (clms *jwt.Claims, err error) {
 	if !slices.Contains[string](joseMaker.knownAudiences, audience) {
 		err = errors.New("unknown audience")
@@ -121,9 +150,10 @@ func NewClaims(subject, audience string) (clms *jwt.Claims, err error) {
 	return
 }
 
-func NewScope() (scp *Scope) {
+// scopes are derived from role of the user
+func NewScope(scopes ...string) (scp *Scope) {
 	scp = &Scope{
-		Scopes: []string{"read", "write"},
+		Scopes: scopes,
 	}
 	return
 }
@@ -139,30 +169,45 @@ func MakeJWT(clms *jwt.Claims, scp *Scope) (rawToken string, err error) {
 	return
 }
 
-func VerifyJWT(raw, email, client string) (err error) {
+// decrypts and checks signature only, for reading jti of tokens to revoke.
+// use VerifyJWT for authentication
+func ReadJWT(raw string) (clm *jwt.Claims, scp *Scope, err error) {
 	parsed, err := jwt.ParseSignedAndEncrypted(raw)
 	if err != nil {
 		return
 	}
-	decr, err := parsed.Decrypt(joseMaker.privateKey)
+	encKey, err := findKey(parsed.Headers)
+	if err != nil {
+		return
+	}
+	decr, err := parsed.Decrypt(encKey.privateKey)
+	if err != nil {
+		return
+	}
+	sigKey, err := findKey(decr.Headers)
 	if err != nil {
 		return
 	}
 
-	clm := jwt.Claims{}
-	scp := Scope{}
-	err = decr.Claims(joseMaker.signatureKey, &clm)
+	clm = &jwt.Claims{}
+	scp = &Scope{}
+	err = decr.Claims(sigKey.signatureKey, clm)
 	if err != nil {
 		return
 	}
-	err = decr.Claims(joseMaker.signatureKey, &scp)
+	err = decr.Claims(sigKey.signatureKey, scp)
+	return
+}
+
+// returns scopes in the token
+func VerifyJWT(raw, email, client string) (scopes []string, err error) {
+	clm, scp, err := ReadJWT(raw)
 	if err != nil {
 		return
 	}
 
-	// check scope has both read and write
-	if !slices.Contains[string](scp.Scopes, "read") ||
-		!slices.Contains[string](scp.Scopes, "write") {
+	// every role can read
+	if !slices.Contains[string](scp.Scopes, "read") {
 		err = errors.New("out of scopes")
 		return
 	}
@@ -208,5 +253,41 @@ func VerifyJWT(raw, email, client string) (err error) {
 		return
 	}
 
+	// check revoked, last as it may hit database
+	if joseMaker.isRevoked != nil {
+		var revoked bool
+		revoked, err = joseMaker.isRevoked(
+			clm.ID,
+			clm.Subject,
+			clm.IssuedAt.Time(),
+		)
+		if err != nil {
+			err = fmt.Errorf("%w: %v", ErrRevocationCheckFailed, err)
+			return
+		}
+		if revoked {
+			err = errors.New("token revoked")
+			return
+		}
+	}
+
+	scopes = scp.Scopes
+	return
+}
+
+// picks key in ring with kid in header
+func findKey(headers []jose.Header) (pair *keyPair, err error) {
+	if len(headers) == 0 || len(headers[0].KeyID) == 0 {
+		err = errors.New("kid not found")
+		return
+	}
+	pair, ok := joseMaker.keys.find(headers[0].KeyID)
+	if !ok {
+		err = errors.New("unknown kid")
+		joseMaker.logger.Printf(
+			"unknown kid: %s\n",
+			headers[0].KeyID,
+		)
+	}
 	return
 }
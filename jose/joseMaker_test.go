@@ -0,0 +1,145 @@
+package jose
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testIssuer   = "test-issuer"
+	testAudience = "test-audience"
+	testSubject  = "user@example.com"
+)
+
+// maker is shared by every test, keys are generated into a temporary dir
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "jose-keys")
+	if err != nil {
+		panic(err)
+	}
+	err = StartJoseMaker(testIssuer, dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		panic(err)
+	}
+	AddKnownAudience(testAudience)
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func makeTestJWT(t *testing.T, subject string, scopes ...string) string {
+	t.Helper()
+	clms, err := NewClaims(subject, testAudience)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := MakeJWT(clms, NewScope(scopes...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func TestVerifyJWT(t *testing.T) {
+	raw := makeTestJWT(t, testSubject, "read", "write")
+
+	scopes, err := VerifyJWT(raw, testSubject, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(scopes, ",") != "read,write" {
+		t.Errorf("scopes = %v, want [read write]", scopes)
+	}
+}
+
+func TestVerifyJWTRejects(t *testing.T) {
+	raw := makeTestJWT(t, testSubject, "read")
+	parts := strings.Split(raw, ".")
+	// flip a character of the ciphertext
+	cipher := []byte(parts[3])
+	if cipher[0] == 'A' {
+		cipher[0] = 'B'
+	} else {
+		cipher[0] = 'A'
+	}
+	parts[3] = string(cipher)
+	tampered := strings.Join(parts, ".")
+
+	tests := []struct {
+		name    string
+		raw     string
+		subject string
+	}{
+		{"other subject", raw, "other@example.com"},
+		{"tampered", tampered, testSubject},
+		{"no read scope", makeTestJWT(t, testSubject, "write"), testSubject},
+		{"garbage", "not.a.token", testSubject},
+	}
+
+	for _, test := range tests {
+		if _, err := VerifyJWT(test.raw, test.subject, ""); err == nil {
+			t.Errorf("%s: token was verified", test.name)
+		}
+	}
+}
+
+func TestNewClaimsUnknownAudience(t *testing.T) {
+	if _, err := NewClaims(testSubject, "unknown-audience"); err == nil {
+		t.Error("claims were made for unknown audience")
+	}
+}
+
+func TestReadJWT(t *testing.T) {
+	raw := makeTestJWT(t, testSubject, "read")
+
+	clm, scp, err := ReadJWT(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clm.Subject != testSubject || clm.Issuer != testIssuer {
+		t.Errorf("claims = %s by %s, want %s by %s",
+			clm.Subject, clm.Issuer, testSubject, testIssuer)
+	}
+	if len(clm.ID) == 0 {
+		t.Error("token has no jti")
+	}
+	if len(scp.Scopes) != 1 || scp.Scopes[0] != "read" {
+		t.Errorf("scopes = %v, want [read]", scp.Scopes)
+	}
+}
+
+func TestVerifyJWTRevoked(t *testing.T) {
+	t.Cleanup(func() { SetRevocationCheck(nil) })
+	raw := makeTestJWT(t, testSubject, "read")
+	clm, _, err := ReadJWT(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	SetRevocationCheck(func(jti, subject string, issuedAt time.Time) (bool, error) {
+		if subject != testSubject || !issuedAt.Equal(clm.IssuedAt.Time()) {
+			t.Errorf("check got %s at %v", subject, issuedAt)
+		}
+		return jti == clm.ID, nil
+	})
+	if _, err = VerifyJWT(raw, testSubject, ""); err == nil {
+		t.Error("revoked token was verified")
+	}
+	other := makeTestJWT(t, testSubject, "read")
+	if _, err = VerifyJWT(other, testSubject, ""); err != nil {
+		t.Errorf("token which is not revoked: %v", err)
+	}
+
+	SetRevocationCheck(func(jti, subject string, issuedAt time.Time) (bool, error) {
+		return false, errors.New("database is down")
+	})
+	_, err = VerifyJWT(other, testSubject, "")
+	if !errors.Is(err, ErrRevocationCheckFailed) {
+		t.Errorf("err = %v, want %v", err, ErrRevocationCheckFailed)
+	}
+}
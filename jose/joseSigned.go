@@ -0,0 +1,68 @@
+package jose
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// signed only tokens for links in mails etc.
+// purpose is used as audience and must match exactly,
+// so these tokens can't be used in place of each other or of JWT for login
+
+func MakeSignedToken(
+	purpose, subject string,
+	exp time.Duration,
+) (rawToken string, err error) {
+	if len(purpose) == 0 || len(subject) == 0 {
+		err = errors.New("need purpose and subject")
+		return
+	}
+
+	t := time.Now()
+	rawToken, err = jwt.Signed(joseMaker.singner).
+		Claims(jwt.Claims{
+			Issuer:    joseMaker.issuer,
+			Subject:   subject,
+			Audience:  jwt.Audience{purpose},
+			Expiry:    jwt.NewNumericDate(t.Add(exp)),
+			NotBefore: jwt.NewNumericDate(t),
+			IssuedAt:  jwt.NewNumericDate(t),
+		}).
+		CompactSerialize()
+	return
+}
+
+func VerifySignedToken(raw, purpose string) (subject string, err error) {
+	parsed, err := jwt.ParseSigned(raw)
+	if err != nil {
+		return
+	}
+	key, err := findKey(parsed.Headers)
+	if err != nil {
+		return
+	}
+
+	clm := jwt.Claims{}
+	err = parsed.Claims(key.signatureKey, &clm)
+	if err != nil {
+		return
+	}
+	err = clm.Validate(jwt.Expected{
+		Issuer:   joseMaker.issuer,
+		Audience: jwt.Audience{purpose},
+		Time:     time.Now(),
+	})
+	if err != nil {
+		return
+	}
+	if len(clm.Audience) != 1 || strings.Compare(clm.Audience[0], purpose) != 0 {
+		err = errors.New("unknown audience")
+		return
+	}
+
+	subject = clm.Subject
+	return
+}
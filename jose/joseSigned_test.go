@@ -0,0 +1,60 @@
+package jose
+
+import (
+	"testing"
+	"time"
+)
+
+func TestVerifySignedToken(t *testing.T) {
+	raw, err := MakeSignedToken("verify-email", testSubject, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subject, err := VerifySignedToken(raw, "verify-email")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subject != testSubject {
+		t.Errorf("subject = %q, want %q", subject, testSubject)
+	}
+
+	if _, err = VerifySignedToken(raw, "reset-password"); err == nil {
+		t.Error("token was verified for other purpose")
+	}
+}
+
+func TestVerifySignedTokenRejects(t *testing.T) {
+	expired, err := MakeSignedToken("verify-email", testSubject, -time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clms, err := NewClaims(testSubject, testAudience)
+	if err != nil {
+		t.Fatal(err)
+	}
+	login, err := MakeJWT(clms, NewScope("read"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		raw     string
+		purpose string
+	}{
+		{"expired", expired, "verify-email"},
+		{"login token", login, testAudience},
+		{"garbage", "not.a.token", "verify-email"},
+	}
+
+	for _, test := range tests {
+		if _, err := VerifySignedToken(test.raw, test.purpose); err == nil {
+			t.Errorf("%s: token was verified", test.name)
+		}
+	}
+
+	if _, err = MakeSignedToken("", testSubject, time.Hour); err == nil {
+		t.Error("token was made without purpose")
+	}
+}
@@ -0,0 +1,89 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// kinds of sender in config.json
+const (
+	SenderKindLog  = "log"
+	SenderKindFile = "file"
+	SenderKindSMTP = "smtp"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Sender delivers plain text mails
+type Sender interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+type Options struct {
+	// one of SenderKind*, empty is log
+	Kind string
+	From string
+	// for file sender
+	Dir string
+	// for smtp sender, password is read from SMTPPasswordEnv
+	SMTPAddress  string
+	SMTPUserName string
+}
+
+func NewSender(options Options, logger *log.Logger) (sender Sender, err error) {
+	switch options.Kind {
+	case "", SenderKindLog:
+		sender = &LogSender{
+			From:   options.From,
+			Logger: logger,
+		}
+	case SenderKindFile:
+		err = os.MkdirAll(options.Dir, 0700)
+		if err != nil {
+			return
+		}
+		sender = &FileSender{
+			From: options.From,
+			Dir:  options.Dir,
+		}
+	case SenderKindSMTP:
+		sender = NewSMTPSender(
+			options.SMTPAddress,
+			options.SMTPUserName,
+			options.From,
+		)
+	default:
+		err = fmt.Errorf("unknown mail sender: %s", options.Kind)
+	}
+	return
+}
+
+// header injection is refused here for every sender
+func (msg *Message) check() error {
+	if strings.ContainsAny(msg.To, "\r\n") ||
+		strings.ContainsAny(msg.Subject, "\r\n") {
+		return fmt.Errorf("invalid mail header")
+	}
+	return nil
+}
+
+func (msg *Message) bytes(from string, date time.Time) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
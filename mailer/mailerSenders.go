@@ -0,0 +1,102 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// same with DBPASS for postgres, password is not in config file
+const SMTPPasswordEnv = "SMTPPASS"
+
+// for local development, mails are only printed
+type LogSender struct {
+	From   string
+	Logger *log.Logger
+}
+
+func (sender *LogSender) Send(ctx context.Context, msg Message) (err error) {
+	err = msg.check()
+	if err != nil {
+		return
+	}
+	sender.Logger.Printf(
+		"mail to %s\n%s\n",
+		msg.To,
+		msg.bytes(sender.From, time.Now()),
+	)
+	return
+}
+
+// for local development, one mail is one .eml file in Dir
+type FileSender struct {
+	From string
+	Dir  string
+}
+
+func (sender *FileSender) Send(ctx context.Context, msg Message) (err error) {
+	err = msg.check()
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	name := fmt.Sprintf("%d.eml", now.UnixNano())
+	err = os.WriteFile(
+		filepath.Join(sender.Dir, name),
+		msg.bytes(sender.From, now),
+		0600,
+	)
+	return
+}
+
+type SMTPSender struct {
+	Address  string
+	UserName string
+	From     string
+	password string
+}
+
+// plain auth is used when userName is not empty
+func NewSMTPSender(address, userName, from string) *SMTPSender {
+	return &SMTPSender{
+		Address:  address,
+		UserName: userName,
+		From:     from,
+		password: os.Getenv(SMTPPasswordEnv),
+	}
+}
+
+// net/smtp does not take ctx, it is only checked before sending
+func (sender *SMTPSender) Send(ctx context.Context, msg Message) (err error) {
+	err = msg.check()
+	if err != nil {
+		return
+	}
+	err = ctx.Err()
+	if err != nil {
+		return
+	}
+
+	var auth smtp.Auth
+	if len(sender.UserName) > 0 {
+		host, _, e := net.SplitHostPort(sender.Address)
+		if e != nil {
+			err = e
+			return
+		}
+		auth = smtp.PlainAuth("", sender.UserName, sender.password, host)
+	}
+	err = smtp.SendMail(
+		sender.Address,
+		auth,
+		sender.From,
+		[]string{msg.To},
+		msg.bytes(sender.From, time.Now()),
+	)
+	return
+}
@@ -0,0 +1,247 @@
+package password
+
+// password hashes in PHC string format, the algorithm and its parameters
+// are stored with the hash so they can be changed later.
+//  argon2id: $argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>
+//  bcrypt:   $2a$12$<salt and key>, bcrypt's own format
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	AlgorithmArgon2id = "argon2id"
+	AlgorithmBcrypt   = "bcrypt"
+)
+
+// recommended by RFC 9106 for memory constrained environments
+const (
+	defaultArgon2Memory  uint32 = 64 * 1024
+	defaultArgon2Time    uint32 = 3
+	defaultArgon2Threads uint8  = 2
+	argon2SaltSize              = 16
+	argon2KeySize               = 32
+	defaultBcryptCost           = bcrypt.DefaultCost + 2
+)
+
+// PHC uses base64 without padding
+var encoding = base64.RawStdEncoding
+
+var (
+	ErrMismatch    = errors.New("password mismatch")
+	ErrUnknownHash = errors.New("unknown password hash")
+)
+
+// zero values are replaced with defaults, empty Algorithm is argon2id
+type Params struct {
+	Algorithm string
+	// KiB
+	Argon2Memory  uint32
+	Argon2Time    uint32
+	Argon2Threads uint8
+	BcryptCost    int
+}
+
+// Hasher hashes new passwords with its params,
+// and verifies hashes of any supported params
+type Hasher struct {
+	params Params
+}
+
+func NewHasher(params Params) (hasher *Hasher, err error) {
+	if len(params.Algorithm) == 0 {
+		params.Algorithm = AlgorithmArgon2id
+	}
+	if params.Argon2Memory == 0 {
+		params.Argon2Memory = defaultArgon2Memory
+	}
+	if params.Argon2Time == 0 {
+		params.Argon2Time = defaultArgon2Time
+	}
+	if params.Argon2Threads == 0 {
+		params.Argon2Threads = defaultArgon2Threads
+	}
+	if params.BcryptCost == 0 {
+		params.BcryptCost = defaultBcryptCost
+	}
+
+	switch params.Algorithm {
+	case AlgorithmArgon2id:
+	case AlgorithmBcrypt:
+		if params.BcryptCost < bcrypt.MinCost ||
+			params.BcryptCost > bcrypt.MaxCost {
+			err = fmt.Errorf("invalid bcrypt cost: %d", params.BcryptCost)
+			return
+		}
+	default:
+		err = fmt.Errorf("unknown password algorithm: %s", params.Algorithm)
+		return
+	}
+
+	hasher = &Hasher{params: params}
+	return
+}
+
+func (hasher *Hasher) Hash(pw string) (hashed string, err error) {
+	if hasher.params.Algorithm == AlgorithmBcrypt {
+		var bytes []byte
+		bytes, err = bcrypt.GenerateFromPassword(
+			[]byte(pw),
+			hasher.params.BcryptCost,
+		)
+		hashed = string(bytes)
+		return
+	}
+
+	salt := make([]byte, argon2SaltSize)
+	_, err = rand.Read(salt)
+	if err != nil {
+		return
+	}
+	hashed = hasher.argon2id(pw, salt).String()
+	return
+}
+
+// returns ErrMismatch when pw is wrong.
+// needsRehash is true for a correct pw whose hash is not of hasher's params
+func (hasher *Hasher) Verify(pw, hashed string) (needsRehash bool, err error) {
+	if strings.HasPrefix(hashed, "$"+AlgorithmArgon2id+"$") {
+		return hasher.verifyArgon2id(pw, hashed)
+	}
+	return hasher.verifyBcrypt(pw, hashed)
+}
+
+func (hasher *Hasher) verifyBcrypt(pw, hashed string) (needsRehash bool, err error) {
+	cost, err := bcrypt.Cost([]byte(hashed))
+	if err != nil {
+		err = ErrUnknownHash
+		return
+	}
+	err = bcrypt.CompareHashAndPassword([]byte(hashed), []byte(pw))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		err = ErrMismatch
+	}
+	if err != nil {
+		return
+	}
+
+	needsRehash = hasher.params.Algorithm != AlgorithmBcrypt ||
+		cost != hasher.params.BcryptCost
+	return
+}
+
+func (hasher *Hasher) verifyArgon2id(pw, hashed string) (needsRehash bool, err error) {
+	stored, err := parseArgon2id(hashed)
+	if err != nil {
+		return
+	}
+	computed := argon2.IDKey(
+		[]byte(pw),
+		stored.salt,
+		stored.time,
+		stored.memory,
+		stored.threads,
+		uint32(len(stored.key)),
+	)
+	if subtle.ConstantTimeCompare(computed, stored.key) != 1 {
+		err = ErrMismatch
+		return
+	}
+
+	params := hasher.params
+	needsRehash = params.Algorithm != AlgorithmArgon2id ||
+		stored.memory != params.Argon2Memory ||
+		stored.time != params.Argon2Time ||
+		stored.threads != params.Argon2Threads ||
+		len(stored.salt) != argon2SaltSize ||
+		len(stored.key) != argon2KeySize
+	return
+}
+
+type argon2idHash struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+func (hasher *Hasher) argon2id(pw string, salt []byte) *argon2idHash {
+	params := hasher.params
+	return &argon2idHash{
+		memory:  params.Argon2Memory,
+		time:    params.Argon2Time,
+		threads: params.Argon2Threads,
+		salt:    salt,
+		key: argon2.IDKey(
+			[]byte(pw),
+			salt,
+			params.Argon2Time,
+			params.Argon2Memory,
+			params.Argon2Threads,
+			argon2KeySize,
+		),
+	}
+}
+
+func (hash *argon2idHash) String() string {
+	return fmt.Sprintf(
+		"$%s$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		AlgorithmArgon2id,
+		argon2.Version,
+		hash.memory,
+		hash.time,
+		hash.threads,
+		encoding.EncodeToString(hash.salt),
+		encoding.EncodeToString(hash.key),
+	)
+}
+
+func parseArgon2id(hashed string) (hash *argon2idHash, err error) {
+	// "", "argon2id", "v=19", "m=..,t=..,p=..", salt, key
+	parts := strings.Split(hashed, "$")
+	if len(parts) != 6 {
+		err = ErrUnknownHash
+		return
+	}
+
+	var version int
+	_, err = fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		err = ErrUnknownHash
+		return
+	}
+
+	hash = &argon2idHash{}
+	_, err = fmt.Sscanf(
+		parts[3],
+		"m=%d,t=%d,p=%d",
+		&hash.memory,
+		&hash.time,
+		&hash.threads,
+	)
+	if err != nil || hash.time == 0 || hash.threads == 0 {
+		err = ErrUnknownHash
+		return
+	}
+
+	hash.salt, err = encoding.DecodeString(parts[4])
+	if err != nil {
+		err = ErrUnknownHash
+		return
+	}
+	hash.key, err = encoding.DecodeString(parts[5])
+	if err != nil || len(hash.key) == 0 {
+		err = ErrUnknownHash
+		return
+	}
+	return
+}
@@ -0,0 +1,164 @@
+package password
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// small params so tests run fast
+var testParams = Params{
+	Argon2Memory:  1024,
+	Argon2Time:    1,
+	Argon2Threads: 1,
+	BcryptCost:    bcrypt.MinCost,
+}
+
+func newTestHasher(t *testing.T, params Params) *Hasher {
+	t.Helper()
+	hasher, err := NewHasher(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hasher
+}
+
+func TestHashVerify(t *testing.T) {
+	for _, algorithm := range []string{AlgorithmArgon2id, AlgorithmBcrypt} {
+		params := testParams
+		params.Algorithm = algorithm
+		hasher := newTestHasher(t, params)
+
+		hashed, err := hasher.Hash("correct horse")
+		if err != nil {
+			t.Fatal(err)
+		}
+		needsRehash, err := hasher.Verify("correct horse", hashed)
+		if err != nil {
+			t.Fatalf("%s: %v", algorithm, err)
+		}
+		if needsRehash {
+			t.Errorf("%s: hash of own params needs rehash", algorithm)
+		}
+
+		_, err = hasher.Verify("wrong horse", hashed)
+		if err != ErrMismatch {
+			t.Errorf("%s: err = %v, want %v", algorithm, err, ErrMismatch)
+		}
+	}
+}
+
+func TestHashArgon2idFormat(t *testing.T) {
+	hasher := newTestHasher(t, testParams)
+	hashed, err := hasher.Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hashed, "$argon2id$v=19$m=1024,t=1,p=1$") {
+		t.Errorf("hash = %s", hashed)
+	}
+
+	// salted
+	other, err := hasher.Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == hashed {
+		t.Error("same hash for same password")
+	}
+}
+
+func TestVerifyNeedsRehash(t *testing.T) {
+	bcryptParams := testParams
+	bcryptParams.Algorithm = AlgorithmBcrypt
+	bcryptHasher := newTestHasher(t, bcryptParams)
+	argon2Hasher := newTestHasher(t, testParams)
+
+	bcryptHash, err := bcryptHasher.Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	argon2Hash, err := argon2Hasher.Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	strongerParams := testParams
+	strongerParams.Argon2Time = 2
+	strongerBcrypt := bcryptParams
+	strongerBcrypt.BcryptCost = bcrypt.MinCost + 1
+
+	tests := []struct {
+		name   string
+		hasher *Hasher
+		hashed string
+	}{
+		{"bcrypt to argon2id", argon2Hasher, bcryptHash},
+		{"argon2id to bcrypt", bcryptHasher, argon2Hash},
+		{"argon2id params", newTestHasher(t, strongerParams), argon2Hash},
+		{"bcrypt cost", newTestHasher(t, strongerBcrypt), bcryptHash},
+	}
+
+	for _, test := range tests {
+		needsRehash, err := test.hasher.Verify("correct horse", test.hashed)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if !needsRehash {
+			t.Errorf("%s: rehash is not needed", test.name)
+		}
+
+		// rehash is only reported for correct password
+		needsRehash, err = test.hasher.Verify("wrong horse", test.hashed)
+		if err != ErrMismatch || needsRehash {
+			t.Errorf("%s: wrong password: needsRehash, err = %v, %v",
+				test.name, needsRehash, err)
+		}
+	}
+}
+
+func TestVerifyUnknownHash(t *testing.T) {
+	hasher := newTestHasher(t, testParams)
+	valid, err := hasher.Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(valid, "$")
+
+	tests := []string{
+		"",
+		"plain text",
+		"$argon2id$v=19$m=1024,t=1,p=1$salt",
+		"$argon2id$v=18$" + strings.Join(parts[3:], "$"),
+		"$argon2id$v=19$m=1024,t=0,p=1$" + strings.Join(parts[4:], "$"),
+		"$argon2id$v=19$" + parts[3] + "$" + parts[4] + "$",
+		"$argon2id$v=19$" + parts[3] + "$!!!$" + parts[5],
+	}
+
+	for _, hashed := range tests {
+		if _, err := hasher.Verify("correct horse", hashed); err != ErrUnknownHash {
+			t.Errorf("Verify(%q): err = %v, want %v", hashed, err, ErrUnknownHash)
+		}
+	}
+}
+
+func TestNewHasher(t *testing.T) {
+	hasher := newTestHasher(t, Params{})
+	if hasher.params.Algorithm != AlgorithmArgon2id ||
+		hasher.params.Argon2Memory != defaultArgon2Memory ||
+		hasher.params.BcryptCost != defaultBcryptCost {
+		t.Errorf("params = %+v, want defaults", hasher.params)
+	}
+
+	invalid := []Params{
+		{Algorithm: "md5"},
+		{Algorithm: AlgorithmBcrypt, BcryptCost: bcrypt.MinCost - 1},
+		{Algorithm: AlgorithmBcrypt, BcryptCost: bcrypt.MaxCost + 1},
+	}
+	for _, params := range invalid {
+		if _, err := NewHasher(params); err == nil {
+			t.Errorf("NewHasher(%+v) passed", params)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package rabbitrpc
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const pendingPollInterval = time.Millisecond * 50
+
+// callback map for convenience of correlation id check
+// safe for concurrent use
+
+type CallbackPool struct {
+	mutex     sync.Mutex
+	callbacks map[string]func(raws Raws)
+}
+
+func NewCallbackPool() *CallbackPool {
+	return &CallbackPool{
+		callbacks: make(map[string]func(raws Raws)),
+	}
+}
+
+func (pool *CallbackPool) Add(corrId string, callback func(raws Raws)) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	pool.callbacks[corrId] = callback
+}
+
+func (pool *CallbackPool) Remove(corrId string) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	delete(pool.callbacks, corrId)
+}
+
+func (pool *CallbackPool) Len() int {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	return len(pool.callbacks)
+}
+
+// blocks until every callback is dispatched or ctx is done
+func (pool *CallbackPool) Wait(ctx context.Context) error {
+	ticker := time.NewTicker(pendingPollInterval)
+	defer ticker.Stop()
+
+	for pool.Len() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return fmt.Errorf(
+				"%d requests still waiting: %w",
+				pool.Len(),
+				ctx.Err(),
+			)
+		}
+	}
+	return nil
+}
+
+// removes the entry and calls it,
+// returns false if correlation id is unknown
+func (pool *CallbackPool) Dispatch(raws Raws) bool {
+	pool.mutex.Lock()
+	callback, ok := pool.callbacks[raws.CorrelationId]
+	if ok {
+		delete(pool.callbacks, raws.CorrelationId)
+	}
+	pool.mutex.Unlock()
+
+	if ok {
+		callback(raws)
+	}
+	return ok
+}
+
+// answers every waiting callback with error response
+func (pool *CallbackPool) FailAll(e *RabbitRPCError) {
+	bin, err := makeBin(
+		Envelope{
+			Status:       StatusError,
+			DataTypeName: ErrorTypeName,
+			Code:         e.Code,
+		},
+		e,
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	pool.mutex.Lock()
+	callbacks := pool.callbacks
+	pool.callbacks = make(map[string]func(raws Raws))
+	pool.mutex.Unlock()
+
+	for corrId, callback := range callbacks {
+		callback(Raws{
+			Body:          bin,
+			CorrelationId: corrId,
+		})
+	}
+}
+
+// Shutdown waits for requests still waiting responses, then stops client.
+// client is stopped even if ctx is done first
+func (rabbit *RabbitClient) Shutdown(ctx context.Context) (err error) {
+	err = rabbit.pending.Wait(ctx)
+	rabbit.Subscriber.Done()
+	rabbit.Publisher.Done()
+	return
+}
+
+func (rabbit *RabbitClient) onResponseReceived(raws Raws) {
+	if !rabbit.pending.Dispatch(raws) {
+		rabbitLogger.Printf(
+			"recieved unknown response: %s",
+			raws.CorrelationId,
+		)
+	}
+}
+
+// Request publishes envelope and waits for the correlated response.
+// when ctx is done before response arrives, correlation entry is removed
+// and ErrorTimeout or ErrorCanceled is returned.
+// fails fast with ErrorUnavailable while disconnected
+func (rabbit *RabbitClient) Request(
+	ctx context.Context,
+	functionToCall string,
+	dataTypeName string,
+	dataPtr interface{},
+) (raws Raws, err error) {
+	if !rabbit.IsConnected() {
+		err = ErrorUnavailable
+		return
+	}
+
+	envelop := Envelope{
+		Method:         MethodCodeGET,
+		Status:         StatusOK,
+		FunctionToCall: functionToCall,
+		DataTypeName:   dataTypeName,
+	}
+	if caller, ok := CallerFrom(ctx); ok {
+		envelop.Caller = caller
+	}
+	if client, ok := ctx.Value(clientKey{}).(*Client); ok {
+		envelop.Client = client
+	}
+	bin, e := makeBin(envelop, dataPtr)
+	if e != nil {
+		err = e
+		return
+	}
+
+	corrId := rabbit.GenerateCorrelationID()
+	wait := make(chan Raws, 1)
+	rabbit.pending.Add(corrId, func(raws Raws) {
+		wait <- raws
+	})
+
+	select {
+	case rabbit.Publisher.Ch <- Raws{
+		Body:          bin,
+		CorrelationId: corrId,
+	}:
+	case <-ctx.Done():
+		rabbit.pending.Remove(corrId)
+		err = contextError(ctx)
+		return
+	}
+
+	select {
+	case raws = <-wait:
+	case <-ctx.Done():
+		rabbit.pending.Remove(corrId)
+		err = contextError(ctx)
+	}
+	return
+}
+
+func contextError(ctx context.Context) *RabbitRPCError {
+	if ctx.Err() == context.DeadlineExceeded {
+		return ErrorTimeout
+	}
+	return ErrorCanceled
+}
+
+// Call sends req as functionToCall and decodes correlated response into Res.
+// error response from server is returned as *RabbitRPCError
+func Call[Req, Res any](
+	ctx context.Context,
+	client *RabbitClient,
+	functionToCall string,
+	req *Req,
+) (res Res, err error) {
+	raws, err := client.Request(
+		ctx,
+		functionToCall,
+		TypeNameOf(req),
+		req,
+	)
+	if err != nil {
+		return
+	}
+
+	envelop, e := FromBin(raws.Body)
+	if e != nil {
+		err = e
+		return
+	}
+
+	if envelop.Status == StatusError {
+		rerr := &RabbitRPCError{}
+		e = envelop.Extract(rerr)
+		if e != nil {
+			err = e
+			return
+		}
+		if len(rerr.Code) == 0 {
+			rerr.Code = envelop.Code
+		}
+		err = rerr
+		return
+	}
+
+	e = envelop.Extract(&res)
+	if e != nil {
+		err = e
+	}
+	return
+}
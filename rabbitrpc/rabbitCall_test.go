@@ -0,0 +1,102 @@
+package rabbitrpc
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCall(t *testing.T) {
+	router := NewRouter(func(err error) {})
+	Register(router, "upperTopic", upperTopic)
+	Register(router, "listTopics",
+		func(ctx context.Context, req *testTopic) (*[]testTopic, error) {
+			return &[]testTopic{*req, *req}, nil
+		},
+	)
+	client := newRouterClient(t, router)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	topic, err := Call[testTopic, testTopic](
+		ctx,
+		client,
+		"upperTopic",
+		&testTopic{Topic: "go"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if topic.Topic != "GO" {
+		t.Errorf("topic = %q, want %q", topic.Topic, "GO")
+	}
+
+	topics, err := Call[testTopic, []testTopic](
+		ctx,
+		client,
+		"listTopics",
+		&testTopic{Topic: "go"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(topics) != 2 || topics[1].Topic != "go" {
+		t.Errorf("topics = %v, want two of go", topics)
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	// server never responds
+	client, _ := newMemoryPair(t, func(server *RabbitClient, raws Raws) {})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	message := "hello"
+	_, err := client.Request(ctx, "echo", "string", &message)
+	if err != ErrorTimeout {
+		t.Fatalf("err = %v, want %v", err, ErrorTimeout)
+	}
+	if n := client.pending.Len(); n != 0 {
+		t.Errorf("pending = %d after timeout, want 0", n)
+	}
+}
+
+func TestRequestCanceled(t *testing.T) {
+	client, _ := newMemoryPair(t, func(server *RabbitClient, raws Raws) {})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(time.Millisecond * 50)
+		cancel()
+	}()
+	message := "hello"
+	_, err := client.Request(ctx, "echo", "string", &message)
+	if err != ErrorCanceled {
+		t.Fatalf("err = %v, want %v", err, ErrorCanceled)
+	}
+}
+
+func TestRequestDisconnected(t *testing.T) {
+	client := NewRPCClientWithTransport(
+		NewMemoryTransport(),
+		"req",
+		"res",
+		"ex",
+		ExchangeKindDirect,
+		"server",
+		"client",
+	)
+	client.Shutdown(context.Background())
+	// wait for the transport to notice
+	deadline := time.Now().Add(time.Second)
+	for client.IsConnected() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	message := "hello"
+	_, err := client.Request(context.Background(), "echo", "string", &message)
+	if err != ErrorUnavailable {
+		t.Fatalf("err = %v, want %v", err, ErrorUnavailable)
+	}
+}
@@ -0,0 +1,68 @@
+package rabbitrpc
+
+import "context"
+
+// Caller is the logged in user a request is made for.
+// it is set by router after the token is verified,
+// services trust it as they trust the router
+type Caller struct {
+	UserId uint     `json:"user_id"`
+	Email  string   `json:"email"`
+	Scopes []string `json:"scopes"`
+}
+
+// Client is the browser a request is made for, set by router
+type Client struct {
+	IP        string `json:"ip"`
+	UserAgent string `json:"user_agent"`
+}
+
+type callerKey struct{}
+type clientKey struct{}
+
+// requests made with returned ctx carry caller in the envelope
+func WithCaller(ctx context.Context, caller *Caller) context.Context {
+	return context.WithValue(ctx, callerKey{}, caller)
+}
+
+// on server side, caller of the request being handled
+func CallerFrom(ctx context.Context) (caller *Caller, ok bool) {
+	caller, ok = ctx.Value(callerKey{}).(*Caller)
+	ok = ok && caller != nil
+	return
+}
+
+func WithClient(ctx context.Context, client *Client) context.Context {
+	return context.WithValue(ctx, clientKey{}, client)
+}
+
+// empty client if request has none
+func ClientFrom(ctx context.Context) *Client {
+	client, ok := ctx.Value(clientKey{}).(*Client)
+	if !ok || client == nil {
+		return &Client{}
+	}
+	return client
+}
+
+func (caller *Caller) HasScope(scope string) bool {
+	for _, s := range caller.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// returns caller of ctx if it has scope
+func RequireScope(ctx context.Context, scope string) (caller *Caller, err error) {
+	caller, ok := CallerFrom(ctx)
+	if !ok {
+		err = NewError(CodeUnauthenticated, "need logged in caller")
+		return
+	}
+	if !caller.HasScope(scope) {
+		err = NewError(CodePermissionDenied, "caller has no scope "+scope)
+	}
+	return
+}
@@ -0,0 +1,61 @@
+package rabbitrpc
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRequireScope(t *testing.T) {
+	caller := &Caller{UserId: 1, Email: "a@example.com", Scopes: []string{"read"}}
+	tests := []struct {
+		ctx   context.Context
+		scope string
+		want  ErrorCode
+	}{
+		{context.Background(), "read", CodeUnauthenticated},
+		{WithCaller(context.Background(), nil), "read", CodeUnauthenticated},
+		{WithCaller(context.Background(), caller), "read", ""},
+		{WithCaller(context.Background(), caller), "write", CodePermissionDenied},
+	}
+
+	for _, test := range tests {
+		got, err := RequireScope(test.ctx, test.scope)
+		if code := CodeOf(err); code != test.want {
+			t.Errorf("RequireScope(%s) code = %q, want %q", test.scope, code, test.want)
+		}
+		if err == nil && got != caller {
+			t.Errorf("RequireScope(%s) caller = %v, want %v", test.scope, got, caller)
+		}
+	}
+}
+
+func TestCallerCarried(t *testing.T) {
+	router := NewRouter(func(err error) {})
+	Register(router, "whoAmI",
+		func(ctx context.Context, req *testTopic) (*testTopic, error) {
+			caller, err := RequireScope(ctx, "read")
+			if err != nil {
+				return nil, err
+			}
+			return &testTopic{Topic: caller.Email}, nil
+		},
+	)
+	client := newRouterClient(t, router)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err := Call[testTopic, testTopic](ctx, client, "whoAmI", &testTopic{})
+	if code := CodeOf(err); code != CodeUnauthenticated {
+		t.Errorf("code without caller = %q, want %q", code, CodeUnauthenticated)
+	}
+
+	ctx = WithCaller(ctx, &Caller{Email: "a@example.com", Scopes: []string{"read"}})
+	res, err := Call[testTopic, testTopic](ctx, client, "whoAmI", &testTopic{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "a@example.com"; res.Topic != want {
+		t.Errorf("topic = %q, want %q", res.Topic, want)
+	}
+}
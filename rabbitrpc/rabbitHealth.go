@@ -0,0 +1,120 @@
+package rabbitrpc
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// reconnect
+
+type Backoff struct {
+	Initial    time.Duration
+	Max        time.Duration
+	Multiplier float64
+	// 0 to 1, fraction of delay which is randomized
+	Jitter float64
+}
+
+var DefaultBackoff = Backoff{
+	Initial:    time.Millisecond * 500,
+	Max:        time.Second * 30,
+	Multiplier: 2,
+	Jitter:     0.2,
+}
+
+// delay before n th retry, starts with 0
+func (backoff Backoff) Delay(attempt int) time.Duration {
+	d := float64(backoff.Initial) *
+		math.Pow(backoff.Multiplier, float64(attempt))
+	if d > float64(backoff.Max) {
+		d = float64(backoff.Max)
+	}
+	if backoff.Jitter > 0 {
+		d -= d * backoff.Jitter * rand.Float64()
+	}
+	return time.Duration(d)
+}
+
+// connection state
+
+type ConnectionState int
+
+const (
+	StateDisconnected ConnectionState = iota
+	StateConnected
+)
+
+func (state ConnectionState) String() string {
+	if state == StateConnected {
+		return "connected"
+	}
+	return "disconnected"
+}
+
+type connectionRole int
+
+const (
+	rolePublisher connectionRole = iota
+	roleSubscriber
+)
+
+// client is connected when both publisher and subscriber are connected
+type connectionHealth struct {
+	mutex      sync.Mutex
+	publisher  bool
+	subscriber bool
+}
+
+func (health *connectionHealth) state() ConnectionState {
+	if health.publisher && health.subscriber {
+		return StateConnected
+	}
+	return StateDisconnected
+}
+
+// onStateChange can be nil
+func (rabbit *RabbitClient) setConnected(
+	role connectionRole,
+	connected bool,
+	onStateChange func(rabbit *RabbitClient, state ConnectionState),
+) {
+	rabbit.health.mutex.Lock()
+	before := rabbit.health.state()
+	if role == rolePublisher {
+		rabbit.health.publisher = connected
+	} else {
+		rabbit.health.subscriber = connected
+	}
+	after := rabbit.health.state()
+	rabbit.health.mutex.Unlock()
+
+	// responses for waiting requests are lost with exclusive queue
+	if role == roleSubscriber && !connected && rabbit.pending != nil {
+		rabbit.pending.FailAll(ErrorUnavailable)
+	}
+
+	if before != after {
+		rabbitLogger.Printf("%s %s", rabbit.ExchangeName, after)
+		if onStateChange != nil {
+			onStateChange(rabbit, after)
+		}
+	}
+}
+
+func (rabbit *RabbitClient) State() ConnectionState {
+	rabbit.health.mutex.Lock()
+	defer rabbit.health.mutex.Unlock()
+	return rabbit.health.state()
+}
+
+func (rabbit *RabbitClient) IsConnected() bool {
+	return rabbit.State() == StateConnected
+}
+
+func (rabbit *RabbitClient) isPublisherConnected() bool {
+	rabbit.health.mutex.Lock()
+	defer rabbit.health.mutex.Unlock()
+	return rabbit.health.publisher
+}
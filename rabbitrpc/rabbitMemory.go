@@ -0,0 +1,226 @@
+package rabbitrpc
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+const memoryQueueSize = 64
+
+// in-process transport for wiring clients and servers without RabbitMQ.
+// share one MemoryTransport between every RabbitClient which should talk.
+// like declared queues in amqp, a queue is exclusive and auto deleted
+// and messages without any bound queue are dropped
+type MemoryTransport struct {
+	mutex     sync.Mutex
+	exchanges map[string]*memoryExchange
+	queues    map[string]chan Raws
+}
+
+type memoryExchange struct {
+	kind     string
+	bindings []memoryBinding
+}
+
+type memoryBinding struct {
+	queueName  string
+	routingKey string
+}
+
+func NewMemoryTransport() *MemoryTransport {
+	return &MemoryTransport{
+		exchanges: make(map[string]*memoryExchange),
+		queues:    make(map[string]chan Raws),
+	}
+}
+
+func (transport *MemoryTransport) Publish(
+	ctx context.Context,
+	rabbit *RabbitClient,
+	messages <-chan Raws,
+) {
+	transport.declareExchange(rabbit.ExchangeName, rabbit.ExchangeKind)
+	rabbitLogger.Printf("publishing...")
+	rabbit.setConnected(rolePublisher, true, nil)
+	defer rabbit.setConnected(rolePublisher, false, nil)
+
+	for {
+		select {
+		case raws, ok := <-messages:
+			if !ok {
+				return
+			}
+			for _, queue := range transport.route(
+				rabbit.ExchangeName,
+				rabbit.PublishRoutingKey,
+			) {
+				// message already accepted is delivered even if ctx is done,
+				// as amqp publisher flushes it, unless queue is full
+				select {
+				case queue <- raws:
+					continue
+				default:
+				}
+				select {
+				case queue <- raws:
+				case <-ctx.Done():
+					return
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (transport *MemoryTransport) Subscribe(
+	ctx context.Context,
+	rabbit *RabbitClient,
+	messages chan<- Raws,
+) {
+	queue := transport.declareAndBind(
+		rabbit.ExchangeName,
+		rabbit.ExchangeKind,
+		rabbit.SubscribeQueueName,
+		rabbit.SubscribeRoutingKey,
+	)
+	defer transport.deleteQueue(rabbit.SubscribeQueueName)
+	rabbitLogger.Printf("subscribed...")
+	rabbit.setConnected(roleSubscriber, true, nil)
+	defer rabbit.setConnected(roleSubscriber, false, nil)
+
+	for {
+		select {
+		case raws := <-queue:
+			select {
+			case messages <- raws:
+			case <-ctx.Done():
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (transport *MemoryTransport) declareExchange(
+	exchangeName string,
+	exchangeKind string,
+) *memoryExchange {
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+	return transport.declareExchangeLocked(exchangeName, exchangeKind)
+}
+
+func (transport *MemoryTransport) declareExchangeLocked(
+	exchangeName string,
+	exchangeKind string,
+) *memoryExchange {
+	ex, ok := transport.exchanges[exchangeName]
+	if !ok {
+		ex = &memoryExchange{kind: exchangeKind}
+		transport.exchanges[exchangeName] = ex
+	}
+	return ex
+}
+
+func (transport *MemoryTransport) declareAndBind(
+	exchangeName string,
+	exchangeKind string,
+	queueName string,
+	routingKey string,
+) chan Raws {
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+
+	ex := transport.declareExchangeLocked(exchangeName, exchangeKind)
+	queue, ok := transport.queues[queueName]
+	if !ok {
+		queue = make(chan Raws, memoryQueueSize)
+		transport.queues[queueName] = queue
+	}
+	ex.bindings = append(ex.bindings, memoryBinding{
+		queueName:  queueName,
+		routingKey: routingKey,
+	})
+	return queue
+}
+
+func (transport *MemoryTransport) deleteQueue(queueName string) {
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+
+	delete(transport.queues, queueName)
+	for _, ex := range transport.exchanges {
+		kept := ex.bindings[:0]
+		for _, b := range ex.bindings {
+			if b.queueName != queueName {
+				kept = append(kept, b)
+			}
+		}
+		ex.bindings = kept
+	}
+}
+
+// returns queues which should receive a message with routing key
+func (transport *MemoryTransport) route(
+	exchangeName string,
+	routingKey string,
+) (queues []chan Raws) {
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+
+	ex, ok := transport.exchanges[exchangeName]
+	if !ok {
+		return
+	}
+	routed := make(map[string]bool)
+	for _, b := range ex.bindings {
+		if routed[b.queueName] ||
+			!matchRoutingKey(ex.kind, b.routingKey, routingKey) {
+			continue
+		}
+		if queue, ok := transport.queues[b.queueName]; ok {
+			routed[b.queueName] = true
+			queues = append(queues, queue)
+		}
+	}
+	return
+}
+
+func matchRoutingKey(exchangeKind, bindingKey, routingKey string) bool {
+	switch exchangeKind {
+	case ExchangeKindFanout:
+		return true
+	case ExchangeKindTopic:
+		return matchTopic(
+			strings.Split(bindingKey, "."),
+			strings.Split(routingKey, "."),
+		)
+	default:
+		return bindingKey == routingKey
+	}
+}
+
+// '*' matches exactly one word, '#' matches zero or more words
+func matchTopic(pattern, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(words); i++ {
+			if matchTopic(pattern[1:], words[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(words) > 0 && matchTopic(pattern[1:], words[1:])
+	default:
+		return len(words) > 0 &&
+			pattern[0] == words[0] &&
+			matchTopic(pattern[1:], words[1:])
+	}
+}
@@ -0,0 +1,128 @@
+package rabbitrpc
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMatchRoutingKey(t *testing.T) {
+	tests := []struct {
+		kind       string
+		bindingKey string
+		routingKey string
+		want       bool
+	}{
+		{ExchangeKindDirect, "server", "server", true},
+		{ExchangeKindDirect, "server", "client", false},
+		{ExchangeKindDirect, "*", "server", false},
+		{ExchangeKindFanout, "server", "client", true},
+		{ExchangeKindTopic, "topic.create", "topic.create", true},
+		{ExchangeKindTopic, "topic.*", "topic.create", true},
+		{ExchangeKindTopic, "topic.*", "topic", false},
+		{ExchangeKindTopic, "topic.*", "topic.create.now", false},
+		{ExchangeKindTopic, "topic.#", "topic", true},
+		{ExchangeKindTopic, "topic.#", "topic.create.now", true},
+		{ExchangeKindTopic, "#", "topic.create", true},
+		{ExchangeKindTopic, "#.now", "topic.create.now", true},
+		{ExchangeKindTopic, "*.create.#", "topic.create", true},
+		{ExchangeKindTopic, "*.create.#", "reply.read", false},
+	}
+
+	for _, test := range tests {
+		got := matchRoutingKey(test.kind, test.bindingKey, test.routingKey)
+		if got != test.want {
+			t.Errorf(
+				"matchRoutingKey(%s, %q, %q) = %v, want %v",
+				test.kind,
+				test.bindingKey,
+				test.routingKey,
+				got,
+				test.want,
+			)
+		}
+	}
+}
+
+// client and server talking through one memory transport,
+// handle is called on server side for each request
+func newMemoryPair(t *testing.T, handle func(server *RabbitClient, raws Raws),
+) (client *RabbitClient, server *RabbitClient) {
+	t.Helper()
+	transport := NewMemoryTransport()
+	server = NewRPCServerWithTransport(
+		transport,
+		"res",
+		"req",
+		"ex",
+		ExchangeKindDirect,
+		"client",
+		"server",
+		func(raws Raws) {
+			handle(server, raws)
+		},
+	)
+	client = NewRPCClientWithTransport(
+		transport,
+		"req",
+		"res",
+		"ex",
+		ExchangeKindDirect,
+		"server",
+		"client",
+	)
+	t.Cleanup(func() {
+		client.Shutdown(context.Background())
+		server.Subscriber.Done()
+		server.Publisher.Done()
+	})
+
+	deadline := time.Now().Add(time.Second)
+	for !client.IsConnected() || !server.IsConnected() {
+		if time.Now().After(deadline) {
+			t.Fatal("memory transport did not connect")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return
+}
+
+func TestMemoryTransportRequest(t *testing.T) {
+	client, _ := newMemoryPair(t, func(server *RabbitClient, raws Raws) {
+		envelop, e := FromBin(raws.Body)
+		if e != nil {
+			server.SendError(e, raws.CorrelationId)
+			return
+		}
+		var message string
+		e = envelop.Extract(&message)
+		if e != nil {
+			server.SendError(e, raws.CorrelationId)
+			return
+		}
+		reply := strings.ToUpper(message)
+		server.SendOK(&reply, "string", raws.CorrelationId)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	message := "hello"
+	raws, err := client.Request(ctx, "echo", "string", &message)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	envelop, e := FromBin(raws.Body)
+	if e != nil {
+		t.Fatal(e)
+	}
+	var reply string
+	e = envelop.Extract(&reply)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if reply != "HELLO" {
+		t.Errorf("reply = %q, want %q", reply, "HELLO")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"sync/atomic"
 	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
@@ -20,6 +21,9 @@ const (
 
 var rabbitLogger *log.Logger
 
+// makes correlation ids unique within a microsecond
+var correlationSeq uint64
+
 type Raws struct {
 	Body          []byte
 	CorrelationId string
@@ -46,15 +50,84 @@ type RabbitHandle struct {
 type RabbitClient struct {
 	Publisher  *RabbitHandle
 	Subscriber *RabbitHandle
+	Transport  Transport
+
+	health connectionHealth
 
 	ContentType         string
-	RabbitURL           string
 	PublishQueueName    string
 	SubscribeQueueName  string
 	ExchangeName        string
 	ExchangeKind        string
 	PublishRoutingKey   string
 	SubscribeRoutingKey string
+
+	// waiting requests, only used by client
+	pending *CallbackPool
+}
+
+// Transport moves Raws between exchange and RabbitClient.
+// both methods block until ctx is done
+type Transport interface {
+	// publish messages with rabbit.PublishRoutingKey to rabbit.ExchangeName
+	Publish(ctx context.Context, rabbit *RabbitClient, messages <-chan Raws)
+	// deliver messages of rabbit.SubscribeQueueName
+	// which is bound with rabbit.SubscribeRoutingKey
+	Subscribe(ctx context.Context, rabbit *RabbitClient, messages chan<- Raws)
+}
+
+// transport over RabbitMQ
+type AMQPTransport struct {
+	URL string
+	// used while (re)dialing
+	Backoff Backoff
+	// called when a client using this transport is (dis)connected, can be nil
+	OnStateChange func(rabbit *RabbitClient, state ConnectionState)
+}
+
+func NewAMQPTransport(url string) *AMQPTransport {
+	return &AMQPTransport{
+		URL:     url,
+		Backoff: DefaultBackoff,
+	}
+}
+
+func (transport *AMQPTransport) Publish(
+	ctx context.Context,
+	rabbit *RabbitClient,
+	messages <-chan Raws,
+) {
+	rabbit.publisherRoutine(
+		ctx,
+		redial(
+			ctx,
+			transport.URL,
+			rabbit.ExchangeName,
+			rabbit.ExchangeKind,
+			transport.Backoff,
+		),
+		messages,
+		transport.OnStateChange,
+	)
+}
+
+func (transport *AMQPTransport) Subscribe(
+	ctx context.Context,
+	rabbit *RabbitClient,
+	messages chan<- Raws,
+) {
+	rabbit.subscriberRoutine(
+		ctx,
+		redial(
+			ctx,
+			transport.URL,
+			rabbit.ExchangeName,
+			rabbit.ExchangeKind,
+			transport.Backoff,
+		),
+		messages,
+		transport.OnStateChange,
+	)
 }
 
 func openLogger() {
@@ -75,55 +148,38 @@ func NewRPCClient(
 	exchangeKind string,
 	publishKey string,
 	subscribeKey string,
-	callback func(raws Raws),
 ) (client *RabbitClient) {
-	client = &RabbitClient{
-		ContentType:         "application/json",
-		RabbitURL:           rabbitURL,
-		PublishQueueName:    publishQueueName,
-		SubscribeQueueName:  subscribeQueueName,
-		ExchangeName:        exchangeName,
-		ExchangeKind:        exchangeKind,
-		PublishRoutingKey:   publishKey,
-		SubscribeRoutingKey: subscribeKey,
-	}
-
-	client.Publisher = &RabbitHandle{}
-	client.Publisher.CTX, client.Publisher.Done = context.WithCancel(
-		context.Background(),
+	return NewRPCClientWithTransport(
+		NewAMQPTransport(rabbitURL),
+		publishQueueName,
+		subscribeQueueName,
+		exchangeName,
+		exchangeKind,
+		publishKey,
+		subscribeKey,
 	)
-	client.Publisher.Ch = make(chan Raws)
+}
 
-	client.Subscriber = &RabbitHandle{}
-	client.Subscriber.CTX, client.Subscriber.Done = context.WithCancel(
-		context.Background(),
+func NewRPCClientWithTransport(
+	transport Transport,
+	publishQueueName string,
+	subscribeQueueName string,
+	exchangeName string,
+	exchangeKind string,
+	publishKey string,
+	subscribeKey string,
+) (client *RabbitClient) {
+	client = newRabbitClient(
+		transport,
+		publishQueueName,
+		subscribeQueueName,
+		exchangeName,
+		exchangeKind,
+		publishKey,
+		subscribeKey,
 	)
-
-	go func() {
-		client.publisherRoutine(
-			redial(
-				client.Publisher.CTX,
-				client.RabbitURL,
-				client.ExchangeName,
-				client.ExchangeKind,
-			),
-			client.Publisher.Ch,
-		)
-	}()
-
-	go func() {
-		client.subscriberRoutine(
-			redial(
-				client.Subscriber.CTX,
-				client.RabbitURL,
-				client.ExchangeName,
-				client.ExchangeKind,
-			),
-			setCallback(callback),
-		)
-	}()
-
-	openLogger()
+	client.pending = NewCallbackPool()
+	client.start(client.onResponseReceived)
 	return
 }
 
@@ -137,9 +193,54 @@ func NewRPCServer(
 	subscribeKey string,
 	callback func(raws Raws),
 ) (server *RabbitClient) {
-	server = &RabbitClient{
+	return NewRPCServerWithTransport(
+		NewAMQPTransport(rabbitURL),
+		publishQueueName,
+		subscribeQueueName,
+		exchangeName,
+		exchangeKind,
+		publishKey,
+		subscribeKey,
+		callback,
+	)
+}
+
+func NewRPCServerWithTransport(
+	transport Transport,
+	publishQueueName string,
+	subscribeQueueName string,
+	exchangeName string,
+	exchangeKind string,
+	publishKey string,
+	subscribeKey string,
+	callback func(raws Raws),
+) (server *RabbitClient) {
+	server = newRabbitClient(
+		transport,
+		publishQueueName,
+		subscribeQueueName,
+		exchangeName,
+		exchangeKind,
+		publishKey,
+		subscribeKey,
+	)
+	server.start(callback)
+	return
+}
+
+func newRabbitClient(
+	transport Transport,
+	publishQueueName string,
+	subscribeQueueName string,
+	exchangeName string,
+	exchangeKind string,
+	publishKey string,
+	subscribeKey string,
+) (rabbit *RabbitClient) {
+	openLogger()
+	rabbit = &RabbitClient{
+		Transport:           transport,
 		ContentType:         "application/json",
-		RabbitURL:           rabbitURL,
 		PublishQueueName:    publishQueueName,
 		SubscribeQueueName:  subscribeQueueName,
 		ExchangeName:        exchangeName,
@@ -148,65 +249,58 @@ func NewRPCServer(
 		SubscribeRoutingKey: subscribeKey,
 	}
 
-	server.Publisher = &RabbitHandle{}
-	server.Publisher.CTX, server.Publisher.Done = context.WithCancel(
+	rabbit.Publisher = &RabbitHandle{}
+	rabbit.Publisher.CTX, rabbit.Publisher.Done = context.WithCancel(
 		context.Background(),
 	)
-	server.Publisher.Ch = make(chan Raws)
+	rabbit.Publisher.Ch = make(chan Raws)
 
-	server.Subscriber = &RabbitHandle{}
-	server.Subscriber.CTX, server.Subscriber.Done = context.WithCancel(
+	rabbit.Subscriber = &RabbitHandle{}
+	rabbit.Subscriber.CTX, rabbit.Subscriber.Done = context.WithCancel(
 		context.Background(),
 	)
-
-	go func() {
-		server.publisherRoutine(
-			redial(
-				server.Publisher.CTX,
-				server.RabbitURL,
-				server.ExchangeName,
-				server.ExchangeKind,
-			),
-			server.Publisher.Ch,
-		)
-	}()
-
-	go func() {
-		server.subscriberRoutine(
-			redial(
-				server.Subscriber.CTX,
-				server.RabbitURL,
-				server.ExchangeName,
-				server.ExchangeKind,
-			),
-			setCallback(callback),
-		)
-	}()
-
-	openLogger()
 	return
 }
 
+func (rabbit *RabbitClient) start(callback func(raws Raws)) {
+	go rabbit.Transport.Publish(
+		rabbit.Publisher.CTX,
+		rabbit,
+		rabbit.Publisher.Ch,
+	)
+	go rabbit.Transport.Subscribe(
+		rabbit.Subscriber.CTX,
+		rabbit,
+		setCallback(callback),
+	)
+}
+
 func (rabbit *RabbitClient) GenerateCorrelationID() string {
 	return fmt.Sprintf(
-		"%s/at%d/%s.to.%s",
+		"%s/at%d-%d/%s.to.%s",
 		rabbit.ExchangeName,
 		time.Now().UnixMicro(),
+		atomic.AddUint64(&correlationSeq, 1),
 		rabbit.SubscribeRoutingKey,
 		rabbit.PublishRoutingKey,
 	)
 }
 
+// sends a channel for each session, dials when the channel is received.
+// keeps retrying with backoff until ctx is done
 func redial(
 	ctx context.Context,
 	url string,
 	exchangeName string,
 	exchangeKind string,
+	backoff Backoff,
 ) chan chan session {
 	sessions := make(chan chan session)
 
 	go func() {
 		sess := make(chan session)
+		defer close(sessions)
+		defer close(sess)
 
 		for {
 			select {
@@ -216,41 +310,34 @@ func redial(
 				return
 			}
 
-			conn, err := amqp.Dial(url)
-			if err != nil {
-				rabbitLogger.Fatalf("cannot (re)dial: %v %q", err, url)
-			}
-
-			ch, err := conn.Channel()
-			if err != nil {
-				rabbitLogger.Fatalf("cannot create channel: %v", err)
-			}
-
-			err = ch.Qos(
-				1,
-				0,
-				false,
-			)
-			if err != nil {
-				rabbitLogger.Fatalln("failed to set QoS")
-			}
-
-			err = ch.ExchangeDeclare(
-				exchangeName,
-				exchangeKind,
-				false,
-				true,
-				false,
-				false,
-				nil,
+			var (
+				s   session
+				err error
 			)
-			if err != nil {
-				rabbitLogger.Fatalf("cannot declare exchange: %v", err)
+			for attempt := 0; ; attempt++ {
+				s, err = dial(url, exchangeName, exchangeKind)
+				if err == nil {
+					break
+				}
+				delay := backoff.Delay(attempt)
+				rabbitLogger.Printf(
+					"cannot (re)dial: %v %q, retry in %v",
+					err,
+					url,
+					delay,
+				)
+				select {
+				case <-time.After(delay):
+				case <-ctx.Done():
+					rabbitLogger.Println("shutting down session factory")
+					return
+				}
 			}
 
 			select {
-			case sess <- session{conn, ch}:
+			case sess <- s:
 			case <-ctx.Done():
+				s.close()
 				rabbitLogger.Println("shutting down new session")
 				return
 			}
@@ -259,20 +346,81 @@ func redial(
 	return sessions
 }
 
+func dial(
+	url string,
+	exchangeName string,
+	exchangeKind string,
+) (sess session, err error) {
+	conn, err := amqp.Dial(url)
+	if err != nil {
+		return
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		err = fmt.Errorf("cannot create channel: %w", err)
+		return
+	}
+
+	err = ch.Qos(
+		1,
+		0,
+		false,
+	)
+	if err != nil {
+		conn.Close()
+		err = fmt.Errorf("failed to set QoS: %w", err)
+		return
+	}
+
+	err = ch.ExchangeDeclare(
+		exchangeName,
+		exchangeKind,
+		false,
+		true,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		conn.Close()
+		err = fmt.Errorf("cannot declare exchange: %w", err)
+		return
+	}
+
+	sess = session{conn, ch}
+	return
+}
+
 // publisher
 
 func (rabbit *RabbitClient) publisherRoutine(
-	sessions chan chan session, messages <-chan Raws) {
+	ctx context.Context,
+	sessions chan chan session,
+	messages <-chan Raws,
+	onStateChange func(rabbit *RabbitClient, state ConnectionState),
+) {
+	// message failed to publish is kept here across reconnection
+	pendingCh := make(chan Raws, 1)
+	defer rabbit.setConnected(rolePublisher, false, onStateChange)
 
 	for sess := range sessions {
 		var (
 			isRunning bool
 			readingCh = messages
-			pendingCh = make(chan Raws, 1)
 			confirmCh = make(chan amqp.Confirmation, 1)
 		)
+		if len(pendingCh) > 0 {
+			readingCh = nil
+		}
+
+		pub, ok := <-sess
+		if !ok {
+			return
+		}
+		rabbit.setConnected(rolePublisher, true, onStateChange)
 
-		pub := <-sess
 		err := pub.Confirm(false)
 		if err != nil {
 			rabbitLogger.Printf("publisher confirms not supported %v", err)
@@ -287,6 +435,15 @@ func (rabbit *RabbitClient) publisherRoutine(
 			var raws Raws
 
 			select {
+			case <-ctx.Done():
+				// flush message already accepted before closing
+				select {
+				case raws = <-pendingCh:
+					rabbit.publish(pub, raws)
+				default:
+				}
+				pub.close()
+				return
 			case confirmed, ok := <-confirmCh:
 				if !ok {
 					break publishLoop
@@ -300,17 +457,7 @@ func (rabbit *RabbitClient) publisherRoutine(
 				}
 				readingCh = messages
 			case raws = <-pendingCh:
-				err := pub.Publish(
-					rabbit.ExchangeName,
-					rabbit.PublishRoutingKey,
-					false,
-					false,
-					amqp.Publishing{
-						ContentType:   rabbit.ContentType,
-						CorrelationId: raws.CorrelationId,
-						Body:          raws.Body,
-					},
-				)
+				err := rabbit.publish(pub, raws)
 				if err != nil {
 					pendingCh <- raws
 					pub.close()
@@ -324,16 +471,39 @@ func (rabbit *RabbitClient) publisherRoutine(
 				readingCh = nil
 			}
 		}
+		rabbit.setConnected(rolePublisher, false, onStateChange)
 	}
 }
 
+func (rabbit *RabbitClient) publish(pub session, raws Raws) error {
+	return pub.Publish(
+		rabbit.ExchangeName,
+		rabbit.PublishRoutingKey,
+		false,
+		false,
+		amqp.Publishing{
+			ContentType:   rabbit.ContentType,
+			CorrelationId: raws.CorrelationId,
+			Body:          raws.Body,
+		},
+	)
+}
+
 // subscriber
 
 func (rabbit *RabbitClient) subscriberRoutine(
-	sessions chan chan session, messages chan<- Raws) {
+	ctx context.Context,
+	sessions chan chan session,
+	messages chan<- Raws,
+	onStateChange func(rabbit *RabbitClient, state ConnectionState),
+) {
+	defer rabbit.setConnected(roleSubscriber, false, onStateChange)
 
 	for sess := range sessions {
-		sub := <-sess
+		sub, ok := <-sess
+		if !ok {
+			return
+		}
 
 		_, err := sub.QueueDeclare(
 			rabbit.SubscribeQueueName,
@@ -349,7 +519,8 @@ func (rabbit *RabbitClient) subscriberRoutine(
 				rabbit.SubscribeQueueName,
 				err,
 			)
-			return
+			sub.close()
+			continue
 		}
 
 		err = sub.QueueBind(
@@ -365,7 +536,8 @@ func (rabbit *RabbitClient) subscriberRoutine(
 				rabbit.ExchangeName,
 				err,
 			)
-			return
+			sub.close()
+			continue
 		}
 
 		deliveries, err := sub.Consume(
@@ -383,18 +555,32 @@ func (rabbit *RabbitClient) subscriberRoutine(
 				rabbit.SubscribeQueueName,
 				err,
 			)
-			return
+			sub.close()
+			continue
 		}
 
 		rabbitLogger.Printf("subscribed...")
+		rabbit.setConnected(roleSubscriber, true, onStateChange)
 
-		for deli := range deliveries {
-			messages <- Raws{
-				Body:          deli.Body,
-				CorrelationId: deli.CorrelationId,
+	consumeLoop:
+		for {
+			select {
+			case <-ctx.Done():
+				sub.close()
+				return
+			case deli, ok := <-deliveries:
+				if !ok {
+					break consumeLoop
+				}
+				messages <- Raws{
+					Body:          deli.Body,
+					CorrelationId: deli.CorrelationId,
+				}
+				sub.Ack(deli.DeliveryTag, false)
 			}
-			sub.Ack(deli.DeliveryTag, false)
 		}
+		rabbit.setConnected(roleSubscriber, false, onStateChange)
+		sub.close()
 	}
 }
 
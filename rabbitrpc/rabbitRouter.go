@@ -0,0 +1,201 @@
+package rabbitrpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sync"
+)
+
+// lower camel case like "createTopic"
+var functionNamePattern = regexp.MustCompile(`^[a-z][a-zA-Z0-9]*$`)
+
+type handlerFunc func(ctx context.Context, envelop *Envelope) (interface{}, error)
+
+type route struct {
+	dataTypeName string
+	handler      handlerFunc
+}
+
+// Router dispatches requests to functions registered by name.
+// register every function before server starts, then call Check
+type Router struct {
+	onError  func(err error)
+	routes   map[string]route
+	err      error
+	inFlight sync.WaitGroup
+	// set by Shutdown, requests are dropped after it
+	mutex  sync.Mutex
+	closed bool
+}
+
+// onError receives errors hidden from caller
+func NewRouter(onError func(err error)) *Router {
+	return &Router{
+		onError: onError,
+		routes:  make(map[string]route),
+	}
+}
+
+// Register adds fn as functionToCall.
+// request body is decoded into Req and returned Res is sent back as OK,
+// returned error is sent back as is if it is *RabbitRPCError,
+// otherwise logged and hidden as internal server error
+func Register[Req, Res any](
+	router *Router,
+	functionToCall string,
+	fn func(ctx context.Context, req *Req) (*Res, error),
+) {
+	if !functionNamePattern.MatchString(functionToCall) {
+		router.fail(fmt.Errorf("malformed function name %q", functionToCall))
+		return
+	}
+	if _, ok := router.routes[functionToCall]; ok {
+		router.fail(fmt.Errorf("duplicate function name %q", functionToCall))
+		return
+	}
+
+	router.routes[functionToCall] = route{
+		dataTypeName: TypeNameOf(new(Req)),
+		handler: func(ctx context.Context, envelop *Envelope) (interface{}, error) {
+			req := new(Req)
+			e := envelop.Extract(req)
+			if e != nil {
+				return nil, e
+			}
+			res, err := fn(ctx, req)
+			if err != nil {
+				return nil, err
+			}
+			return res, nil
+		},
+	}
+}
+
+func (router *Router) fail(err error) {
+	if router.err == nil {
+		router.err = err
+	}
+}
+
+// returns first error found while registering
+func (router *Router) Check() error {
+	if router.err == nil && len(router.routes) == 0 {
+		return errors.New("no function is registered")
+	}
+	return router.err
+}
+
+func (router *Router) Dispatch(server *RabbitClient, raws Raws) {
+	// subscriber may deliver a request after Shutdown started waiting
+	router.mutex.Lock()
+	if router.closed {
+		router.mutex.Unlock()
+		rabbitLogger.Printf(
+			"dropped request after shutdown: %s",
+			raws.CorrelationId,
+		)
+		return
+	}
+	router.inFlight.Add(1)
+	router.mutex.Unlock()
+
+	go func() {
+		defer router.inFlight.Done()
+		envelop, e := FromBin(raws.Body)
+		if e != nil {
+			server.SendError(e, raws.CorrelationId)
+			return
+		}
+
+		r, ok := router.routes[envelop.FunctionToCall]
+		if !ok {
+			server.SendError(ErrorFunctionNotFound, raws.CorrelationId)
+			return
+		}
+		if envelop.DataTypeName != r.dataTypeName {
+			server.SendError(ErrorTypeNotFound, raws.CorrelationId)
+			return
+		}
+
+		// publisher lives until running functions are done
+		ctx := server.Publisher.CTX
+		if envelop.Caller != nil {
+			ctx = WithCaller(ctx, envelop.Caller)
+		}
+		if envelop.Client != nil {
+			ctx = WithClient(ctx, envelop.Client)
+		}
+		res, err := r.handler(ctx, envelop)
+		if err != nil {
+			router.handleError(server, envelop.FunctionToCall, err, raws.CorrelationId)
+			return
+		}
+		server.SendOK(res, TypeNameOf(res), raws.CorrelationId)
+	}()
+}
+
+// Shutdown stops receiving requests and waits for running functions,
+// then stops server. server is stopped even if ctx is done first
+func (router *Router) Shutdown(ctx context.Context, server *RabbitClient,
+) (err error) {
+	server.Subscriber.Done()
+	// no function starts after this, so inFlight is not added while waiting
+	router.mutex.Lock()
+	router.closed = true
+	router.mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		router.inFlight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = fmt.Errorf("functions still running: %w", ctx.Err())
+	}
+
+	server.Publisher.Done()
+	return
+}
+
+func (router *Router) handleError(
+	server *RabbitClient,
+	functionToCall string,
+	err error,
+	corrId string,
+) {
+	var rerr *RabbitRPCError
+	if errors.As(err, &rerr) {
+		server.SendError(rerr, corrId)
+		return
+	}
+
+	router.onError(fmt.Errorf("%s: %w", functionToCall, err))
+	server.SendError(
+		NewError(CodeInternal, "internal server error"),
+		corrId,
+	)
+}
+
+// name used as DataTypeName, "Topic" for *Topic, "TopicSlice" for *[]Topic
+func TypeNameOf(dataPtr interface{}) string {
+	return typeName(reflect.TypeOf(dataPtr))
+}
+
+func typeName(t reflect.Type) string {
+	if t == nil {
+		return ""
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return typeName(t.Elem())
+	case reflect.Slice:
+		return typeName(t.Elem()) + "Slice"
+	default:
+		return t.Name()
+	}
+}
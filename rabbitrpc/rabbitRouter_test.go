@@ -0,0 +1,229 @@
+package rabbitrpc
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testTopic struct {
+	Topic string `json:"topic"`
+}
+
+func upperTopic(ctx context.Context, req *testTopic) (*testTopic, error) {
+	return &testTopic{Topic: strings.ToUpper(req.Topic)}, nil
+}
+
+func TestRouterCheck(t *testing.T) {
+	router := NewRouter(func(err error) {})
+	if err := router.Check(); err == nil {
+		t.Error("empty router passed Check")
+	}
+
+	Register(router, "upperTopic", upperTopic)
+	if err := router.Check(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"UpperTopic", "upper-topic", "", "upperTopic"} {
+		router := NewRouter(func(err error) {})
+		Register(router, "upperTopic", upperTopic)
+		Register(router, name, upperTopic)
+		if err := router.Check(); err == nil {
+			t.Errorf("registering %q passed Check", name)
+		}
+	}
+}
+
+func TestTypeNameOf(t *testing.T) {
+	tests := []struct {
+		dataPtr interface{}
+		want    string
+	}{
+		{&testTopic{}, "testTopic"},
+		{&[]testTopic{}, "testTopicSlice"},
+		{new(string), "string"},
+		{nil, ""},
+	}
+
+	for _, test := range tests {
+		if got := TypeNameOf(test.dataPtr); got != test.want {
+			t.Errorf("TypeNameOf(%T) = %q, want %q", test.dataPtr, got, test.want)
+		}
+	}
+}
+
+// client talking to router through memory transport
+func newRouterClient(t *testing.T, router *Router) *RabbitClient {
+	t.Helper()
+	if err := router.Check(); err != nil {
+		t.Fatal(err)
+	}
+	client, _ := newMemoryPair(t, router.Dispatch)
+	return client
+}
+
+// sends dataPtr as functionToCall, returns response envelope
+func request(
+	t *testing.T,
+	client *RabbitClient,
+	functionToCall string,
+	dataTypeName string,
+	dataPtr interface{},
+) *Envelope {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	raws, err := client.Request(ctx, functionToCall, dataTypeName, dataPtr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelop, e := FromBin(raws.Body)
+	if e != nil {
+		t.Fatal(e)
+	}
+	return envelop
+}
+
+func TestRouterDispatch(t *testing.T) {
+	router := NewRouter(func(err error) {})
+	Register(router, "upperTopic", upperTopic)
+	client := newRouterClient(t, router)
+
+	envelop := request(t, client, "upperTopic", "testTopic", &testTopic{Topic: "go"})
+	if envelop.Status != StatusOK {
+		t.Fatalf("status = %v, want OK", envelop.Status)
+	}
+	if envelop.DataTypeName != "testTopic" {
+		t.Errorf("type name = %q, want %q", envelop.DataTypeName, "testTopic")
+	}
+	res := &testTopic{}
+	if e := envelop.Extract(res); e != nil {
+		t.Fatal(e)
+	}
+	if res.Topic != "GO" {
+		t.Errorf("topic = %q, want %q", res.Topic, "GO")
+	}
+}
+
+func TestRouterDispatchUnknown(t *testing.T) {
+	router := NewRouter(func(err error) {})
+	Register(router, "upperTopic", upperTopic)
+	client := newRouterClient(t, router)
+
+	tests := []struct {
+		functionToCall string
+		dataTypeName   string
+		want           *RabbitRPCError
+	}{
+		{"lowerTopic", "testTopic", ErrorFunctionNotFound},
+		{"upperTopic", "testReply", ErrorTypeNotFound},
+	}
+
+	for _, test := range tests {
+		envelop := request(
+			t,
+			client,
+			test.functionToCall,
+			test.dataTypeName,
+			&testTopic{Topic: "go"},
+		)
+		if envelop.Status != StatusError {
+			t.Errorf("%s: status = %v, want error", test.functionToCall, envelop.Status)
+			continue
+		}
+		rerr := &RabbitRPCError{}
+		if e := envelop.Extract(rerr); e != nil {
+			t.Fatal(e)
+		}
+		if rerr.Error() != test.want.Error() {
+			t.Errorf("%s: error = %q, want %q", test.functionToCall, rerr, test.want)
+		}
+	}
+}
+
+func TestRouterHidesInternalError(t *testing.T) {
+	hidden := make(chan error, 1)
+	router := NewRouter(func(err error) {
+		hidden <- err
+	})
+	Register(router, "failTopic",
+		func(ctx context.Context, req *testTopic) (*testTopic, error) {
+			return nil, errors.New("database is down")
+		},
+	)
+	client := newRouterClient(t, router)
+
+	envelop := request(t, client, "failTopic", "testTopic", &testTopic{})
+	rerr := &RabbitRPCError{}
+	if e := envelop.Extract(rerr); e != nil {
+		t.Fatal(e)
+	}
+	if strings.Contains(rerr.Error(), "database") {
+		t.Errorf("internal error leaked to caller: %q", rerr)
+	}
+
+	select {
+	case err := <-hidden:
+		if !strings.Contains(err.Error(), "failTopic: database is down") {
+			t.Errorf("onError got %q", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("onError was not called")
+	}
+}
+
+func TestRouterShutdown(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	router := NewRouter(func(err error) {})
+	Register(router, "slowTopic",
+		func(ctx context.Context, req *testTopic) (*testTopic, error) {
+			close(started)
+			<-release
+			return req, nil
+		},
+	)
+	if err := router.Check(); err != nil {
+		t.Fatal(err)
+	}
+	client, server := newMemoryPair(t, router.Dispatch)
+
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_, err := Call[testTopic, testTopic](ctx, client, "slowTopic", &testTopic{})
+		done <- err
+	}()
+	<-started
+
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		shutdown <- router.Shutdown(ctx, server)
+	}()
+	for {
+		router.mutex.Lock()
+		closed := router.closed
+		router.mutex.Unlock()
+		if closed {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// running function is waited for and its response is sent
+	close(release)
+	if err := <-shutdown; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("call running at shutdown: %v", err)
+	}
+
+	// requests delivered after shutdown are dropped
+	router.Dispatch(server, Raws{CorrelationId: "late"})
+}
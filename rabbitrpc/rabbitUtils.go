@@ -2,8 +2,14 @@ package rabbitrpc
 
 import (
 	"encoding/json"
+	"errors"
+	"time"
 )
 
+// longest wait of a response for publisher,
+// publisher doesn't read while it waits for a confirm or reconnects
+const responseSendTimeout = time.Second * 5
+
 // req res classification
 
 type MethodCode int
@@ -30,6 +36,13 @@ type Envelope struct {
 	FunctionToCall string `json:"function_to_call"`
 	DataTypeName   string `json:"type_name"`
 	Body           []byte `json:"body"`
+
+	// set when status is error
+	Code ErrorCode `json:"code,omitempty"`
+
+	// set by client when request is made for a logged in user
+	Caller *Caller `json:"caller,omitempty"`
+	Client *Client `json:"client,omitempty"`
 }
 
 func MakeBin(
@@ -38,26 +51,29 @@ func MakeBin(
 	functionToCall string,
 	dataTypeName string,
 	dataPtr interface{},
+) (binEnvelope []byte, errorJSONMarshaling *RabbitRPCError) {
+	return makeBin(
+		Envelope{
+			Method:         method,
+			Status:         status,
+			FunctionToCall: functionToCall,
+			DataTypeName:   dataTypeName,
+		},
+		dataPtr,
+	)
+}
+
+func makeBin(envelop Envelope, dataPtr interface{},
 ) (binEnvelope []byte, errorJSONMarshaling *RabbitRPCError) {
 	binData, err := json.Marshal(dataPtr)
 	if err != nil {
-		errorJSONMarshaling = &RabbitRPCError{
-			What: err.Error(),
-		}
+		errorJSONMarshaling = NewError(CodeInternal, err.Error())
 		return
 	}
-	envelop := Envelope{
-		Method:         method,
-		Status:         status,
-		FunctionToCall: functionToCall,
-		DataTypeName:   dataTypeName,
-		Body:           binData,
-	}
+	envelop.Body = binData
 	binEnvelope, err = json.Marshal(envelop)
 	if err != nil {
-		errorJSONMarshaling = &RabbitRPCError{
-			What: err.Error(),
-		}
+		errorJSONMarshaling = NewError(CodeInternal, err.Error())
 	}
 	return
 }
@@ -67,9 +83,7 @@ func FromBin(bin []byte,
 	envelop = &Envelope{}
 	err := json.Unmarshal(bin, envelop)
 	if err != nil {
-		errorJSONUnmarshaling = &RabbitRPCError{
-			What: err.Error(),
-		}
+		errorJSONUnmarshaling = NewError(CodeInvalidArgument, err.Error())
 	}
 	return
 }
@@ -78,37 +92,158 @@ func (envelop *Envelope) Extract(dataPtr interface{},
 ) (errorJSONUnmarshaling *RabbitRPCError) {
 	err := json.Unmarshal(envelop.Body, dataPtr)
 	if err != nil {
-		errorJSONUnmarshaling = &RabbitRPCError{
-			What: err.Error(),
-		}
+		errorJSONUnmarshaling = NewError(CodeInvalidArgument, err.Error())
 	}
 	return
 }
 
-// callback map for convenience of correlation id check
+// response
+
+func (rabbit *RabbitClient) SendError(e *RabbitRPCError, corrId string) {
+	bin, err := makeBin(
+		Envelope{
+			Status:       StatusError,
+			DataTypeName: ErrorTypeName,
+			Code:         e.Code,
+		},
+		e,
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	rabbit.sendResponse(Raws{
+		Body:          bin,
+		CorrelationId: corrId,
+	})
+}
+
+func (rabbit *RabbitClient) SendOK(
+	dataPtr interface{},
+	dataName string,
+	corrId string,
+) {
+	bin, err := MakeBin(
+		0,
+		StatusOK,
+		"",
+		dataName,
+		dataPtr,
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	rabbit.sendResponse(Raws{
+		Body:          bin,
+		CorrelationId: corrId,
+	})
+}
 
-type CallbackPool map[string]func(raws Raws)
+// response is dropped instead of blocking the function which made it,
+// while publisher is disconnected or when it doesn't take it in time.
+// subscriber is not checked, it is stopped first on shutdown.
+// caller of the request gets timeout
+func (rabbit *RabbitClient) sendResponse(raws Raws) {
+	if !rabbit.isPublisherConnected() {
+		rabbitLogger.Printf(
+			"dropped response while disconnected: %s",
+			raws.CorrelationId,
+		)
+		return
+	}
+
+	timer := time.NewTimer(responseSendTimeout)
+	defer timer.Stop()
+	select {
+	case rabbit.Publisher.Ch <- raws:
+	case <-rabbit.Publisher.CTX.Done():
+		rabbitLogger.Printf(
+			"dropped response after shutdown: %s",
+			raws.CorrelationId,
+		)
+	case <-timer.C:
+		rabbitLogger.Printf(
+			"dropped response not published in time: %s",
+			raws.CorrelationId,
+		)
+	}
+}
 
 // error definitions
 
+type ErrorCode string
+
+const (
+	CodeNotFound         ErrorCode = "not_found"
+	CodeInvalidArgument  ErrorCode = "invalid_argument"
+	CodeUnauthenticated  ErrorCode = "unauthenticated"
+	CodeLocked           ErrorCode = "locked"
+	CodeConflict         ErrorCode = "conflict"
+	CodePermissionDenied ErrorCode = "permission_denied"
+	CodeRateLimited      ErrorCode = "rate_limited"
+	CodeInternal         ErrorCode = "internal"
+	CodeUnavailable      ErrorCode = "unavailable"
+	CodeDeadlineExceeded ErrorCode = "deadline_exceeded"
+	CodeCanceled         ErrorCode = "canceled"
+)
+
 type RabbitRPCError struct {
-	What string `json:"what"`
+	Code ErrorCode `json:"code"`
+	What string    `json:"what"`
 }
 
 const ErrorTypeName = "RabbitRPCError"
 
+func NewError(code ErrorCode, what string) *RabbitRPCError {
+	return &RabbitRPCError{
+		Code: code,
+		What: what,
+	}
+}
+
 func (err *RabbitRPCError) Error() string {
 	return err.What
 }
 
+// returns CodeInternal for errors which are not *RabbitRPCError
+func CodeOf(err error) ErrorCode {
+	if err == nil {
+		return ""
+	}
+	var rerr *RabbitRPCError
+	if errors.As(err, &rerr) && len(rerr.Code) > 0 {
+		return rerr.Code
+	}
+	return CodeInternal
+}
+
 var ErrorTypeNotFound *RabbitRPCError = &RabbitRPCError{
+	Code: CodeInvalidArgument,
 	What: "type name is unknown",
 }
 
 var ErrorMethodCodeInvalid *RabbitRPCError = &RabbitRPCError{
+	Code: CodeInvalidArgument,
 	What: "method code is invalid",
 }
 
 var ErrorFunctionNotFound *RabbitRPCError = &RabbitRPCError{
+	Code: CodeInvalidArgument,
 	What: "function name is invalid",
 }
+
+var ErrorUnavailable *RabbitRPCError = &RabbitRPCError{
+	Code: CodeUnavailable,
+	What: "rabbitmq is not connected",
+}
+
+var ErrorTimeout *RabbitRPCError = &RabbitRPCError{
+	Code: CodeDeadlineExceeded,
+	What: "request timed out",
+}
+
+var ErrorCanceled *RabbitRPCError = &RabbitRPCError{
+	Code: CodeCanceled,
+	What: "request canceled",
+}
@@ -0,0 +1,82 @@
+package rabbitrpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestCodeOf(t *testing.T) {
+	tests := []struct {
+		err  error
+		want ErrorCode
+	}{
+		{nil, ""},
+		{NewError(CodeNotFound, "no such topic"), CodeNotFound},
+		{fmt.Errorf("wrapped: %w", NewError(CodeLocked, "user locked")), CodeLocked},
+		{&RabbitRPCError{What: "no code"}, CodeInternal},
+		{errors.New("plain"), CodeInternal},
+	}
+
+	for _, test := range tests {
+		if got := CodeOf(test.err); got != test.want {
+			t.Errorf("CodeOf(%v) = %q, want %q", test.err, got, test.want)
+		}
+	}
+}
+
+func TestCallErrorCode(t *testing.T) {
+	router := NewRouter(func(err error) {})
+	Register(router, "readTopic",
+		func(ctx context.Context, req *testTopic) (*testTopic, error) {
+			return nil, NewError(CodeNotFound, "no such topic")
+		},
+	)
+	client := newRouterClient(t, router)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err := Call[testTopic, testTopic](ctx, client, "readTopic", &testTopic{})
+
+	var rerr *RabbitRPCError
+	if !errors.As(err, &rerr) {
+		t.Fatalf("err = %v, want *RabbitRPCError", err)
+	}
+	if rerr.Code != CodeNotFound || rerr.What != "no such topic" {
+		t.Errorf("err = %+v, want not found", rerr)
+	}
+}
+
+func TestSendResponseDisconnected(t *testing.T) {
+	server := NewRPCServerWithTransport(
+		NewMemoryTransport(),
+		"res",
+		"req",
+		"ex",
+		ExchangeKindDirect,
+		"client",
+		"server",
+		func(raws Raws) {},
+	)
+	server.Subscriber.Done()
+	server.Publisher.Done()
+	deadline := time.Now().Add(time.Second)
+	for server.isPublisherConnected() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	// nobody reads Publisher.Ch, responses must not block
+	done := make(chan struct{})
+	go func() {
+		server.SendOK(&testTopic{}, "testTopic", "corr")
+		server.SendError(ErrorFunctionNotFound, "corr")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("response blocked while disconnected")
+	}
+}
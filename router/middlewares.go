@@ -7,6 +7,7 @@ import (
 	"learning-web-chatboard4/rabbitrpc"
 	"learning-web-chatboard4/session"
 	"log"
+	"net/http"
 
 	"github.com/gin-gonic/gin"
 )
@@ -15,6 +16,7 @@ const (
 	loggedInLabel   = "logged-in"
 	sessionPtrLabel = "session-ptr"
 	stateLabel      = "state"
+	callerLabel     = "caller"
 )
 
 func setCommonHeadersMiddleware(ctx *gin.Context) {
@@ -24,36 +26,44 @@ func setCommonHeadersMiddleware(ctx *gin.Context) {
 	ctx.Next()
 }
 
+// pages don't work without session,
+// request ends with error page when sessions service fails
 func sessionCheckMiddleware(ctx *gin.Context) {
 	err := checkSessionInternal(ctx)
 	if err != nil {
-		if gin.IsDebugging() {
-			log.Fatalln("!!MIDDLEWARE ERROR!!", err.Error())
-		} else {
-			log.Printf("!!MIDDLEWARE ERROR!! %s\n", err.Error())
-		}
+		handleErrorInternal(err, ctx, true)
+		ctx.Abort()
+		return
 	}
 	ctx.Next()
 }
 
 func checkSessionInternal(ctx *gin.Context) (err error) {
-	sess := &models.Session{}
+	var sess models.Session
 	uuid, err := session.PickupSessionCookie(ctx)
+
+	reqCtx, cancel := requestContext(ctx)
+	defer cancel()
+
 	// cookie is valid
 	if err == nil {
-		exists := false
-		exists, err = session.ConfirmExistsFromRedis(uuid)
-		if err != nil {
+		sess, err = rabbitrpc.Call[models.Session, models.Session](
+			reqCtx,
+			sessionsClient,
+			"readSession",
+			&models.Session{UuId: uuid},
+		)
+		if rabbitrpc.CodeOf(err) == rabbitrpc.CodeNotFound {
+			err = errors.New("cookie looks valid, but session not stored")
+		} else if err != nil {
 			return
 		}
-		if exists {
-			// get session from redis
-			err = session.GetFromRedis(uuid, sess)
+		// ttl of session is restarted by reading, so is exp of cookie
+		if err == nil {
+			err = session.StoreSessionCookie(ctx, sess.UuId)
 			if err != nil {
 				return
 			}
-		} else {
-			err = errors.New("cookie looks valid, but redis not stored")
 		}
 	}
 	// no cookie or cookie is invalid or expired
@@ -65,8 +75,12 @@ func checkSessionInternal(ctx *gin.Context) (err error) {
 			)
 		}
 		// create new session
-		sess = session.NewSession()
-		err = session.SetToRedisWithExpiration(sess)
+		sess, err = rabbitrpc.Call[models.Session, models.Session](
+			reqCtx,
+			sessionsClient,
+			"createSession",
+			&models.Session{},
+		)
 		if err != nil {
 			return
 		}
@@ -76,19 +90,16 @@ func checkSessionInternal(ctx *gin.Context) (err error) {
 		}
 	}
 
-	ctx.Set(sessionPtrLabel, sess)
+	ctx.Set(sessionPtrLabel, &sess)
 	err = nil
 	return
 }
 
+// user is seen as logged out when login can't be checked
 func loggedInCheckMiddleware(ctx *gin.Context) {
 	loggedIn, err := checkLoginInternal(ctx)
 	if err != nil {
-		if gin.IsDebugging() {
-			log.Fatalln("!!MIDDLEWARE ERROR!!", err.Error())
-		} else {
-			log.Printf("!!MIDDLEWARE ERROR!! %s\n", err.Error())
-		}
+		handleErrorInternal(err, ctx, false)
 	}
 	ctx.Set(loggedInLabel, loggedIn)
 	ctx.Next()
@@ -104,42 +115,115 @@ func checkLoginInternal(ctx *gin.Context) (loggedIn bool, err error) {
 		return
 	}
 
-	token := &common.Token{
-		UserEmail: sess.UserEmail,
-		Raw:       sess.Token,
+	caller, err := verifyTokenInternal(ctx, sess)
+	if rabbitrpc.CodeOf(err) == rabbitrpc.CodeUnauthenticated &&
+		len(sess.RefreshToken) > 0 {
+		// access token is short lived, try to renew it
+		err = refreshTokenInternal(ctx, sess)
+		if err == nil {
+			caller, err = verifyTokenInternal(ctx, sess)
+		}
+	}
+	if err != nil {
+		// failing verification just means logged out,
+		// other errors are logged but not break the page
+		if rabbitrpc.CodeOf(err) != rabbitrpc.CodeUnauthenticated {
+			handleErrorInternal(err, ctx, false)
+		}
+		loggedIn = false
+		err = nil
+		return
 	}
-	err = sendRequestAndWait(
+
+	// token has no user id
+	caller.UserId = sess.UserId
+	ctx.Set(callerLabel, &caller)
+	loggedIn = true
+	return
+}
+
+func verifyTokenInternal(ctx *gin.Context, sess *models.Session,
+) (caller rabbitrpc.Caller, err error) {
+	reqCtx, cancel := requestContext(ctx)
+	defer cancel()
+
+	caller, err = rabbitrpc.Call[common.Token, rabbitrpc.Caller](
+		reqCtx,
 		usersClient,
 		"verifyToken",
-		"Token",
-		token,
-		func(raws rabbitrpc.Raws) (e error) {
-			e = extract(&raws, &common.SimpleMessage{})
-			if e != nil {
-				handleErrorInternal(e.Error(), ctx, false)
-			}
-			return
+		&common.Token{
+			UserEmail: sess.UserEmail,
+			Raw:       sess.Token,
+		},
+	)
+	return
+}
+
+// new tokens are stored into sess and sessions service
+func refreshTokenInternal(ctx *gin.Context, sess *models.Session) (err error) {
+	reqCtx, cancel := requestContext(ctx)
+	defer cancel()
+
+	refreshed, err := rabbitrpc.Call[common.Token, models.User](
+		reqCtx,
+		usersClient,
+		"refreshToken",
+		&common.Token{
+			UserEmail: sess.UserEmail,
+			Refresh:   sess.RefreshToken,
 		},
 	)
 	if err != nil {
-		loggedIn = false
-		// bad design
-		// can't sort unexpected error from failing verifications
-		err = nil
 		return
 	}
-	loggedIn = true
+	if refreshed.Email != sess.UserEmail {
+		err = rabbitrpc.NewError(
+			rabbitrpc.CodeUnauthenticated,
+			"refresh token of another user",
+		)
+		return
+	}
+
+	sess.Token = refreshed.Token
+	sess.RefreshToken = refreshed.RefreshToken
+	updated, err := rabbitrpc.Call[models.Session, models.Session](
+		reqCtx,
+		sessionsClient,
+		"updateSession",
+		sess,
+	)
+	if err != nil {
+		return
+	}
+	*sess = updated
 	return
 }
 
+// put after loggedInCheckMiddleware.
+// logged out user is sent to login page, user without scope gets 403
+func requireScope(scope string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if !confirmLoggedIn(ctx) {
+			ctx.Redirect(http.StatusFound, "/user/login")
+			ctx.Abort()
+			return
+		}
+		if !confirmScope(ctx, scope) {
+			errorPage(ctx, http.StatusForbidden, "permission denied")
+			ctx.Abort()
+			return
+		}
+		ctx.Next()
+	}
+}
+
+// forms can't be posted without state, so does the request end
 func generateSessionStateMiddleware(ctx *gin.Context) {
 	state, err := generateSessionStateInternal(ctx)
 	if err != nil {
-		if gin.IsDebugging() {
-			log.Fatalln("!!MIDDLEWARE NOTWORKING!!", err.Error())
-		} else {
-			log.Printf("!!MIDDLEWARE NOTWORKING!! %s\n", err.Error())
-		}
+		handleErrorInternal(err, ctx, true)
+		ctx.Abort()
+		return
 	}
 
 	ctx.Set(stateLabel, state)
@@ -152,14 +236,18 @@ func generateSessionStateInternal(ctx *gin.Context) (stateAndMACEncoded string,
 		return
 	}
 
-	sess.State, stateAndMACEncoded, err = session.GenerateState()
-	if err != nil {
-		return
-	}
-	err = session.SetToRedis(sess)
+	reqCtx, cancel := requestContext(ctx)
+	defer cancel()
+
+	msg, err := rabbitrpc.Call[models.Session, common.SimpleMessage](
+		reqCtx,
+		sessionsClient,
+		"generateState",
+		&models.Session{UuId: sess.UuId},
+	)
 	if err != nil {
 		return
 	}
-	ctx.Set(sessionPtrLabel, sess)
+	stateAndMACEncoded = msg.Message
 	return
 }
@@ -3,6 +3,7 @@ package main
 import (
 	"errors"
 	"learning-web-chatboard4/common/models"
+	"learning-web-chatboard4/rabbitrpc"
 	"log"
 
 	"github.com/gin-gonic/gin"
@@ -24,6 +25,35 @@ func confirmLoggedIn(ctx *gin.Context) (isLoggedIn bool) {
 	return
 }
 
+// logged in user has verified email address
+func confirmVerified(ctx *gin.Context) bool {
+	sess, err := getSessionPtrFromCTX(ctx)
+	return err == nil && sess.UserVerified
+}
+
+// nil when logged out
+func getCallerFromCTX(ctx *gin.Context) *rabbitrpc.Caller {
+	val, ok := ctx.Get(callerLabel)
+	if !ok {
+		return nil
+	}
+	caller, ok := val.(*rabbitrpc.Caller)
+	if !ok {
+		if gin.IsDebugging() {
+			log.Fatalln("!!MIDDLEWARE BROKEN!! caller is not *Caller")
+		} else {
+			log.Println("!!MIDDLEWARE BROKEN!! caller is not *Caller")
+		}
+	}
+	return caller
+}
+
+// logged in user has scope in the token
+func confirmScope(ctx *gin.Context, scope string) bool {
+	caller := getCallerFromCTX(ctx)
+	return caller != nil && caller.HasScope(scope)
+}
+
 func getSessionPtrFromCTX(ctx *gin.Context) (ptr *models.Session, err error) {
 	val, ok := ctx.Get(sessionPtrLabel)
 	if !ok {
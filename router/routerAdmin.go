@@ -0,0 +1,303 @@
+package main
+
+import (
+	"learning-web-chatboard4/common"
+	"learning-web-chatboard4/common/models"
+	"learning-web-chatboard4/rabbitrpc"
+	"net/http"
+	"net/url"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// admin console. scopes are checked by requireScope in routes,
+// and again by services
+
+const (
+	usersPerAdminPage  = 50
+	loginsPerAdminPage = 100
+	reportsPerQueue    = 50
+	maxRoleLen         = 32
+)
+
+var roles = []string{
+	models.RoleMember,
+	models.RoleModerator,
+	models.RoleAdmin,
+}
+
+func adminUsersGet(ctx *gin.Context) {
+	query := ctx.Query("q")
+	page, err := adminUsersGetInternal(ctx, query)
+	if err != nil {
+		handleErrorInternal(err, ctx, true)
+		return
+	}
+
+	navbar, _ := getHTMLElemntInternal(true)
+	state := getStateFromCTX(ctx)
+	ctx.HTML(
+		http.StatusOK,
+		"admin.html",
+		gin.H{
+			"navbar": navbar,
+			"state":  state,
+			"query":  query,
+			"users":  page.Users,
+			"roles":  roles,
+		},
+	)
+}
+
+func adminUsersGetInternal(ctx *gin.Context, query string,
+) (page models.UserPage, err error) {
+	if utf8.RuneCountInString(query) > maxEmailLen {
+		err = errorInvalidInput
+		return
+	}
+
+	reqCtx, cancel := requestContext(ctx)
+	defer cancel()
+
+	page, err = rabbitrpc.Call[models.UserSearch, models.UserPage](
+		reqCtx,
+		usersClient,
+		"searchUsers",
+		&models.UserSearch{
+			Query: query,
+			Limit: usersPerAdminPage,
+		},
+	)
+	return
+}
+
+// function is one of lockUser, unlockUser, setRole and forceLogout
+func adminUserPost(function string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		email, err := adminUserPostInternal(ctx, function)
+		if err != nil {
+			handleErrorInternal(err, ctx, true)
+			return
+		}
+		ctx.Redirect(
+			http.StatusFound,
+			"/admin/users?q="+url.QueryEscape(email),
+		)
+	}
+}
+
+func adminUserPostInternal(ctx *gin.Context, function string,
+) (email string, err error) {
+	_, err = stateCheckProcess(ctx)
+	if err != nil {
+		return
+	}
+
+	email = ctx.PostForm("email")
+	if utf8.RuneCountInString(email) > maxEmailLen {
+		err = errorInvalidInput
+		return
+	}
+	err = validate.Var(email, "email")
+	if err != nil {
+		err = errorInvalidInput
+		return
+	}
+	// only for setRole
+	role := ctx.PostForm("role")
+	if utf8.RuneCountInString(role) > maxRoleLen {
+		err = errorInvalidInput
+		return
+	}
+
+	reqCtx, cancel := requestContext(ctx)
+	defer cancel()
+
+	_, err = rabbitrpc.Call[models.User, models.User](
+		reqCtx,
+		usersClient,
+		function,
+		&models.User{
+			Email: email,
+			Role:  role,
+		},
+	)
+	return
+}
+
+// every attempt when email is empty
+func adminLoginsGet(ctx *gin.Context) {
+	email := ctx.Query("email")
+	page, err := adminLoginsGetInternal(ctx, email)
+	if err != nil {
+		handleErrorInternal(err, ctx, true)
+		return
+	}
+
+	navbar, _ := getHTMLElemntInternal(true)
+	ctx.HTML(
+		http.StatusOK,
+		"logins.html",
+		gin.H{
+			"navbar": navbar,
+			"title":  "Sign-in attempts",
+			"admin":  true,
+			"email":  email,
+			"logins": page.Logins,
+		},
+	)
+}
+
+func adminLoginsGetInternal(ctx *gin.Context, email string,
+) (page models.LoginPage, err error) {
+	if utf8.RuneCountInString(email) > maxEmailLen {
+		err = errorInvalidInput
+		return
+	}
+
+	reqCtx, cancel := requestContext(ctx)
+	defer cancel()
+
+	page, err = rabbitrpc.Call[models.LoginQuery, models.LoginPage](
+		reqCtx,
+		usersClient,
+		"readLogins",
+		&models.LoginQuery{
+			Email: email,
+			Limit: loginsPerAdminPage,
+		},
+	)
+	return
+}
+
+func adminQueueGet(ctx *gin.Context) {
+	queue, err := adminQueueGetInternal(ctx)
+	if err != nil {
+		handleErrorInternal(err, ctx, true)
+		return
+	}
+
+	navbar, _ := getHTMLElemntInternal(true)
+	state := getStateFromCTX(ctx)
+	ctx.HTML(
+		http.StatusOK,
+		"queue.html",
+		gin.H{
+			"navbar": navbar,
+			"state":  state,
+			"items":  queue.Items,
+		},
+	)
+}
+
+func adminQueueGetInternal(ctx *gin.Context) (queue models.ModerationQueue, err error) {
+	reqCtx, cancel := requestContext(ctx)
+	defer cancel()
+
+	queue, err = rabbitrpc.Call[models.PageRequest, models.ModerationQueue](
+		reqCtx,
+		topicsClient,
+		"readModerationQueue",
+		&models.PageRequest{Limit: reportsPerQueue},
+	)
+	return
+}
+
+func adminResolvePost(ctx *gin.Context) {
+	err := adminResolvePostInternal(ctx)
+	if err != nil {
+		handleErrorInternal(err, ctx, true)
+		return
+	}
+	ctx.Redirect(http.StatusFound, "/admin/queue")
+}
+
+func adminResolvePostInternal(ctx *gin.Context) (err error) {
+	_, err = stateCheckProcess(ctx)
+	if err != nil {
+		return
+	}
+
+	report, err := reportFromPostForm(ctx)
+	if err != nil {
+		return
+	}
+	report.Resolution = ctx.PostForm("resolution")
+	if report.Resolution != models.ResolutionDismissed &&
+		report.Resolution != models.ResolutionDeleted {
+		err = errorInvalidInput
+		return
+	}
+
+	reqCtx, cancel := requestContext(ctx)
+	defer cancel()
+
+	_, err = rabbitrpc.Call[models.Report, models.Report](
+		reqCtx,
+		topicsClient,
+		"resolveReports",
+		report,
+	)
+	return
+}
+
+// kind and id of reported content
+func reportFromPostForm(ctx *gin.Context) (report *models.Report, err error) {
+	kind := ctx.PostForm("kind")
+	if kind != models.ReportTopic && kind != models.ReportReply {
+		err = errorInvalidInput
+		return
+	}
+	uuid, err := idFromPostForm(ctx)
+	if err != nil {
+		return
+	}
+
+	report = &models.Report{
+		Kind:       kind,
+		TargetUuId: uuid,
+	}
+	return
+}
+
+// from topic page, by any logged in user
+func reportPost(ctx *gin.Context) {
+	err := reportPostInternal(ctx)
+	if err != nil {
+		handleErrorInternal(err, ctx, true)
+		return
+	}
+	errorPage(ctx, http.StatusOK, "thank you, moderators will check it")
+}
+
+func reportPostInternal(ctx *gin.Context) (err error) {
+	_, err = stateCheckProcess(ctx)
+	if err != nil {
+		return
+	}
+
+	report, err := reportFromPostForm(ctx)
+	if err != nil {
+		return
+	}
+	report.Reason = ctx.PostForm("reason")
+	if utf8.RuneCountInString(report.Reason) > maxReasonLen {
+		err = errorInvalidInput
+		return
+	}
+	if common.IsEmpty(report.Reason) {
+		report.Reason = "no reason given"
+	}
+
+	reqCtx, cancel := requestContext(ctx)
+	defer cancel()
+
+	_, err = rabbitrpc.Call[models.Report, models.Report](
+		reqCtx,
+		topicsClient,
+		"reportContent",
+		report,
+	)
+	return
+}
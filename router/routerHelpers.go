@@ -1,160 +1,100 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/base64"
-	"errors"
-	"learning-web-chatboard4/common"
 	"learning-web-chatboard4/common/models"
 	"learning-web-chatboard4/rabbitrpc"
-	"learning-web-chatboard4/session"
-	"strconv"
-	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/gin-gonic/gin"
 )
 
-func sendRequest(
-	client *rabbitrpc.RabbitClient,
-	functionToCall string,
-	dataTypeName string,
-	dataPtr interface{},
-	callback func(raws rabbitrpc.Raws),
-) error {
-	corrId := client.GenerateCorrelationID()
-	callbackPool[corrId] = func(raws rabbitrpc.Raws) {
-		callback(raws)
-		doneCh <- raws.CorrelationId
-	}
-	bin, err := rabbitrpc.MakeBin(
-		0,
-		0,
-		functionToCall,
-		dataTypeName,
-		dataPtr,
-	)
-	if err != nil {
-		return err
-	}
+var errorInvalidInput = rabbitrpc.NewError(
+	rabbitrpc.CodeInvalidArgument,
+	"invalid input",
+)
 
-	client.Publisher.Ch <- rabbitrpc.Raws{
-		Body:          bin,
-		CorrelationId: corrId,
-	}
-	return nil
-}
+// how long router waits for a response from services
+const requestTimeout = time.Second * 10
 
-func sendRequestAndWait(
-	client *rabbitrpc.RabbitClient,
-	functionToCall string,
-	dataTypeName string,
-	dataPtr interface{},
-	callback func(raws rabbitrpc.Raws) error,
-) error {
-	wait := make(chan error)
-	go func() {
-		err := sendRequest(
-			client,
-			functionToCall,
-			dataTypeName,
-			dataPtr,
-			func(raws rabbitrpc.Raws) {
-				e := callback(raws)
-				wait <- e
-			},
-		)
-		if err != nil {
-			wait <- err
-		}
-	}()
-	select {
-	case e := <-wait:
-		return e
+// deadline is derived from http request,
+// requests carry the browser and the caller when logged in
+func requestContext(ctx *gin.Context) (context.Context, context.CancelFunc) {
+	reqCtx := rabbitrpc.WithClient(
+		ctx.Request.Context(),
+		&rabbitrpc.Client{
+			IP:        ctx.ClientIP(),
+			UserAgent: ctx.Request.UserAgent(),
+		},
+	)
+	if caller := getCallerFromCTX(ctx); caller != nil {
+		reqCtx = rabbitrpc.WithCaller(reqCtx, caller)
 	}
+	return context.WithTimeout(reqCtx, requestTimeout)
 }
 
-func extract(raws *rabbitrpc.Raws, dataPtr interface{}) error {
-	envelop, e := rabbitrpc.FromBin(raws.Body)
-	if e != nil {
-		return errors.New(e.What)
-	}
-
-	if envelop.Status == rabbitrpc.StatusError {
-		common.LogWarning(logger).Println("returned status is error")
-		rerr := &rabbitrpc.RabbitRPCError{}
-		e = envelop.Extract(rerr)
-		if e != nil {
-			return errors.New(e.What)
-		}
-		return errors.New(rerr.What)
+// cursor is opaque for router, just check it looks like a cursor
+func cursorFromQuery(ctx *gin.Context) (cursor string, err error) {
+	cursor = ctx.Query("cursor")
+	if utf8.RuneCountInString(cursor) > maxCursorLen {
+		err = errorInvalidInput
+		return
 	}
-
-	e = envelop.Extract(dataPtr)
-	if e != nil {
-		return errors.New(e.What)
+	err = validate.Var(cursor, "omitempty,base64url")
+	if err != nil {
+		err = errorInvalidInput
 	}
-	return nil
+	return
 }
 
-func stateCheckProcess(ctx *gin.Context) (sess *models.Session, err error) {
-	sess, err = getSessionPtrFromCTX(ctx)
+// uuid in query or form is url encoded
+func uuidFromBase64(encoded string) (uuid string, err error) {
+	bytes, err := base64.URLEncoding.DecodeString(encoded)
 	if err != nil {
+		err = errorInvalidInput
 		return
 	}
 
-	// check state
-	state := ctx.PostForm("state")
-	err = checkState(state, sess.State)
+	uuid = string(bytes)
+	err = validate.Var(uuid, "uuid4")
 	if err != nil {
-		return
+		err = errorInvalidInput
 	}
-
-	// state is consumed, delete it
-	sess.State = ""
-	err = session.SetToRedis(sess)
 	return
 }
 
-func checkState(exposedVal, privateVal string) (err error) {
-	if strings.Compare(exposedVal, "") == 0 {
-		err = errors.New("exposed value is empty")
-		return
-	}
-	if strings.Compare(privateVal, "") == 0 {
-		err = errors.New("private value is empty")
-		return
-	}
-
-	bytesVal, err := base64.URLEncoding.DecodeString(exposedVal)
+// state is checked and consumed by sessions service,
+// returned session is also stored into ctx
+func stateCheckProcess(ctx *gin.Context) (sess *models.Session, err error) {
+	sess, err = getSessionPtrFromCTX(ctx)
 	if err != nil {
 		return
 	}
-	splited := bytes.SplitN(bytesVal, []byte("||"), 2)
-	// mac can store any bytes,
-	// this should be URL encoded until validation
-	macStored := splited[0]
-	stateStored := string(splited[1])
 
-	if !session.VerifyMAC(macStored, []byte(privateVal)) {
-		err = errors.New("invalid mac")
-		return
-	}
-	if strings.Compare(stateStored, privateVal) != 0 {
-		err = errors.New("invalid state")
-		return
-	}
-	_, unixTimeStr, ok := strings.Cut(stateStored, "||")
-	if !ok {
-		err = errors.New("separator not found")
+	state := ctx.PostForm("state")
+	if len(state) == 0 || utf8.RuneCountInString(state) > maxStateLen {
+		err = errorInvalidInput
 		return
 	}
-	unixTime, err := strconv.ParseInt(unixTimeStr, 10, 64)
+
+	reqCtx, cancel := requestContext(ctx)
+	defer cancel()
+
+	consumed, err := rabbitrpc.Call[models.Session, models.Session](
+		reqCtx,
+		sessionsClient,
+		"consumeState",
+		&models.Session{
+			UuId:  sess.UuId,
+			State: state,
+		},
+	)
 	if err != nil {
 		return
 	}
-	if unixTime < time.Now().Unix() {
-		err = errors.New("state expired")
-	}
+	sess = &consumed
+	ctx.Set(sessionPtrLabel, sess)
 	return
 }
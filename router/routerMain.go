@@ -1,10 +1,17 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
 	"learning-web-chatboard4/common"
+	"learning-web-chatboard4/common/models"
 	"learning-web-chatboard4/rabbitrpc"
 	"learning-web-chatboard4/session"
 	"log"
+	"net/http"
 
 	"github.com/gin-gonic/gin"
 	"github.com/go-playground/validator/v10"
@@ -14,14 +21,32 @@ var config *common.Configuration
 var logger *log.Logger
 var usersClient *rabbitrpc.RabbitClient
 var topicsClient *rabbitrpc.RabbitClient
-var callbackPool rabbitrpc.CallbackPool
-var callbackCh chan rabbitrpc.Raws
-var doneCh chan string
+var sessionsClient *rabbitrpc.RabbitClient
 var validate *validator.Validate
 
 func main() {
 	var err error
 
+	newCookieKey := flag.Bool(
+		"new-cookie-key",
+		false,
+		"print a new cookie key and exit, put it at the head of cookie keys",
+	)
+	flag.Parse()
+
+	if *newCookieKey {
+		key, err := session.NewCookieKey()
+		if err != nil {
+			log.Fatalln(err.Error())
+		}
+		bin, err := json.Marshal(key)
+		if err != nil {
+			log.Fatalln(err.Error())
+		}
+		fmt.Println(string(bin))
+		return
+	}
+
 	// config
 	config, err = common.LoadConfig()
 	if err != nil {
@@ -32,7 +57,7 @@ func main() {
 	err = session.StartSessionMaker(
 		config.UseSecureCookie,
 		config.SetHttpOnlyCookie,
-		config.ShowSQL,
+		config.CookieKeysFile,
 	)
 	if err != nil {
 		log.Fatalln(err.Error())
@@ -48,70 +73,59 @@ func main() {
 	}
 
 	//rabbit
-	callbackCh = make(chan rabbitrpc.Raws)
-	callbackPool = make(rabbitrpc.CallbackPool)
-	doneCh = make(chan string)
+	transport := rabbitrpc.NewAMQPTransport(rabbitrpc.DefaultRabbitURL)
+	transport.OnStateChange = func(
+		rabbit *rabbitrpc.RabbitClient,
+		state rabbitrpc.ConnectionState,
+	) {
+		common.LogWarning(logger).Printf(
+			"%s is %s\n",
+			rabbit.ExchangeName,
+			state,
+		)
+	}
 
-	usersClient = rabbitrpc.NewRPCClient(
-		rabbitrpc.DefaultRabbitURL,
+	usersClient = rabbitrpc.NewRPCClientWithTransport(
+		transport,
 		config.UsersReqQName,
 		config.UsersResQName,
 		config.UsersExchangeName,
 		rabbitrpc.ExchangeKindDirect,
 		config.UsersServerKey,
 		config.UsersClientKey,
-		func(raws rabbitrpc.Raws) {
-			callbackCh <- raws
-		},
 	)
-	defer usersClient.Publisher.Done()
-	defer usersClient.Subscriber.Done()
 
-	topicsClient = rabbitrpc.NewRPCClient(
-		rabbitrpc.DefaultRabbitURL,
+	topicsClient = rabbitrpc.NewRPCClientWithTransport(
+		transport,
 		config.TopicsReqQName,
 		config.TopicsResQName,
 		config.TopicsExchangeName,
 		rabbitrpc.ExchangeKindDirect,
 		config.TopicsServerKey,
 		config.TopicsClientKey,
-		func(raws rabbitrpc.Raws) {
-			callbackCh <- raws
-		},
 	)
-	defer topicsClient.Publisher.Done()
-	defer topicsClient.Subscriber.Done()
 
-	go func() {
-	loop:
-		for {
-			select {
-			case <-usersClient.Publisher.CTX.Done():
-				break loop
-			case <-usersClient.Subscriber.CTX.Done():
-				break loop
-			case <-topicsClient.Publisher.CTX.Done():
-				break loop
-			case <-topicsClient.Subscriber.CTX.Done():
-				break loop
-			case raws := <-callbackCh:
-				fn, ok := callbackPool[raws.CorrelationId]
-				if ok {
-					go fn(raws)
-				} else {
-					common.LogError(logger).Println("recieved unknown response")
-				}
-			case id := <-doneCh:
-				delete(callbackPool, id)
-			}
-		}
-	}()
+	sessionsClient = rabbitrpc.NewRPCClientWithTransport(
+		transport,
+		config.SessionsReqQName,
+		config.SessionsResQName,
+		config.SessionsExchangeName,
+		rabbitrpc.ExchangeKindDirect,
+		config.SessionsServerKey,
+		config.SessionsClientKey,
+	)
 
 	// validator
 	validate = validator.New()
 
 	//gin
 	webEngine := gin.Default()
+	// client ip is used for throttling and logins,
+	// forwarded headers from others are ignored
+	err = webEngine.SetTrustedProxies(config.TrustedProxies)
+	if err != nil {
+		common.LogError(logger).Fatalln(err.Error())
+	}
 	// setup templates
 	webEngine.Static("/static", "./public")
 	webEngine.Delims("{{", "}}")
@@ -124,6 +138,7 @@ func main() {
 		loggedInCheckMiddleware,
 		indexGet,
 	)
+	webEngine.GET("/health", healthGet)
 	webEngine.GET(
 		"/error",
 		setCommonHeadersMiddleware,
@@ -148,9 +163,48 @@ func main() {
 		generateSessionStateMiddleware,
 		signupGet,
 	)
+	usersRoute.GET(
+		"/forgot",
+		generateSessionStateMiddleware,
+		forgotGet,
+	)
+	usersRoute.GET(
+		"/reset",
+		generateSessionStateMiddleware,
+		resetGet,
+	)
+	usersRoute.GET("/verify", verifyGet)
+	usersRoute.GET(
+		"/resend",
+		generateSessionStateMiddleware,
+		resendGet,
+	)
+	usersRoute.GET(
+		"/totp",
+		generateSessionStateMiddleware,
+		totpGet,
+	)
+	usersRoute.GET(
+		"/2fa",
+		generateSessionStateMiddleware,
+		twoFactorGet,
+	)
+	usersRoute.GET("/activity", activityGet)
+	usersRoute.GET(
+		"/logout",
+		generateSessionStateMiddleware,
+		logoutGet,
+	)
 	usersRoute.POST("/logout", logoutPost)
+	usersRoute.POST("/logout-all", logoutAllPost)
+	usersRoute.POST("/resend-verification", resendPost)
+	usersRoute.POST("/forgot-password", forgotPost)
+	usersRoute.POST("/reset-password", resetPost)
 	usersRoute.POST("/signup-account", signupPost)
 	usersRoute.POST("/authenticate", authenticatePost)
+	usersRoute.POST("/totp-verify", totpVerifyPost)
+	usersRoute.POST("/2fa-enable", twoFactorEnablePost)
+	usersRoute.POST("/2fa-disable", twoFactorDisablePost)
 
 	threadsRoute := webEngine.Group("/topic")
 	threadsRoute.Use(
@@ -168,8 +222,93 @@ func main() {
 		generateSessionStateMiddleware,
 		newTopicGet,
 	)
-	threadsRoute.POST("/create", newTopicPost)
-	threadsRoute.POST("/post", newReplyPost)
+	threadsRoute.GET(
+		"/edit",
+		generateSessionStateMiddleware,
+		editTopicGet,
+	)
+	threadsRoute.GET(
+		"/reply/edit",
+		generateSessionStateMiddleware,
+		editReplyGet,
+	)
+	writeScope := requireScope(models.ScopeWrite)
+	threadsRoute.POST("/create", writeScope, newTopicPost)
+	threadsRoute.POST("/post", writeScope, newReplyPost)
+	threadsRoute.POST("/update", writeScope, updateTopicPost)
+	threadsRoute.POST("/delete", writeScope, deleteTopicPost)
+	threadsRoute.POST("/reply/update", writeScope, updateReplyPost)
+	threadsRoute.POST("/reply/delete", writeScope, deleteReplyPost)
+	threadsRoute.POST("/report", writeScope, reportPost)
+
+	adminRoute := webEngine.Group("/admin")
+	adminRoute.Use(
+		setCommonHeadersMiddleware,
+		sessionCheckMiddleware,
+		loggedInCheckMiddleware,
+	)
+	adminScope := requireScope(models.ScopeAdmin)
+	// moderators only see the queue
+	moderateScope := requireScope(models.ScopeModerate)
+	adminRoute.GET(
+		"/users",
+		adminScope,
+		generateSessionStateMiddleware,
+		adminUsersGet,
+	)
+	adminRoute.GET("/logins", adminScope, adminLoginsGet)
+	adminRoute.GET(
+		"/queue",
+		moderateScope,
+		generateSessionStateMiddleware,
+		adminQueueGet,
+	)
+	adminRoute.POST("/users/lock", adminScope, adminUserPost("lockUser"))
+	adminRoute.POST("/users/unlock", adminScope, adminUserPost("unlockUser"))
+	adminRoute.POST("/users/role", adminScope, adminUserPost("setRole"))
+	adminRoute.POST("/users/logout", adminScope, adminUserPost("forceLogout"))
+	adminRoute.POST("/queue/resolve", moderateScope, adminResolvePost)
+
+	httpServer := &http.Server{
+		Addr:    config.AddressRouter,
+		Handler: webEngine,
+	}
+	go func() {
+		err := httpServer.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			common.LogError(logger).Fatalln(err.Error())
+		}
+	}()
+
+	shutdownCTX, stop := common.NotifyShutdown()
+	defer stop()
+	<-shutdownCTX.Done()
+	shutdown(httpServer)
+}
 
-	webEngine.Run(config.AddressRouter)
+func shutdown(httpServer *http.Server) {
+	common.LogInfo(logger).Println("shutting down...")
+	ctx, cancel := context.WithTimeout(
+		context.Background(),
+		common.ShutdownTimeout,
+	)
+	defer cancel()
+
+	// stop accepting and wait for running handlers
+	err := httpServer.Shutdown(ctx)
+	if err != nil {
+		common.LogWarning(logger).Println(err.Error())
+	}
+
+	for _, client := range []*rabbitrpc.RabbitClient{
+		usersClient,
+		topicsClient,
+		sessionsClient,
+	} {
+		err = client.Shutdown(ctx)
+		if err != nil {
+			common.LogWarning(logger).Println(err.Error())
+		}
+	}
+	common.LogInfo(logger).Println("bye")
 }
@@ -1,8 +1,8 @@
 package main
 
 import (
+	"context"
 	"encoding/base64"
-	"errors"
 	"fmt"
 	"html/template"
 	"learning-web-chatboard4/common"
@@ -14,6 +14,7 @@ import (
 	"unicode/utf8"
 
 	"github.com/gin-gonic/gin"
+	"github.com/skip2/go-qrcode"
 )
 
 const (
@@ -36,9 +37,9 @@ const (
 	  <a class="navbar-brand" href="/">KEIJIBAN</a>
     </div>
     <div class="nav navbar-nav navbar-right">
-	<form id="logout" action="/user/logout" method="post">
-      <button class="btn btn-outline-primary btn-sm" type="submit">Logout</button>
-	</form>
+	<a class="btn btn-outline-secondary btn-sm" href="/user/activity">Activity</a>
+	<a class="btn btn-outline-secondary btn-sm" href="/user/2fa">Two factor</a>
+	<a class="btn btn-outline-primary btn-sm" href="/user/logout">Logout</a>
 	</div>
   </div>
 </div>`
@@ -58,24 +59,100 @@ const (
 )
 
 const (
-	minNameLen  = 1
-	maxNameLen  = 100
-	minEmailLen = 1
-	maxEmailLen = 100
-	minPwLen    = 6
-	maxPwLen    = 60
-	maxTopicLen = 5000
-	maxReplyLen = 5000
+	minNameLen   = 1
+	maxNameLen   = 100
+	minEmailLen  = 1
+	maxEmailLen  = 100
+	minPwLen     = 6
+	maxPwLen     = 60
+	maxTopicLen  = 5000
+	maxReplyLen  = 5000
+	maxReasonLen = 500
+	maxCursorLen = 100
+	maxUuIdLen   = 100
+	maxStateLen  = 200
+	// base64 of 32 bytes
+	resetTokenLen = 43
+	// signed token from authentication service
+	maxVerifyTokenLen = 1000
+	// recovery code with hyphens and spaces
+	maxTotpCodeLen = 30
+	// pixels
+	qrCodeSize = 256
 )
 
+const (
+	topicsPerPage  = 20
+	repliesPerPage = 50
+	loginsPerPage  = 20
+)
+
+type errorPageInfo struct {
+	status int
+	msg    string
+}
+
+// error code from services to what user sees.
+// messages are generic, handlers which know better override them
+var errorPages = map[rabbitrpc.ErrorCode]errorPageInfo{
+	rabbitrpc.CodeNotFound: {
+		http.StatusNotFound,
+		"not found",
+	},
+	rabbitrpc.CodeInvalidArgument: {
+		http.StatusBadRequest,
+		"invalid input",
+	},
+	rabbitrpc.CodeUnauthenticated: {
+		http.StatusUnauthorized,
+		"authentication required",
+	},
+	rabbitrpc.CodeLocked: {
+		http.StatusLocked,
+		"this account is locked",
+	},
+	rabbitrpc.CodeConflict: {
+		http.StatusConflict,
+		"already exists",
+	},
+	rabbitrpc.CodePermissionDenied: {
+		http.StatusForbidden,
+		"permission denied",
+	},
+	rabbitrpc.CodeRateLimited: {
+		http.StatusTooManyRequests,
+		"too many requests, try again later",
+	},
+	rabbitrpc.CodeInternal: {
+		http.StatusInternalServerError,
+		"internal error",
+	},
+	rabbitrpc.CodeUnavailable: {
+		http.StatusServiceUnavailable,
+		"service unavailable",
+	},
+	rabbitrpc.CodeDeadlineExceeded: {
+		http.StatusGatewayTimeout,
+		"service timed out",
+	},
+	rabbitrpc.CodeCanceled: {
+		http.StatusServiceUnavailable,
+		"request canceled",
+	},
+}
+
 func handleErrorInternal(
-	loggerErrorMsg string,
+	err error,
 	ctx *gin.Context,
-	redirect bool,
+	render bool,
 ) {
-	common.LogError(logger).Println("recieved error:", loggerErrorMsg)
-	if redirect {
-		errorRedirect(ctx, "internal error")
+	common.LogError(logger).Println("recieved error:", err.Error())
+	if render {
+		info, ok := errorPages[rabbitrpc.CodeOf(err)]
+		if !ok {
+			info = errorPages[rabbitrpc.CodeInternal]
+		}
+		errorPage(ctx, info.status, info.msg)
 	}
 }
 
@@ -88,62 +165,82 @@ func getHTMLElemntInternal(isLoggedin bool) (template.HTML, template.HTML) {
 }
 
 func indexGet(ctx *gin.Context) {
-	topics, err := indexGetInternal(ctx)
+	page, err := indexGetInternal(ctx)
 	if err != nil {
-		handleErrorInternal(err.Error(), ctx, true)
+		handleErrorInternal(err, ctx, true)
+		return
 	}
 	navbar, _ := getHTMLElemntInternal(confirmLoggedIn(ctx))
 	ctx.HTML(
 		http.StatusOK,
 		"index.html",
 		gin.H{
-			"navbar": navbar,
-			"topics": topics,
+			"navbar":   navbar,
+			"topics":   page.Topics,
+			"next":     page.Next,
+			"isNewest": len(ctx.Query("cursor")) == 0,
 		},
 	)
 }
 
-func indexGetInternal(ctx *gin.Context) (topics []models.Topic, err error) {
-	err = sendRequestAndWait(
+func indexGetInternal(ctx *gin.Context) (page models.TopicPage, err error) {
+	cursor, err := cursorFromQuery(ctx)
+	if err != nil {
+		return
+	}
+
+	reqCtx, cancel := requestContext(ctx)
+	defer cancel()
+
+	page, err = rabbitrpc.Call[models.PageRequest, models.TopicPage](
+		reqCtx,
 		topicsClient,
 		"readTopics",
-		"Topic",
-		&models.Topic{},
-		func(raws rabbitrpc.Raws) (e error) {
-			e = extract(&raws, &topics)
-			if e != nil {
-				handleErrorInternal(e.Error(), ctx, false)
-			}
-			return
+		&models.PageRequest{
+			Cursor: cursor,
+			Limit:  topicsPerPage,
 		},
 	)
 	return
 }
 
-func errorRedirect(ctx *gin.Context, msg string) {
-	ctx.Redirect(
-		http.StatusFound,
-		fmt.Sprintf(
-			"%s%s",
-			"/error?msg=",
-			msg,
-		),
-	)
-}
-
 func errorGet(ctx *gin.Context) {
 	errMsg := ctx.Query("msg")
 	err := validate.Var(errMsg, "lowercase")
 	if err != nil {
 		errMsg = "internal error"
 	}
+	errorPage(ctx, http.StatusFound, errMsg)
+}
+
+// render error page directly with status
+func errorPage(ctx *gin.Context, status int, msg string) {
 	navbar, _ := getHTMLElemntInternal(confirmLoggedIn(ctx))
 	ctx.HTML(
-		http.StatusFound,
+		status,
 		"error.html",
 		gin.H{
 			"navbar": navbar,
-			"msg":    errMsg,
+			"msg":    msg,
+		},
+	)
+}
+
+// for load balancers and monitoring
+func healthGet(ctx *gin.Context) {
+	status := http.StatusOK
+	if !usersClient.IsConnected() ||
+		!topicsClient.IsConnected() ||
+		!sessionsClient.IsConnected() {
+
+		status = http.StatusServiceUnavailable
+	}
+	ctx.JSON(
+		status,
+		gin.H{
+			"users":    usersClient.State().String(),
+			"topics":   topicsClient.State().String(),
+			"sessions": sessionsClient.State().String(),
 		},
 	)
 }
@@ -172,11 +269,29 @@ func signupGet(ctx *gin.Context) {
 
 // use one more page and use post method
 // for protecting from CSRF attack
+func logoutGet(ctx *gin.Context) {
+	if !confirmLoggedIn(ctx) {
+		ctx.Redirect(http.StatusFound, "/")
+		return
+	}
+
+	navbar, _ := getHTMLElemntInternal(true)
+	state := getStateFromCTX(ctx)
+	ctx.HTML(
+		http.StatusOK,
+		"logout.html",
+		gin.H{
+			"navbar": navbar,
+			"state":  state,
+		},
+	)
+}
+
 func logoutPost(ctx *gin.Context) {
 	if confirmLoggedIn(ctx) {
 		err := logoutPostInternal(ctx)
 		if err != nil {
-			handleErrorInternal(err.Error(), ctx, true)
+			handleErrorInternal(err, ctx, true)
 			return
 		}
 	}
@@ -184,19 +299,89 @@ func logoutPost(ctx *gin.Context) {
 }
 
 func logoutPostInternal(ctx *gin.Context) (err error) {
-	sess, err := getSessionPtrFromCTX(ctx)
+	sess, err := stateCheckProcess(ctx)
+	if err != nil {
+		return
+	}
+
+	reqCtx, cancel := requestContext(ctx)
+	defer cancel()
+
+	// session is deleted even if tokens are not revoked
+	_, revokeErr := rabbitrpc.Call[common.Token, common.SimpleMessage](
+		reqCtx,
+		usersClient,
+		"revokeToken",
+		&common.Token{
+			UserEmail: sess.UserEmail,
+			Raw:       sess.Token,
+			Refresh:   sess.RefreshToken,
+		},
+	)
+	if revokeErr != nil {
+		handleErrorInternal(revokeErr, ctx, false)
+	}
+
+	_, err = rabbitrpc.Call[models.Session, models.Session](
+		reqCtx,
+		sessionsClient,
+		"deleteSession",
+		&models.Session{UuId: sess.UuId},
+	)
+	return
+}
+
+// every token of the user is revoked, other browsers are logged out
+// when their access token is checked next
+func logoutAllPost(ctx *gin.Context) {
+	if confirmLoggedIn(ctx) {
+		err := logoutAllPostInternal(ctx)
+		if err != nil {
+			handleErrorInternal(err, ctx, true)
+			return
+		}
+	}
+	ctx.Redirect(http.StatusMovedPermanently, "/")
+}
+
+func logoutAllPostInternal(ctx *gin.Context) (err error) {
+	sess, err := stateCheckProcess(ctx)
+	if err != nil {
+		return
+	}
+
+	reqCtx, cancel := requestContext(ctx)
+	defer cancel()
+
+	// user is the caller
+	_, err = rabbitrpc.Call[models.User, common.SimpleMessage](
+		reqCtx,
+		usersClient,
+		"revokeAllTokens",
+		&models.User{},
+	)
 	if err != nil {
 		return
 	}
 
-	session.DelFromRedis(sess.UuId)
+	_, err = rabbitrpc.Call[models.Session, models.Session](
+		reqCtx,
+		sessionsClient,
+		"deleteSession",
+		&models.Session{UuId: sess.UuId},
+	)
 	return
 }
 
 func signupPost(ctx *gin.Context) {
 	err := signupPostInternal(ctx)
+	if rabbitrpc.CodeOf(err) == rabbitrpc.CodeConflict {
+		handleErrorInternal(err, ctx, false)
+		errorPage(ctx, http.StatusConflict, "name or email is already used")
+		return
+	}
 	if err != nil {
-		handleErrorInternal(err.Error(), ctx, true)
+		handleErrorInternal(err, ctx, true)
 		return
 	}
 	ctx.Redirect(http.StatusMovedPermanently, "/user/login")
@@ -211,25 +396,26 @@ func signupPostInternal(ctx *gin.Context) (err error) {
 	email := ctx.PostForm("email")
 	emailLen := utf8.RuneCountInString(email)
 	if emailLen < minEmailLen || emailLen > maxEmailLen {
-		err = errors.New("invalid input")
+		err = errorInvalidInput
 		return
 	}
 	err = validate.Var(email, "email")
 	if err != nil {
+		err = errorInvalidInput
 		return
 	}
 
 	pw := ctx.PostForm("password")
 	pwLen := utf8.RuneCountInString(pw)
 	if pwLen < minPwLen || pwLen > maxPwLen {
-		err = errors.New("invalid input")
+		err = errorInvalidInput
 		return
 	}
 
 	name := ctx.PostForm("name")
 	nameLen := utf8.RuneCountInString(name)
 	if nameLen < minNameLen || nameLen > maxNameLen {
-		err = errors.New("invalid input")
+		err = errorInvalidInput
 		return
 	}
 
@@ -238,7 +424,7 @@ func signupPostInternal(ctx *gin.Context) (err error) {
 		strings.Compare(name, email) == 0 ||
 		strings.Compare(pw, email) == 0 {
 
-		err = errors.New("invalid input")
+		err = errorInvalidInput
 		return
 	}
 
@@ -248,32 +434,37 @@ func signupPostInternal(ctx *gin.Context) (err error) {
 		Password: pw,
 	}
 
-	err = sendRequest(
+	reqCtx, cancel := requestContext(ctx)
+	defer cancel()
+
+	_, err = rabbitrpc.Call[models.User, models.User](
+		reqCtx,
 		usersClient,
 		"createUser",
-		"User",
 		&newUser,
-		func(raws rabbitrpc.Raws) {
-			user := models.User{}
-			e := extract(&raws, &user)
-			if e != nil {
-				handleErrorInternal(e.Error(), ctx, false)
-			}
-		},
 	)
 	return
 }
 
 func authenticatePost(ctx *gin.Context) {
-	err := authenticatePostInternal(ctx)
+	needTotp, err := authenticatePostInternal(ctx)
+	if rabbitrpc.CodeOf(err) == rabbitrpc.CodeUnauthenticated {
+		handleErrorInternal(err, ctx, false)
+		errorPage(ctx, http.StatusUnauthorized, "email or password is incorrect")
+		return
+	}
 	if err != nil {
-		handleErrorInternal(err.Error(), ctx, true)
+		handleErrorInternal(err, ctx, true)
+		return
+	}
+	if needTotp {
+		ctx.Redirect(http.StatusFound, "/user/totp")
 		return
 	}
 	ctx.Redirect(http.StatusMovedPermanently, "/")
 }
 
-func authenticatePostInternal(ctx *gin.Context) (err error) {
+func authenticatePostInternal(ctx *gin.Context) (needTotp bool, err error) {
 	var sess *models.Session
 	sess, err = stateCheckProcess(ctx)
 	if err != nil {
@@ -283,271 +474,1106 @@ func authenticatePostInternal(ctx *gin.Context) (err error) {
 	// authenticate
 	email := ctx.PostForm("email")
 	if utf8.RuneCountInString(email) > maxEmailLen {
-		err = errors.New("invalid input")
+		err = errorInvalidInput
 		return
 	}
 	err = validate.Var(email, "email")
 	if err != nil {
+		err = errorInvalidInput
 		return
 	}
 
 	pw := ctx.PostForm("password")
 	if utf8.RuneCountInString(pw) > maxPwLen {
-		err = errors.New("invalid input")
+		err = errorInvalidInput
 		return
 	}
 
-	authUser := models.User{
-		Email:    email,
-		Password: pw,
-	}
-	err = sendRequestAndWait(
+	reqCtx, cancel := requestContext(ctx)
+	defer cancel()
+
+	authUser, err := rabbitrpc.Call[models.User, models.User](
+		reqCtx,
 		usersClient,
 		"readUser",
-		"User",
-		&authUser,
-		func(raws rabbitrpc.Raws) (e error) {
-			e = extract(&raws, &authUser)
-			if e != nil {
-				handleErrorInternal(e.Error(), ctx, false)
-			}
-			return
+		&models.User{
+			Email:    email,
+			Password: pw,
 		},
 	)
 	if err != nil {
 		return
 	}
 
-	// delete session from redis to update uuid
-	session.DelFromRedis(sess.UuId)
-
-	// start new session
-	sess.UuId = common.NewUuIdString()
-	sess.Token = authUser.Token
-	sess.UserName = authUser.Name
-	sess.UserId = authUser.Id
-	sess.UserEmail = authUser.Email
-
-	session.SetToRedisWithExpiration(sess)
+	// password was ok, code is asked next
+	if !common.IsEmpty(authUser.TotpTicket) {
+		sess.TotpTicket = authUser.TotpTicket
+		_, err = rabbitrpc.Call[models.Session, models.Session](
+			reqCtx,
+			sessionsClient,
+			"updateSession",
+			sess,
+		)
+		needTotp = true
+		return
+	}
 
-	err = session.StoreSessionCookie(ctx, sess.UuId)
+	err = startUserSessionInternal(ctx, reqCtx, sess, &authUser)
 	return
 }
 
-func topicGet(ctx *gin.Context) {
-	topic, replies, err := topicGetInternal(ctx)
+// start new session with new uuid, old one is deleted
+func startUserSessionInternal(
+	ctx *gin.Context,
+	reqCtx context.Context,
+	sess *models.Session,
+	authUser *models.User,
+) (err error) {
+	renewed, err := rabbitrpc.Call[models.Session, models.Session](
+		reqCtx,
+		sessionsClient,
+		"renewSession",
+		&models.Session{
+			UuId:         sess.UuId,
+			Token:        authUser.Token,
+			RefreshToken: authUser.RefreshToken,
+			UserName:     authUser.Name,
+			UserId:       authUser.Id,
+			UserEmail:    authUser.Email,
+			UserVerified: authUser.IsVerified(),
+		},
+	)
 	if err != nil {
-		handleErrorInternal(err.Error(), ctx, true)
 		return
 	}
 
-	navbar, replyForm := getHTMLElemntInternal(confirmLoggedIn(ctx))
-	state := getStateFromCTX(ctx)
+	err = session.StoreSessionCookie(ctx, renewed.UuId)
+	return
+}
 
+func totpGet(ctx *gin.Context) {
+	sess, err := getSessionPtrFromCTX(ctx)
+	if err != nil || common.IsEmpty(sess.TotpTicket) {
+		ctx.Redirect(http.StatusFound, "/user/login")
+		return
+	}
+	state := getStateFromCTX(ctx)
 	ctx.HTML(
 		http.StatusOK,
-		"topic.html",
+		"totp.html",
 		gin.H{
-			"navbar":    navbar,
-			"topic":     topic,
-			"replyForm": replyForm,
-			"replies":   replies,
-			"state":     state,
+			"state": state,
 		},
 	)
 }
 
-func topicGetInternal(ctx *gin.Context,
-) (topic *models.Topic, replies []models.Reply, err error) {
-	base64_uuid := ctx.Query("id")
-	bytes, err := base64.URLEncoding.DecodeString(base64_uuid)
+func totpVerifyPost(ctx *gin.Context) {
+	err := totpVerifyPostInternal(ctx)
+	if rabbitrpc.CodeOf(err) == rabbitrpc.CodeUnauthenticated {
+		handleErrorInternal(err, ctx, false)
+		errorPage(
+			ctx,
+			http.StatusUnauthorized,
+			"code is incorrect or login expired",
+		)
+		return
+	}
 	if err != nil {
+		handleErrorInternal(err, ctx, true)
 		return
 	}
+	ctx.Redirect(http.StatusMovedPermanently, "/")
+}
 
-	uuid := string(bytes)
-	err = validate.Var(uuid, "uuid4")
+func totpVerifyPostInternal(ctx *gin.Context) (err error) {
+	sess, err := stateCheckProcess(ctx)
 	if err != nil {
 		return
 	}
+	if common.IsEmpty(sess.TotpTicket) {
+		err = rabbitrpc.NewError(
+			rabbitrpc.CodeUnauthenticated,
+			"no login in progress",
+		)
+		return
+	}
 
-	topic = &models.Topic{UuId: uuid}
-	err = sendRequestAndWait(
-		topicsClient,
-		"readATopic",
-		"Topic",
-		topic,
-		func(raws rabbitrpc.Raws) (e error) {
-			e = extract(&raws, topic)
-			if e != nil {
-				handleErrorInternal(e.Error(), ctx, false)
-			}
-			return
-		},
-	)
-	if err != nil {
+	code := ctx.PostForm("code")
+	if common.IsEmpty(code) || utf8.RuneCountInString(code) > maxTotpCodeLen {
+		err = errorInvalidInput
 		return
 	}
 
-	err = sendRequestAndWait(
-		topicsClient,
-		"readRepliesInTopic",
-		"Topic",
-		topic,
-		func(raws rabbitrpc.Raws) (e error) {
-			e = extract(&raws, &replies)
-			if e != nil {
-				handleErrorInternal(e.Error(), ctx, false)
-			}
-			return
+	reqCtx, cancel := requestContext(ctx)
+	defer cancel()
+
+	authUser, err := rabbitrpc.Call[models.TotpCode, models.User](
+		reqCtx,
+		usersClient,
+		"verifyTotp",
+		&models.TotpCode{
+			Ticket: sess.TotpTicket,
+			Code:   code,
 		},
 	)
 	if err != nil {
 		return
 	}
 
-	// store info into session
-	sess, err := getSessionPtrFromCTX(ctx)
+	err = startUserSessionInternal(ctx, reqCtx, sess, &authUser)
+	return
+}
+
+func twoFactorGet(ctx *gin.Context) {
+	if !confirmLoggedIn(ctx) {
+		ctx.Redirect(http.StatusFound, "/user/login")
+		return
+	}
+
+	enrollment, qr, err := twoFactorGetInternal(ctx)
 	if err != nil {
+		handleErrorInternal(err, ctx, true)
 		return
 	}
-	sess.TopicId = topic.Id
-	sess.TopicUuId = topic.UuId
-	err = session.SetToRedis(sess)
-	return
-}
 
-func newTopicGet(ctx *gin.Context) {
-	loggedin := confirmLoggedIn(ctx)
-	navbar, _ := getHTMLElemntInternal(loggedin)
+	navbar, _ := getHTMLElemntInternal(true)
 	state := getStateFromCTX(ctx)
-	if loggedin {
-		ctx.HTML(
-			http.StatusOK,
-			"newtopic.html",
-			gin.H{
-				"navbar": navbar,
-				"state":  state,
-			},
-		)
-	} else {
-		ctx.Redirect(http.StatusFound, "/user/login")
+	ctx.HTML(
+		http.StatusOK,
+		"twofactor.html",
+		gin.H{
+			"navbar":  navbar,
+			"state":   state,
+			"enabled": enrollment.Enabled,
+			"secret":  enrollment.Secret,
+			"qr":      qr,
+		},
+	)
+}
+
+// qr is png data uri of enrollment.URI
+func twoFactorGetInternal(ctx *gin.Context,
+) (enrollment models.TotpEnrollment, qr template.URL, err error) {
+	reqCtx, cancel := requestContext(ctx)
+	defer cancel()
+
+	// user is the caller
+	enrollment, err = rabbitrpc.Call[models.User, models.TotpEnrollment](
+		reqCtx,
+		usersClient,
+		"beginTotp",
+		&models.User{},
+	)
+	if err != nil || enrollment.Enabled {
+		return
+	}
+
+	png, err := qrcode.Encode(enrollment.URI, qrcode.Medium, qrCodeSize)
+	if err != nil {
+		return
 	}
+	qr = template.URL(
+		"data:image/png;base64," + base64.StdEncoding.EncodeToString(png),
+	)
+	return
 }
 
-func newTopicPost(ctx *gin.Context) {
+func twoFactorEnablePost(ctx *gin.Context) {
 	if !confirmLoggedIn(ctx) {
 		ctx.Redirect(http.StatusFound, "/user/login")
 		return
 	}
 
-	err := newTopicPostInternal(ctx)
+	codes, err := twoFactorEnablePostInternal(ctx)
 	if err != nil {
-		handleErrorInternal(err.Error(), ctx, true)
+		handleErrorInternal(err, ctx, true)
 		return
 	}
 
-	ctx.Redirect(http.StatusMovedPermanently, "/")
+	navbar, _ := getHTMLElemntInternal(true)
+	ctx.HTML(
+		http.StatusOK,
+		"recovery.html",
+		gin.H{
+			"navbar": navbar,
+			"codes":  codes,
+		},
+	)
 }
 
-func newTopicPostInternal(ctx *gin.Context) (err error) {
-	sess, err := stateCheckProcess(ctx)
+func twoFactorEnablePostInternal(ctx *gin.Context) (codes []string, err error) {
+	_, err = stateCheckProcess(ctx)
 	if err != nil {
 		return
 	}
 
-	body := ctx.PostForm("topic")
-	if utf8.RuneCountInString(body) > maxTopicLen {
-		err = errors.New("invalid input")
+	code := ctx.PostForm("code")
+	if common.IsEmpty(code) || utf8.RuneCountInString(code) > maxTotpCodeLen {
+		err = errorInvalidInput
 		return
 	}
 
-	topic := models.Topic{
-		Topic:  body,
-		Owner:  sess.UserName,
-		UserId: sess.UserId,
-	}
-	err = sendRequestAndWait(
-		topicsClient,
-		"createTopic",
-		"Topic",
-		&topic,
-		func(raws rabbitrpc.Raws) (e error) {
-			e = extract(&raws, &topic)
-			if e != nil {
-				handleErrorInternal(e.Error(), ctx, false)
-			}
-			return
-		},
+	reqCtx, cancel := requestContext(ctx)
+	defer cancel()
+
+	enrollment, err := rabbitrpc.Call[models.TotpCode, models.TotpEnrollment](
+		reqCtx,
+		usersClient,
+		"enableTotp",
+		&models.TotpCode{Code: code},
 	)
+	if err != nil {
+		return
+	}
+	codes = enrollment.RecoveryCodes
 	return
 }
 
-func newReplyPost(ctx *gin.Context) {
+func twoFactorDisablePost(ctx *gin.Context) {
 	if !confirmLoggedIn(ctx) {
 		ctx.Redirect(http.StatusFound, "/user/login")
 		return
 	}
 
-	topiUuId, err := newReplyPostInternal(ctx)
+	err := twoFactorDisablePostInternal(ctx)
+	if rabbitrpc.CodeOf(err) == rabbitrpc.CodeUnauthenticated {
+		handleErrorInternal(err, ctx, false)
+		errorPage(ctx, http.StatusUnauthorized, "code is incorrect")
+		return
+	}
 	if err != nil {
-		handleErrorInternal(err.Error(), ctx, true)
+		handleErrorInternal(err, ctx, true)
 		return
 	}
-	encoded := base64.URLEncoding.EncodeToString([]byte(topiUuId))
-	ctx.Redirect(http.StatusMovedPermanently, fmt.Sprint("/topic/read?id=", encoded))
+	errorPage(ctx, http.StatusOK, "two factor authentication is disabled")
 }
 
-func newReplyPostInternal(ctx *gin.Context) (topiUuId string, err error) {
-	sess, err := stateCheckProcess(ctx)
+func twoFactorDisablePostInternal(ctx *gin.Context) (err error) {
+	_, err = stateCheckProcess(ctx)
 	if err != nil {
 		return
 	}
 
-	// pick up info from session
-	topiId := sess.TopicId
-	topiUuId = sess.TopicUuId
-
-	body := ctx.PostForm("body")
-	if utf8.RuneCountInString(body) > maxReplyLen {
-		err = errors.New("invlid input")
+	code := ctx.PostForm("code")
+	if common.IsEmpty(code) || utf8.RuneCountInString(code) > maxTotpCodeLen {
+		err = errorInvalidInput
 		return
 	}
 
-	reply := models.Reply{
-		Body:        body,
-		Contributor: sess.UserName,
-		UserId:      sess.UserId,
-		TopicId:     topiId,
-	}
-	err = sendRequest(
-		topicsClient,
-		"createReply",
-		"Reply",
-		&reply,
-		func(raws rabbitrpc.Raws) {
-			e := extract(&raws, &reply)
-			if e != nil {
-				handleErrorInternal(e.Error(), ctx, false)
-			}
-		},
+	reqCtx, cancel := requestContext(ctx)
+	defer cancel()
+
+	_, err = rabbitrpc.Call[models.TotpCode, common.SimpleMessage](
+		reqCtx,
+		usersClient,
+		"disableTotp",
+		&models.TotpCode{Code: code},
 	)
+	return
+}
+
+// recent sign-in activity of the user
+func activityGet(ctx *gin.Context) {
+	if !confirmLoggedIn(ctx) {
+		ctx.Redirect(http.StatusFound, "/user/login")
+		return
+	}
+
+	page, err := activityGetInternal(ctx)
 	if err != nil {
+		handleErrorInternal(err, ctx, true)
 		return
 	}
 
-	topic := models.Topic{UuId: topiUuId}
-	err = sendRequest(
-		topicsClient,
-		"incrementTopic",
-		"Topic",
-		&topic,
-		func(raws rabbitrpc.Raws) {
-			e := extract(&raws, &topic)
-			if e != nil {
-				handleErrorInternal(e.Error(), ctx, false)
-			}
+	navbar, _ := getHTMLElemntInternal(true)
+	ctx.HTML(
+		http.StatusOK,
+		"logins.html",
+		gin.H{
+			"navbar": navbar,
+			"title":  "Recent sign-in activity",
+			"logins": page.Logins,
 		},
 	)
+}
+
+func activityGetInternal(ctx *gin.Context) (page models.LoginPage, err error) {
+	reqCtx, cancel := requestContext(ctx)
+	defer cancel()
+
+	page, err = rabbitrpc.Call[models.LoginQuery, models.LoginPage](
+		reqCtx,
+		usersClient,
+		"readLoginActivity",
+		&models.LoginQuery{Limit: loginsPerPage},
+	)
 	return
 }
+
+func forgotGet(ctx *gin.Context) {
+	state := getStateFromCTX(ctx)
+	ctx.HTML(
+		http.StatusOK,
+		"forgot.html",
+		gin.H{
+			"state": state,
+		},
+	)
+}
+
+func forgotPost(ctx *gin.Context) {
+	err := forgotPostInternal(ctx)
+	if err != nil {
+		handleErrorInternal(err, ctx, true)
+		return
+	}
+	// same message whether email is registered or not
+	errorPage(
+		ctx,
+		http.StatusOK,
+		"if the address is registered, a reset link has been sent",
+	)
+}
+
+func forgotPostInternal(ctx *gin.Context) (err error) {
+	_, err = stateCheckProcess(ctx)
+	if err != nil {
+		return
+	}
+
+	email := ctx.PostForm("email")
+	if utf8.RuneCountInString(email) > maxEmailLen {
+		err = errorInvalidInput
+		return
+	}
+	err = validate.Var(email, "email")
+	if err != nil {
+		err = errorInvalidInput
+		return
+	}
+
+	reqCtx, cancel := requestContext(ctx)
+	defer cancel()
+
+	_, err = rabbitrpc.Call[models.User, common.SimpleMessage](
+		reqCtx,
+		usersClient,
+		"requestPasswordReset",
+		&models.User{Email: email},
+	)
+	return
+}
+
+func resetGet(ctx *gin.Context) {
+	token := ctx.Query("token")
+	err := validateResetToken(token)
+	if err != nil {
+		handleErrorInternal(err, ctx, true)
+		return
+	}
+
+	state := getStateFromCTX(ctx)
+	ctx.HTML(
+		http.StatusOK,
+		"reset.html",
+		gin.H{
+			"state": state,
+			"token": token,
+		},
+	)
+}
+
+func resetPost(ctx *gin.Context) {
+	err := resetPostInternal(ctx)
+	if err != nil {
+		handleErrorInternal(err, ctx, true)
+		return
+	}
+	ctx.Redirect(http.StatusMovedPermanently, "/user/login")
+}
+
+func resetPostInternal(ctx *gin.Context) (err error) {
+	_, err = stateCheckProcess(ctx)
+	if err != nil {
+		return
+	}
+
+	token := ctx.PostForm("token")
+	err = validateResetToken(token)
+	if err != nil {
+		return
+	}
+
+	pw := ctx.PostForm("password")
+	pwLen := utf8.RuneCountInString(pw)
+	if pwLen < minPwLen || pwLen > maxPwLen {
+		err = errorInvalidInput
+		return
+	}
+
+	reqCtx, cancel := requestContext(ctx)
+	defer cancel()
+
+	_, err = rabbitrpc.Call[models.NewPassword, common.SimpleMessage](
+		reqCtx,
+		usersClient,
+		"resetPassword",
+		&models.NewPassword{
+			Token:    token,
+			Password: pw,
+		},
+	)
+	return
+}
+
+func validateResetToken(token string) (err error) {
+	if len(token) != resetTokenLen {
+		err = errorInvalidInput
+		return
+	}
+	_, err = base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		err = errorInvalidInput
+	}
+	return
+}
+
+func verifyGet(ctx *gin.Context) {
+	err := verifyGetInternal(ctx)
+	if err != nil {
+		handleErrorInternal(err, ctx, true)
+		return
+	}
+	errorPage(ctx, http.StatusOK, "your email address is verified")
+}
+
+func verifyGetInternal(ctx *gin.Context) (err error) {
+	token := ctx.Query("token")
+	if len(token) == 0 || len(token) > maxVerifyTokenLen {
+		err = errorInvalidInput
+		return
+	}
+
+	reqCtx, cancel := requestContext(ctx)
+	defer cancel()
+
+	verified, err := rabbitrpc.Call[common.Token, models.User](
+		reqCtx,
+		usersClient,
+		"verifyEmail",
+		&common.Token{Raw: token},
+	)
+	if err != nil {
+		return
+	}
+
+	// no need to login again when verified in same browser
+	sess, err := getSessionPtrFromCTX(ctx)
+	if err != nil || sess.UserId != verified.Id {
+		err = nil
+		return
+	}
+	sess.UserVerified = true
+	if len(sess.RefreshToken) > 0 {
+		// new access token has verified scope, session is updated with it
+		err = refreshTokenInternal(ctx, sess)
+		return
+	}
+	_, err = rabbitrpc.Call[models.Session, models.Session](
+		reqCtx,
+		sessionsClient,
+		"updateSession",
+		sess,
+	)
+	return
+}
+
+func resendGet(ctx *gin.Context) {
+	state := getStateFromCTX(ctx)
+	ctx.HTML(
+		http.StatusOK,
+		"resend.html",
+		gin.H{
+			"state": state,
+		},
+	)
+}
+
+func resendPost(ctx *gin.Context) {
+	err := resendPostInternal(ctx)
+	if err != nil {
+		handleErrorInternal(err, ctx, true)
+		return
+	}
+	// same message whether email is registered or not
+	errorPage(
+		ctx,
+		http.StatusOK,
+		"if the address is registered and not verified yet, a mail has been sent",
+	)
+}
+
+func resendPostInternal(ctx *gin.Context) (err error) {
+	_, err = stateCheckProcess(ctx)
+	if err != nil {
+		return
+	}
+
+	email := ctx.PostForm("email")
+	if utf8.RuneCountInString(email) > maxEmailLen {
+		err = errorInvalidInput
+		return
+	}
+	err = validate.Var(email, "email")
+	if err != nil {
+		err = errorInvalidInput
+		return
+	}
+
+	reqCtx, cancel := requestContext(ctx)
+	defer cancel()
+
+	_, err = rabbitrpc.Call[models.User, common.SimpleMessage](
+		reqCtx,
+		usersClient,
+		"resendVerification",
+		&models.User{Email: email},
+	)
+	return
+}
+
+func notVerifiedPage(ctx *gin.Context) {
+	errorPage(
+		ctx,
+		http.StatusForbidden,
+		"please verify your email address first, the mail can be sent again from /user/resend",
+	)
+}
+
+func topicGet(ctx *gin.Context) {
+	topic, page, err := topicGetInternal(ctx)
+	if err != nil {
+		handleErrorInternal(err, ctx, true)
+		return
+	}
+
+	loggedIn := confirmLoggedIn(ctx)
+	navbar, replyForm := getHTMLElemntInternal(loggedIn)
+	state := getStateFromCTX(ctx)
+
+	// for showing edit and delete to owner,
+	// and delete to moderators
+	var userId uint
+	if loggedIn {
+		sess, err := getSessionPtrFromCTX(ctx)
+		if err == nil {
+			userId = sess.UserId
+		}
+	}
+	canModerate := confirmScope(ctx, models.ScopeModerate)
+
+	ctx.HTML(
+		http.StatusOK,
+		"topic.html",
+		gin.H{
+			"navbar":      navbar,
+			"topic":       topic,
+			"replyForm":   replyForm,
+			"replies":     page.Replies,
+			"next":        page.Next,
+			"isFirst":     len(ctx.Query("cursor")) == 0,
+			"state":       state,
+			"userId":      userId,
+			"canModerate": canModerate,
+		},
+	)
+}
+
+func topicGetInternal(ctx *gin.Context,
+) (topic *models.Topic, page models.ReplyPage, err error) {
+	cursor, err := cursorFromQuery(ctx)
+	if err != nil {
+		return
+	}
+
+	uuid, err := uuidFromBase64(ctx.Query("id"))
+	if err != nil {
+		return
+	}
+
+	reqCtx, cancel := requestContext(ctx)
+	defer cancel()
+
+	found, err := rabbitrpc.Call[models.Topic, models.Topic](
+		reqCtx,
+		topicsClient,
+		"readATopic",
+		&models.Topic{UuId: uuid},
+	)
+	if err != nil {
+		return
+	}
+	topic = &found
+
+	page, err = rabbitrpc.Call[models.PageRequest, models.ReplyPage](
+		reqCtx,
+		topicsClient,
+		"readRepliesInTopic",
+		&models.PageRequest{
+			TopicId: topic.Id,
+			Cursor:  cursor,
+			Limit:   repliesPerPage,
+		},
+	)
+	if err != nil {
+		return
+	}
+
+	// store info into session
+	sess, err := getSessionPtrFromCTX(ctx)
+	if err != nil {
+		return
+	}
+	sess.TopicId = topic.Id
+	sess.TopicUuId = topic.UuId
+	_, err = rabbitrpc.Call[models.Session, models.Session](
+		reqCtx,
+		sessionsClient,
+		"updateSession",
+		sess,
+	)
+	return
+}
+
+func newTopicGet(ctx *gin.Context) {
+	loggedin := confirmLoggedIn(ctx)
+	navbar, _ := getHTMLElemntInternal(loggedin)
+	state := getStateFromCTX(ctx)
+	if loggedin {
+		ctx.HTML(
+			http.StatusOK,
+			"newtopic.html",
+			gin.H{
+				"navbar": navbar,
+				"state":  state,
+			},
+		)
+	} else {
+		ctx.Redirect(http.StatusFound, "/user/login")
+	}
+}
+
+func newTopicPost(ctx *gin.Context) {
+	if !confirmLoggedIn(ctx) {
+		ctx.Redirect(http.StatusFound, "/user/login")
+		return
+	}
+	if !confirmVerified(ctx) {
+		notVerifiedPage(ctx)
+		return
+	}
+
+	err := newTopicPostInternal(ctx)
+	if err != nil {
+		handleErrorInternal(err, ctx, true)
+		return
+	}
+
+	ctx.Redirect(http.StatusMovedPermanently, "/")
+}
+
+func newTopicPostInternal(ctx *gin.Context) (err error) {
+	sess, err := stateCheckProcess(ctx)
+	if err != nil {
+		return
+	}
+
+	body := ctx.PostForm("topic")
+	if utf8.RuneCountInString(body) > maxTopicLen {
+		err = errorInvalidInput
+		return
+	}
+
+	topic := models.Topic{
+		Topic:  body,
+		Owner:  sess.UserName,
+		UserId: sess.UserId,
+	}
+	reqCtx, cancel := requestContext(ctx)
+	defer cancel()
+
+	_, err = rabbitrpc.Call[models.Topic, models.Topic](
+		reqCtx,
+		topicsClient,
+		"createTopic",
+		&topic,
+	)
+	return
+}
+
+func newReplyPost(ctx *gin.Context) {
+	if !confirmLoggedIn(ctx) {
+		ctx.Redirect(http.StatusFound, "/user/login")
+		return
+	}
+	if !confirmVerified(ctx) {
+		notVerifiedPage(ctx)
+		return
+	}
+
+	topiUuId, err := newReplyPostInternal(ctx)
+	if err != nil {
+		handleErrorInternal(err, ctx, true)
+		return
+	}
+	encoded := base64.URLEncoding.EncodeToString([]byte(topiUuId))
+	ctx.Redirect(http.StatusMovedPermanently, fmt.Sprint("/topic/read?id=", encoded))
+}
+
+func newReplyPostInternal(ctx *gin.Context) (topiUuId string, err error) {
+	sess, err := stateCheckProcess(ctx)
+	if err != nil {
+		return
+	}
+
+	// pick up info from session
+	topiId := sess.TopicId
+	topiUuId = sess.TopicUuId
+
+	body := ctx.PostForm("body")
+	if utf8.RuneCountInString(body) > maxReplyLen {
+		err = errorInvalidInput
+		return
+	}
+
+	reply := models.Reply{
+		Body:        body,
+		Contributor: sess.UserName,
+		UserId:      sess.UserId,
+		TopicId:     topiId,
+	}
+	reqCtx, cancel := requestContext(ctx)
+	defer cancel()
+
+	_, err = rabbitrpc.Call[models.Reply, models.Reply](
+		reqCtx,
+		topicsClient,
+		"createReply",
+		&reply,
+	)
+	return
+}
+
+func editTopicGet(ctx *gin.Context) {
+	if !confirmLoggedIn(ctx) {
+		ctx.Redirect(http.StatusFound, "/user/login")
+		return
+	}
+
+	topic, err := editTopicGetInternal(ctx)
+	if err != nil {
+		handleErrorInternal(err, ctx, true)
+		return
+	}
+
+	navbar, _ := getHTMLElemntInternal(true)
+	state := getStateFromCTX(ctx)
+	ctx.HTML(
+		http.StatusOK,
+		"edittopic.html",
+		gin.H{
+			"navbar": navbar,
+			"topic":  topic,
+			"state":  state,
+		},
+	)
+}
+
+func editTopicGetInternal(ctx *gin.Context) (topic models.Topic, err error) {
+	sess, err := getSessionPtrFromCTX(ctx)
+	if err != nil {
+		return
+	}
+
+	uuid, err := uuidFromBase64(ctx.Query("id"))
+	if err != nil {
+		return
+	}
+
+	reqCtx, cancel := requestContext(ctx)
+	defer cancel()
+
+	topic, err = rabbitrpc.Call[models.Topic, models.Topic](
+		reqCtx,
+		topicsClient,
+		"readATopic",
+		&models.Topic{UuId: uuid},
+	)
+	if err != nil {
+		return
+	}
+
+	// data service checks again when updating
+	if topic.UserId != sess.UserId {
+		err = rabbitrpc.NewError(
+			rabbitrpc.CodePermissionDenied,
+			"not an owner of the thread",
+		)
+	}
+	return
+}
+
+func updateTopicPost(ctx *gin.Context) {
+	if !confirmLoggedIn(ctx) {
+		ctx.Redirect(http.StatusFound, "/user/login")
+		return
+	}
+
+	topic, err := updateTopicPostInternal(ctx)
+	if err != nil {
+		handleErrorInternal(err, ctx, true)
+		return
+	}
+	ctx.Redirect(http.StatusMovedPermanently, fmt.Sprint("/topic/read?id=", topic.AsURL()))
+}
+
+func updateTopicPostInternal(ctx *gin.Context) (topic models.Topic, err error) {
+	sess, err := stateCheckProcess(ctx)
+	if err != nil {
+		return
+	}
+
+	uuid, err := idFromPostForm(ctx)
+	if err != nil {
+		return
+	}
+
+	body := ctx.PostForm("topic")
+	if utf8.RuneCountInString(body) > maxTopicLen {
+		err = errorInvalidInput
+		return
+	}
+
+	reqCtx, cancel := requestContext(ctx)
+	defer cancel()
+
+	topic, err = rabbitrpc.Call[models.Topic, models.Topic](
+		reqCtx,
+		topicsClient,
+		"updateTopic",
+		&models.Topic{
+			UuId:   uuid,
+			Topic:  body,
+			UserId: sess.UserId,
+		},
+	)
+	return
+}
+
+func deleteTopicPost(ctx *gin.Context) {
+	if !confirmLoggedIn(ctx) {
+		ctx.Redirect(http.StatusFound, "/user/login")
+		return
+	}
+
+	err := deleteTopicPostInternal(ctx)
+	if err != nil {
+		handleErrorInternal(err, ctx, true)
+		return
+	}
+	ctx.Redirect(http.StatusMovedPermanently, "/")
+}
+
+func deleteTopicPostInternal(ctx *gin.Context) (err error) {
+	sess, err := stateCheckProcess(ctx)
+	if err != nil {
+		return
+	}
+
+	uuid, err := idFromPostForm(ctx)
+	if err != nil {
+		return
+	}
+
+	reqCtx, cancel := requestContext(ctx)
+	defer cancel()
+
+	_, err = rabbitrpc.Call[models.Topic, models.Topic](
+		reqCtx,
+		topicsClient,
+		"deleteTopic",
+		&models.Topic{
+			UuId:   uuid,
+			UserId: sess.UserId,
+		},
+	)
+	return
+}
+
+func editReplyGet(ctx *gin.Context) {
+	if !confirmLoggedIn(ctx) {
+		ctx.Redirect(http.StatusFound, "/user/login")
+		return
+	}
+
+	reply, err := editReplyGetInternal(ctx)
+	if err != nil {
+		handleErrorInternal(err, ctx, true)
+		return
+	}
+
+	navbar, _ := getHTMLElemntInternal(true)
+	state := getStateFromCTX(ctx)
+	ctx.HTML(
+		http.StatusOK,
+		"editreply.html",
+		gin.H{
+			"navbar": navbar,
+			"reply":  reply,
+			"state":  state,
+		},
+	)
+}
+
+func editReplyGetInternal(ctx *gin.Context) (reply models.Reply, err error) {
+	sess, err := getSessionPtrFromCTX(ctx)
+	if err != nil {
+		return
+	}
+
+	uuid, err := uuidFromBase64(ctx.Query("id"))
+	if err != nil {
+		return
+	}
+
+	reqCtx, cancel := requestContext(ctx)
+	defer cancel()
+
+	reply, err = rabbitrpc.Call[models.Reply, models.Reply](
+		reqCtx,
+		topicsClient,
+		"readAReply",
+		&models.Reply{UuId: uuid},
+	)
+	if err != nil {
+		return
+	}
+
+	// data service checks again when updating
+	if reply.UserId != sess.UserId {
+		err = rabbitrpc.NewError(
+			rabbitrpc.CodePermissionDenied,
+			"not an owner of the reply",
+		)
+	}
+	return
+}
+
+func updateReplyPost(ctx *gin.Context) {
+	if !confirmLoggedIn(ctx) {
+		ctx.Redirect(http.StatusFound, "/user/login")
+		return
+	}
+
+	topiUuId, err := updateReplyPostInternal(ctx)
+	if err != nil {
+		handleErrorInternal(err, ctx, true)
+		return
+	}
+	redirectToTopic(ctx, topiUuId)
+}
+
+func updateReplyPostInternal(ctx *gin.Context) (topiUuId string, err error) {
+	sess, err := stateCheckProcess(ctx)
+	if err != nil {
+		return
+	}
+	topiUuId = sess.TopicUuId
+
+	uuid, err := idFromPostForm(ctx)
+	if err != nil {
+		return
+	}
+
+	body := ctx.PostForm("body")
+	if utf8.RuneCountInString(body) > maxReplyLen {
+		err = errorInvalidInput
+		return
+	}
+
+	reqCtx, cancel := requestContext(ctx)
+	defer cancel()
+
+	_, err = rabbitrpc.Call[models.Reply, models.Reply](
+		reqCtx,
+		topicsClient,
+		"updateReply",
+		&models.Reply{
+			UuId:   uuid,
+			Body:   body,
+			UserId: sess.UserId,
+		},
+	)
+	return
+}
+
+func deleteReplyPost(ctx *gin.Context) {
+	if !confirmLoggedIn(ctx) {
+		ctx.Redirect(http.StatusFound, "/user/login")
+		return
+	}
+
+	topiUuId, err := deleteReplyPostInternal(ctx)
+	if err != nil {
+		handleErrorInternal(err, ctx, true)
+		return
+	}
+	redirectToTopic(ctx, topiUuId)
+}
+
+func deleteReplyPostInternal(ctx *gin.Context) (topiUuId string, err error) {
+	sess, err := stateCheckProcess(ctx)
+	if err != nil {
+		return
+	}
+	topiUuId = sess.TopicUuId
+
+	uuid, err := idFromPostForm(ctx)
+	if err != nil {
+		return
+	}
+
+	reqCtx, cancel := requestContext(ctx)
+	defer cancel()
+
+	_, err = rabbitrpc.Call[models.Reply, models.Reply](
+		reqCtx,
+		topicsClient,
+		"deleteReply",
+		&models.Reply{
+			UuId:   uuid,
+			UserId: sess.UserId,
+		},
+	)
+	return
+}
+
+func idFromPostForm(ctx *gin.Context) (uuid string, err error) {
+	encoded := ctx.PostForm("id")
+	if utf8.RuneCountInString(encoded) > maxUuIdLen {
+		err = errorInvalidInput
+		return
+	}
+	uuid, err = uuidFromBase64(encoded)
+	return
+}
+
+// back to the topic which is stored in session, or index
+func redirectToTopic(ctx *gin.Context, topiUuId string) {
+	if len(topiUuId) == 0 {
+		ctx.Redirect(http.StatusMovedPermanently, "/")
+		return
+	}
+	encoded := base64.URLEncoding.EncodeToString([]byte(topiUuId))
+	ctx.Redirect(http.StatusMovedPermanently, fmt.Sprint("/topic/read?id=", encoded))
+}
@@ -2,7 +2,10 @@ package session
 
 import (
 	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
 	"encoding/base64"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"net/http"
@@ -15,25 +18,30 @@ import (
 
 const sessionCookieLabel = "moemoecookie"
 
+// cookie value is "v1." + base64url(header || nonce || sealed)
+// header is version(1) keyIdLen(1) keyId exp(8, unix big endian)
+// and authenticated as additional data, so exp can't be changed
+const (
+	cookiePrefixV1    = "v1."
+	cookieVersion1    = byte(1)
+	maxCookieLen      = 512
+	maxCookieKeyIdLen = 64
+	// value is a uuid
+	maxCookieValueLen = 64
+	expFieldSize      = 8
+)
+
+var errorInvalidCookie = errors.New("invalid cookie")
+
 func StoreSessionCookie(ctx *gin.Context, value string) (err error) {
-	//add exp
-	value = fmt.Sprintf(
-		"%s||%d",
+	valToStore, err := sealCookie(
+		primaryKey(),
 		value,
-		time.Now().Add(sessionExp).Unix(),
+		time.Now().Add(SessionExp),
 	)
-	encrypted, err := encrypt(value)
 	if err != nil {
 		return
 	}
-	// add mac value first
-	bytesVal := makeMAC(encrypted)
-	// separated '||'
-	bytesVal = append(bytesVal, []byte("||")...)
-	// add encrypted value
-	bytesVal = append(bytesVal, encrypted...)
-
-	valToStore := base64.URLEncoding.EncodeToString(bytesVal)
 
 	if gin.IsDebugging() {
 		sessionMaker.logger.Printf(
@@ -60,20 +68,150 @@ func PickupSessionCookie(ctx *gin.Context) (value string, err error) {
 	if err != nil {
 		return
 	}
+	if len(rawStored) > maxCookieLen {
+		err = errorInvalidCookie
+		return
+	}
+
+	if strings.HasPrefix(rawStored, cookiePrefixV1) {
+		value, err = openCookie(rawStored)
+		return
+	}
+
+	// TODO: remove legacy format in next release
+	value, err = openLegacyCookie(rawStored)
+	if err != nil {
+		return
+	}
+	// upgrade to current format
+	err = StoreSessionCookie(ctx, value)
+	return
+}
+
+func cookieAEAD(key *cookieKey) (cipher.AEAD, error) {
+	return cipher.NewGCM(key.block)
+}
+
+func cookieHeader(keyId string, exp time.Time) []byte {
+	header := make([]byte, 2+len(keyId)+expFieldSize)
+	header[0] = cookieVersion1
+	header[1] = byte(len(keyId))
+	copy(header[2:], keyId)
+	binary.BigEndian.PutUint64(header[2+len(keyId):], uint64(exp.Unix()))
+	return header
+}
+
+func sealCookie(
+	key *cookieKey,
+	value string,
+	exp time.Time,
+) (sealed string, err error) {
+	if len(value) > maxCookieValueLen {
+		err = errors.New("cookie value too long")
+		return
+	}
+	if len(key.id) > maxCookieKeyIdLen {
+		err = errors.New("cookie key id too long")
+		return
+	}
+	aead, err := cookieAEAD(key)
+	if err != nil {
+		return
+	}
+
+	header := cookieHeader(key.id, exp)
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return
+	}
+
+	bin := append(header, nonce...)
+	bin = aead.Seal(bin, nonce, []byte(value), header)
+	sealed = cookiePrefixV1 + base64.RawURLEncoding.EncodeToString(bin)
+	return
+}
+
+func openCookie(rawStored string) (value string, err error) {
+	bin, err := base64.RawURLEncoding.DecodeString(
+		strings.TrimPrefix(rawStored, cookiePrefixV1),
+	)
+	if err != nil {
+		err = errorInvalidCookie
+		return
+	}
+
+	// version and key id length
+	if len(bin) < 2 || bin[0] != cookieVersion1 {
+		err = errorInvalidCookie
+		return
+	}
+	keyIdLen := int(bin[1])
+	if keyIdLen == 0 || keyIdLen > maxCookieKeyIdLen {
+		err = errorInvalidCookie
+		return
+	}
+	headerLen := 2 + keyIdLen + expFieldSize
+	if len(bin) < headerLen {
+		err = errorInvalidCookie
+		return
+	}
+	header := bin[:headerLen]
+	keyId := string(bin[2 : 2+keyIdLen])
+	unixTime := int64(binary.BigEndian.Uint64(bin[2+keyIdLen : headerLen]))
+
+	key, ok := findKeyById(keyId)
+	if !ok {
+		err = fmt.Errorf("unknown cookie key %s", keyId)
+		return
+	}
+	aead, err := cookieAEAD(key)
+	if err != nil {
+		return
+	}
+	rest := bin[headerLen:]
+	if len(rest) < aead.NonceSize()+aead.Overhead() ||
+		len(rest) > aead.NonceSize()+aead.Overhead()+maxCookieValueLen {
+		err = errorInvalidCookie
+		return
+	}
+	nonce := rest[:aead.NonceSize()]
+	plain, err := aead.Open(nil, nonce, rest[aead.NonceSize():], header)
+	if err != nil {
+		err = errorInvalidCookie
+		return
+	}
+
+	// checked after authentication, exp is trustworthy here
+	if unixTime < time.Now().Unix() {
+		err = errors.New("session expired")
+		return
+	}
+	value = string(plain)
+	return
+}
+
+// mac||ctr encrypted "value||exp"
+func openLegacyCookie(rawStored string) (value string, err error) {
 	bytesVal, err := base64.URLEncoding.DecodeString(rawStored)
 	if err != nil {
 		return
 	}
 	splited := bytes.SplitN(bytesVal, []byte("||"), 2)
+	if len(splited) != 2 {
+		err = errors.New("separator not found")
+		return
+	}
 	mac := splited[0]
 	encrypted := splited[1]
 
-	if !VerifyMAC(mac, encrypted) {
+	key, ok := findKeyByMAC(mac, encrypted)
+	if !ok {
 		err = fmt.Errorf("invalid cookie %s", rawStored)
 		return
 	}
 
-	decrypted, err := decrypt(encrypted)
+	decrypted, err := decrypt(key, encrypted)
 	if err != nil {
 		return
 	}
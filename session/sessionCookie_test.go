@@ -0,0 +1,118 @@
+package session
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testCookieValue = "0b7e3d9c-6a4f-4f8e-9d2b-2f1c5a7e8b90"
+
+// replaces keys of sessionMaker with new keys of ids, first is primary
+func setTestCookieKeys(t *testing.T, ids ...string) []*cookieKey {
+	t.Helper()
+	saved := sessionMaker.keys
+	t.Cleanup(func() { sessionMaker.keys = saved })
+
+	sessionMaker.keys = nil
+	for _, id := range ids {
+		raw, err := NewCookieKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw.Id = id
+		key, err := newCookieKeyFrom(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sessionMaker.keys = append(sessionMaker.keys, key)
+	}
+	return sessionMaker.keys
+}
+
+func TestSealOpenCookie(t *testing.T) {
+	keys := setTestCookieKeys(t, "primary", "retired")
+
+	for _, key := range keys {
+		sealed, err := sealCookie(key, testCookieValue, time.Now().Add(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(sealed, cookiePrefixV1) {
+			t.Errorf("sealed = %q, want prefix %q", sealed, cookiePrefixV1)
+		}
+		if len(sealed) > maxCookieLen {
+			t.Errorf("sealed is %d bytes, over %d", len(sealed), maxCookieLen)
+		}
+
+		value, err := openCookie(sealed)
+		if err != nil {
+			t.Fatalf("key %s: %v", key.id, err)
+		}
+		if value != testCookieValue {
+			t.Errorf("key %s: value = %q, want %q", key.id, value, testCookieValue)
+		}
+	}
+}
+
+func TestOpenCookieRejects(t *testing.T) {
+	keys := setTestCookieKeys(t, "primary")
+	exp := time.Now().Add(time.Hour)
+	sealed, err := sealCookie(keys[0], testCookieValue, exp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin, err := base64.RawURLEncoding.DecodeString(
+		strings.TrimPrefix(sealed, cookiePrefixV1),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// changes byte at i of sealed cookie
+	flip := func(i int) string {
+		changed := append([]byte{}, bin...)
+		changed[i] ^= 1
+		return cookiePrefixV1 + base64.RawURLEncoding.EncodeToString(changed)
+	}
+	expLast := 2 + len(keys[0].id) + expFieldSize - 1
+
+	expired, err := sealCookie(keys[0], testCookieValue, time.Now().Add(-time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := setTestCookieKeys(t, "other")
+	unknown, err := sealCookie(other[0], testCookieValue, exp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionMaker.keys = keys
+
+	tests := []struct {
+		name   string
+		sealed string
+	}{
+		{"extended exp", flip(expLast)},
+		{"changed value", flip(len(bin) - 1)},
+		{"other version", flip(0)},
+		{"expired", expired},
+		{"unknown key", unknown},
+		{"truncated", sealed[:len(sealed)-8]},
+		{"not base64", cookiePrefixV1 + "!!!"},
+		{"empty", cookiePrefixV1},
+	}
+
+	for _, test := range tests {
+		if value, err := openCookie(test.sealed); err == nil {
+			t.Errorf("%s: opened as %q", test.name, value)
+		}
+	}
+}
+
+func TestSealCookieTooLong(t *testing.T) {
+	keys := setTestCookieKeys(t, "primary")
+	value := strings.Repeat("a", maxCookieValueLen+1)
+	if _, err := sealCookie(keys[0], value, time.Now().Add(time.Hour)); err == nil {
+		t.Error("too long value was sealed")
+	}
+}
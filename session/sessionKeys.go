@@ -0,0 +1,127 @@
+package session
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// environment variable takes priority over the file,
+// both have json array of keys. the first one is primary
+// and used for new cookies, others are retired and only used for
+// reading cookies issued before rotation
+const CookieKeysEnv = "CHATBOARD_COOKIE_KEYS"
+
+type CookieKey struct {
+	Id  string `json:"id"`
+	Enc []byte `json:"enc"`
+	MAC []byte `json:"mac"`
+}
+
+type cookieKey struct {
+	id     string
+	block  cipher.Block
+	macKey []byte
+}
+
+// NewCookieKey makes a key to be added at the head of keys file
+func NewCookieKey() (key CookieKey, err error) {
+	key = CookieKey{
+		Id:  time.Now().UTC().Format("20060102150405"),
+		Enc: make([]byte, aes256ENCKeySize),
+		MAC: make([]byte, sha256MACKeySize),
+	}
+	_, err = rand.Read(key.Enc)
+	if err != nil {
+		return
+	}
+	_, err = rand.Read(key.MAC)
+	return
+}
+
+// returns nil without error when keys are not configured
+// or keys file does not exist
+func loadCookieKeys(keysFile string) (keys []*cookieKey, err error) {
+	var bin []byte
+	if env, ok := os.LookupEnv(CookieKeysEnv); ok && len(env) > 0 {
+		bin = []byte(env)
+	} else if len(keysFile) > 0 {
+		bin, err = os.ReadFile(keysFile)
+		if errors.Is(err, os.ErrNotExist) {
+			err = nil
+			return
+		}
+		if err != nil {
+			return
+		}
+	} else {
+		return
+	}
+
+	var raws []CookieKey
+	err = json.Unmarshal(bin, &raws)
+	if err != nil {
+		return
+	}
+	if len(raws) == 0 {
+		err = errors.New("no cookie key")
+		return
+	}
+
+	seen := make(map[string]bool)
+	for _, raw := range raws {
+		if len(raw.Id) == 0 || seen[raw.Id] {
+			err = fmt.Errorf("cookie key id is empty or duplicated: %s", raw.Id)
+			return
+		}
+		seen[raw.Id] = true
+		var key *cookieKey
+		key, err = newCookieKeyFrom(raw)
+		if err != nil {
+			return
+		}
+		keys = append(keys, key)
+	}
+	return
+}
+
+func newCookieKeyFrom(raw CookieKey) (key *cookieKey, err error) {
+	if uint(len(raw.Enc)) != aes256ENCKeySize {
+		err = fmt.Errorf("cookie key %s: enc must be %d bytes", raw.Id, aes256ENCKeySize)
+		return
+	}
+	if uint(len(raw.MAC)) < minMACKeySize {
+		err = fmt.Errorf("cookie key %s: mac must be at least %d bytes", raw.Id, minMACKeySize)
+		return
+	}
+	block, err := aes.NewCipher(raw.Enc)
+	if err != nil {
+		return
+	}
+	key = &cookieKey{
+		id:     raw.Id,
+		block:  block,
+		macKey: raw.MAC,
+	}
+	return
+}
+
+func primaryKey() *cookieKey {
+	return sessionMaker.keys[0]
+}
+
+func findKeyById(id string) (key *cookieKey, ok bool) {
+	for _, key = range sessionMaker.keys {
+		if key.id == id {
+			ok = true
+			return
+		}
+	}
+	key = nil
+	return
+}
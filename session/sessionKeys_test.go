@@ -0,0 +1,44 @@
+package session
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestLoadCookieKeys(t *testing.T) {
+	t.Setenv(CookieKeysEnv, "")
+	keys, err := loadCookieKeys(t.TempDir() + "/missing.json")
+	if err != nil || keys != nil {
+		t.Errorf("missing file: keys = %v, err = %v", keys, err)
+	}
+
+	enc := base64.StdEncoding.EncodeToString(make([]byte, aes256ENCKeySize))
+	mac := base64.StdEncoding.EncodeToString(make([]byte, minMACKeySize))
+	key := `{"id":"%s","enc":"` + enc + `","mac":"` + mac + `"}`
+
+	t.Setenv(CookieKeysEnv, "["+
+		strings.Replace(key, "%s", "new", 1)+","+
+		strings.Replace(key, "%s", "old", 1)+"]")
+	keys, err = loadCookieKeys("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0].id != "new" || keys[1].id != "old" {
+		t.Errorf("keys were not loaded in order")
+	}
+
+	invalid := []string{
+		"[]",
+		"[" + strings.Replace(key, "%s", "", 1) + "]",
+		"[" + strings.Replace(key, "%s", "dup", 1) + "," +
+			strings.Replace(key, "%s", "dup", 1) + "]",
+		`[{"id":"short","enc":"AAAA","mac":"` + mac + `"}]`,
+	}
+	for _, env := range invalid {
+		t.Setenv(CookieKeysEnv, env)
+		if _, err = loadCookieKeys(""); err == nil {
+			t.Errorf("keys were loaded from %s", env)
+		}
+	}
+}
@@ -1,80 +1,88 @@
 package session
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/hmac"
-	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
+	"errors"
 	"fmt"
-	"io"
 	"learning-web-chatboard4/common"
 	"learning-web-chatboard4/common/models"
 	"log"
 	"os"
+	"strconv"
+	"strings"
 	"time"
-
-	"github.com/gomodule/redigo/redis"
 )
 
 const (
 	aes256ENCKeySize uint = 32
 	sha256MACKeySize uint = 64
+	minMACKeySize    uint = 32
 	stateSize        uint = 32
 	stateExp              = time.Minute * 5
-	sessionExp            = time.Hour
-	sessionExpSec         = int(sessionExp / time.Second)
+	SessionExp            = time.Hour
+	sessionExpSec         = int(SessionExp / time.Second)
 )
 
 var sessionMaker struct {
 	isInitialized     bool
-	showRedisLog      bool
 	logger            *log.Logger
-	redisConn         redis.Conn
-	block             cipher.Block
-	macKey            []byte
+	keys              []*cookieKey
 	useSecureCookie   bool
 	useHttpOnlyCookie bool
 }
 
-// every time server is restarted, cookie become no longer valid
-func StartSessionMaker(useSecure, useHttpOnly, showLog bool) (err error) {
+// cookie keys are loaded from CookieKeysEnv or keysFile.
+// without both, keys are random and
+// every time server is restarted, cookie become no longer valid.
+// keys are also used for mac of states
+func StartSessionMaker(
+	useSecure, useHttpOnly bool,
+	keysFile string,
+) (err error) {
 	if sessionMaker.isInitialized {
 		return
 	}
 
-	sessionMaker.isInitialized = true
-	sessionMaker.showRedisLog = showLog
-
-	sessionMaker.redisConn, err = redis.Dial(
-		redisConnectionKind,
-		redisAddress,
+	sessionMaker.logger = log.New(
+		os.Stdout,
+		"[SESSION] ",
+		log.Ldate|log.Ltime|log.Lshortfile,
 	)
-	if err != nil {
-		return
-	}
 
-	bKyeStr, err := common.GenerateRandomString(aes256ENCKeySize)
+	sessionMaker.keys, err = loadCookieKeys(keysFile)
 	if err != nil {
 		return
 	}
-	bKey := []byte(bKyeStr)
-	macKeyStr, err := common.GenerateRandomString(sha256MACKeySize)
-	if err != nil {
-		return
+	if sessionMaker.keys == nil {
+		sessionMaker.logger.Println(
+			"cookie keys are not configured, using random keys",
+		)
+		var raw CookieKey
+		raw, err = NewCookieKey()
+		if err != nil {
+			return
+		}
+		var key *cookieKey
+		key, err = newCookieKeyFrom(raw)
+		if err != nil {
+			return
+		}
+		sessionMaker.keys = []*cookieKey{key}
 	}
-	sessionMaker.macKey = []byte(macKeyStr)
-	sessionMaker.block, err = aes.NewCipher(bKey)
-
-	sessionMaker.logger = log.New(
-		os.Stdout,
-		"[SESSION] ",
-		log.Ldate|log.Ltime|log.Lshortfile,
+	sessionMaker.logger.Printf(
+		"primary cookie key: %s, %d keys\n",
+		primaryKey().id,
+		len(sessionMaker.keys),
 	)
 
 	sessionMaker.useSecureCookie = useSecure
 	sessionMaker.useHttpOnlyCookie = useHttpOnly
+	sessionMaker.isInitialized = true
 	return
 }
 
@@ -108,35 +116,91 @@ func GenerateState() (stateRaw, stateAndMACEncoded string, err error) {
 	return
 }
 
+// exposed is what GenerateState returned as stateAndMACEncoded,
+// private is stateRaw
+func VerifyState(exposedVal, privateVal string) (err error) {
+	if len(exposedVal) == 0 {
+		err = errors.New("exposed value is empty")
+		return
+	}
+	if len(privateVal) == 0 {
+		err = errors.New("private value is empty")
+		return
+	}
+
+	bytesVal, err := base64.URLEncoding.DecodeString(exposedVal)
+	if err != nil {
+		return
+	}
+	splited := bytes.SplitN(bytesVal, []byte("||"), 2)
+	if len(splited) != 2 {
+		err = errors.New("separator not found")
+		return
+	}
+	// mac can store any bytes,
+	// this should be URL encoded until validation
+	macStored := splited[0]
+	stateStored := string(splited[1])
+
+	if !VerifyMAC(macStored, []byte(privateVal)) {
+		err = errors.New("invalid mac")
+		return
+	}
+	if stateStored != privateVal {
+		err = errors.New("invalid state")
+		return
+	}
+	_, unixTimeStr, ok := strings.Cut(stateStored, "||")
+	if !ok {
+		err = errors.New("separator not found")
+		return
+	}
+	unixTime, err := strconv.ParseInt(unixTimeStr, 10, 64)
+	if err != nil {
+		return
+	}
+	if unixTime < time.Now().Unix() {
+		err = errors.New("state expired")
+	}
+	return
+}
+
+// mac made with retired keys is also valid
 func VerifyMAC(mac, value []byte) bool {
-	hashedVal := makeMAC(value)
-	return hmac.Equal(mac, hashedVal)
+	_, ok := findKeyByMAC(mac, value)
+	return ok
+}
+
+func findKeyByMAC(mac, value []byte) (key *cookieKey, ok bool) {
+	for _, key = range sessionMaker.keys {
+		if hmac.Equal(mac, makeMACWith(key, value)) {
+			ok = true
+			return
+		}
+	}
+	key = nil
+	return
 }
 
 func makeMAC(value []byte) []byte {
+	return makeMACWith(primaryKey(), value)
+}
+
+func makeMACWith(key *cookieKey, value []byte) []byte {
 	// possible to cache??
-	hash := hmac.New(sha256.New, sessionMaker.macKey)
+	hash := hmac.New(sha256.New, key.macKey)
 	hash.Write(value)
 	return hash.Sum(nil)
 }
 
-func encrypt(plainText string) (cipherText []byte, err error) {
-	cipherText = make([]byte, aes.BlockSize+len(plainText))
-	iv := cipherText[:aes.BlockSize]
-	n, err := io.ReadFull(rand.Reader, iv)
-	if err != nil {
-		err = fmt.Errorf("%s: returned %d", err.Error(), n)
+// only for reading legacy cookies
+func decrypt(key *cookieKey, cipherText []byte) (plainText string, err error) {
+	if len(cipherText) < aes.BlockSize {
+		err = errors.New("cipher text too short")
 		return
 	}
-
-	encryptStream := cipher.NewCTR(sessionMaker.block, iv)
-	encryptStream.XORKeyStream(cipherText[aes.BlockSize:], []byte(plainText))
-	return
-}
-
-func decrypt(cipherText []byte) (plainText string, err error) {
 	decryptText := make([]byte, len(cipherText[aes.BlockSize:]))
-	decryptStream := cipher.NewCTR(sessionMaker.block, cipherText[:aes.BlockSize])
+	decryptStream := cipher.NewCTR(key.block, cipherText[:aes.BlockSize])
 	decryptStream.XORKeyStream(decryptText, cipherText[aes.BlockSize:])
 	plainText = string(decryptText)
 	return
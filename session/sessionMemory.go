@@ -0,0 +1,261 @@
+package session
+
+import (
+	"encoding/json"
+	"learning-web-chatboard4/common/models"
+	"strings"
+	"sync"
+	"time"
+)
+
+const memorySweepInterval = time.Minute
+
+type memoryEntry struct {
+	bytes []byte
+	// zero is no expiration
+	expiresAt time.Time
+}
+
+func (entry *memoryEntry) expired(now time.Time) bool {
+	return !entry.expiresAt.IsZero() && !now.Before(entry.expiresAt)
+}
+
+// for tests and single node development,
+// sessions are lost when process exits
+type memoryStore struct {
+	mutex   sync.Mutex
+	entries map[string]*memoryEntry
+	done    chan struct{}
+	once    sync.Once
+}
+
+func NewMemoryStore() Store {
+	store := &memoryStore{
+		entries: make(map[string]*memoryEntry),
+		done:    make(chan struct{}),
+	}
+	go store.sweep()
+	return store
+}
+
+// removes expired entries periodically
+func (store *memoryStore) sweep() {
+	ticker := time.NewTicker(memorySweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			store.mutex.Lock()
+			for uuid, entry := range store.entries {
+				if entry.expired(now) {
+					delete(store.entries, uuid)
+				}
+			}
+			store.mutex.Unlock()
+		case <-store.done:
+			return
+		}
+	}
+}
+
+// caller holds mutex
+func (store *memoryStore) find(uuid string) (entry *memoryEntry, ok bool) {
+	entry, ok = store.entries[uuid]
+	if ok && entry.expired(time.Now()) {
+		delete(store.entries, uuid)
+		entry, ok = nil, false
+	}
+	return
+}
+
+func (store *memoryStore) Get(uuid string, sess *models.Session) (err error) {
+	store.mutex.Lock()
+	entry, ok := store.find(uuid)
+	store.mutex.Unlock()
+	if !ok {
+		err = ErrNotFound
+		return
+	}
+	err = json.Unmarshal(entry.bytes, sess)
+	return
+}
+
+func (store *memoryStore) Set(sess *models.Session) (err error) {
+	bytes, err := json.Marshal(sess)
+	if err != nil {
+		return
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	entry, ok := store.find(sess.UuId)
+	if !ok {
+		err = ErrNotFound
+		return
+	}
+	// Get reads bytes of an entry without mutex, so entry is replaced
+	store.entries[sess.UuId] = &memoryEntry{
+		bytes:     bytes,
+		expiresAt: entry.expiresAt,
+	}
+	return
+}
+
+func (store *memoryStore) SetWithTTL(
+	sess *models.Session,
+	ttl time.Duration,
+) (err error) {
+	bytes, err := json.Marshal(sess)
+	if err != nil {
+		return
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.entries[sess.UuId] = &memoryEntry{
+		bytes:     bytes,
+		expiresAt: time.Now().Add(ttl),
+	}
+	return
+}
+
+func (store *memoryStore) Touch(uuid string, ttl time.Duration) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	entry, ok := store.find(uuid)
+	if !ok {
+		return ErrNotFound
+	}
+	store.entries[uuid] = &memoryEntry{
+		bytes:     entry.bytes,
+		expiresAt: time.Now().Add(ttl),
+	}
+	return nil
+}
+
+func (store *memoryStore) Delete(uuid string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	delete(store.entries, uuid)
+	return nil
+}
+
+func (store *memoryStore) Close() error {
+	store.once.Do(func() {
+		close(store.done)
+	})
+	return nil
+}
+
+type memoryHits struct {
+	hits   []time.Time
+	window time.Duration
+}
+
+// caller holds mutex
+func (entry *memoryHits) prune(now time.Time) {
+	from := now.Add(-entry.window)
+	i := 0
+	for i < len(entry.hits) && !entry.hits[i].After(from) {
+		i++
+	}
+	entry.hits = entry.hits[i:]
+}
+
+// hits are lost when process exits, not shared between processes
+type memoryLimiter struct {
+	mutex   sync.Mutex
+	entries map[string]*memoryHits
+	done    chan struct{}
+	once    sync.Once
+}
+
+func NewMemoryLimiter() Limiter {
+	limiter := &memoryLimiter{
+		entries: make(map[string]*memoryHits),
+		done:    make(chan struct{}),
+	}
+	go limiter.sweep()
+	return limiter
+}
+
+// removes keys without hits in their window
+func (limiter *memoryLimiter) sweep() {
+	ticker := time.NewTicker(memorySweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			limiter.mutex.Lock()
+			for key, entry := range limiter.entries {
+				entry.prune(now)
+				if len(entry.hits) == 0 {
+					delete(limiter.entries, key)
+				}
+			}
+			limiter.mutex.Unlock()
+		case <-limiter.done:
+			return
+		}
+	}
+}
+
+func (limiter *memoryLimiter) Hit(key string, window time.Duration) error {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	now := time.Now()
+	entry, ok := limiter.entries[key]
+	if !ok {
+		entry = &memoryHits{}
+		limiter.entries[key] = entry
+	}
+	entry.window = window
+	entry.prune(now)
+	entry.hits = append(entry.hits, now)
+	return nil
+}
+
+func (limiter *memoryLimiter) Peek(key string, window time.Duration,
+) (hits Hits, err error) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	entry, ok := limiter.entries[key]
+	if !ok {
+		return
+	}
+	from := time.Now().Add(-window)
+	for _, hit := range entry.hits {
+		if hit.After(from) {
+			hits.Count++
+			hits.Last = hit
+		}
+	}
+	return
+}
+
+func (limiter *memoryLimiter) Reset(key string) error {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	delete(limiter.entries, key)
+	return nil
+}
+
+func (limiter *memoryLimiter) ResetPrefix(prefix string) error {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	for key := range limiter.entries {
+		if strings.HasPrefix(key, prefix) {
+			delete(limiter.entries, key)
+		}
+	}
+	return nil
+}
+
+func (limiter *memoryLimiter) Close() error {
+	limiter.once.Do(func() {
+		close(limiter.done)
+	})
+	return nil
+}
@@ -0,0 +1,184 @@
+package session
+
+import (
+	"errors"
+	"learning-web-chatboard4/common/models"
+	"testing"
+	"time"
+)
+
+func TestMemoryStore(t *testing.T) {
+	store := NewMemoryStore()
+	defer store.Close()
+
+	sess := &models.Session{UuId: "uuid", UserName: "alice"}
+	err := store.Set(sess)
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Set of missing session: err = %v, want %v", err, ErrNotFound)
+	}
+
+	if err = store.SetWithTTL(sess, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	sess.UserName = "bob"
+	if err = store.Set(sess); err != nil {
+		t.Fatal(err)
+	}
+	got := &models.Session{}
+	if err = store.Get("uuid", got); err != nil {
+		t.Fatal(err)
+	}
+	if got.UserName != "bob" {
+		t.Errorf("user name = %q, want %q", got.UserName, "bob")
+	}
+
+	if err = store.Delete("uuid"); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Get("uuid", got); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get after Delete: err = %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestMemoryStoreExpiry(t *testing.T) {
+	store := NewMemoryStore()
+	defer store.Close()
+
+	sess := &models.Session{UuId: "uuid"}
+	if err := store.SetWithTTL(sess, time.Millisecond*50); err != nil {
+		t.Fatal(err)
+	}
+	// Set keeps remaining ttl
+	if err := store.Set(sess); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 100)
+
+	if err := store.Get("uuid", &models.Session{}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get of expired session: err = %v, want %v", err, ErrNotFound)
+	}
+	if err := store.Set(sess); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Set of expired session: err = %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestMemoryLimiter(t *testing.T) {
+	limiter := NewMemoryLimiter()
+	defer limiter.Close()
+
+	hits, err := limiter.Peek("key", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hits.Count != 0 || !hits.Last.IsZero() {
+		t.Errorf("hits of unknown key = %+v, want none", hits)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err = limiter.Hit("key", time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// peek records nothing
+	for i := 0; i < 2; i++ {
+		hits, err = limiter.Peek("key", time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hits.Count != 3 {
+			t.Errorf("count = %d, want 3", hits.Count)
+		}
+	}
+	if time.Since(hits.Last) > time.Second {
+		t.Errorf("last = %v, want now", hits.Last)
+	}
+
+	if err = limiter.Reset("key"); err != nil {
+		t.Fatal(err)
+	}
+	hits, err = limiter.Peek("key", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hits.Count != 0 {
+		t.Errorf("count after Reset = %d, want 0", hits.Count)
+	}
+}
+
+func TestMemoryLimiterWindow(t *testing.T) {
+	limiter := NewMemoryLimiter()
+	defer limiter.Close()
+
+	window := time.Millisecond * 100
+	if err := limiter.Hit("key", window); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(window)
+	if err := limiter.Hit("key", window); err != nil {
+		t.Fatal(err)
+	}
+
+	hits, err := limiter.Peek("key", window)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hits.Count != 1 {
+		t.Errorf("count = %d, want 1 within window", hits.Count)
+	}
+}
+
+func TestMemoryLimiterResetPrefix(t *testing.T) {
+	limiter := NewMemoryLimiter()
+	defer limiter.Close()
+
+	keys := []string{
+		"pair:a@example.com|192.0.2.1",
+		"pair:a@example.com|192.0.2.2",
+		// other email which is prefix of the email
+		"pair:a@example.co|192.0.2.1",
+	}
+	for _, key := range keys {
+		if err := limiter.Hit(key, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := limiter.ResetPrefix("pair:a@example.com|"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, key := range keys {
+		hits, err := limiter.Peek(key, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := 0
+		if i == 2 {
+			want = 1
+		}
+		if hits.Count != want {
+			t.Errorf("count of %s = %d, want %d", key, hits.Count, want)
+		}
+	}
+}
+
+func TestMemoryStoreTouch(t *testing.T) {
+	store := NewMemoryStore()
+	defer store.Close()
+
+	if err := store.Touch("uuid", time.Hour); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Touch of missing session: err = %v, want %v", err, ErrNotFound)
+	}
+
+	sess := &models.Session{UuId: "uuid"}
+	if err := store.SetWithTTL(sess, time.Millisecond*50); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Touch("uuid", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 100)
+
+	if err := store.Get("uuid", &models.Session{}); err != nil {
+		t.Errorf("Get of touched session: %v", err)
+	}
+}
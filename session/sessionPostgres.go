@@ -0,0 +1,275 @@
+package session
+
+import (
+	"encoding/json"
+	"learning-web-chatboard4/common"
+	"learning-web-chatboard4/common/models"
+	"sync"
+	"time"
+
+	"xorm.io/xorm"
+)
+
+const (
+	sessionsTable         = "sessions"
+	postgresSweepInterval = time.Minute * 5
+)
+
+// sessions table in setup_db.sql, expired rows are deleted periodically
+type postgresStore struct {
+	dbEngine *xorm.Engine
+	done     chan struct{}
+	once     sync.Once
+}
+
+func NewPostgresStore(dbName string, showSQL bool) (store Store, err error) {
+	dbEngine, err := common.OpenDb(dbName, showSQL, 0)
+	if err != nil {
+		return
+	}
+	err = dbEngine.Ping()
+	if err != nil {
+		dbEngine.Close()
+		return
+	}
+
+	pgStore := &postgresStore{
+		dbEngine: dbEngine,
+		done:     make(chan struct{}),
+	}
+	go pgStore.sweep()
+	store = pgStore
+	return
+}
+
+func (store *postgresStore) sweep() {
+	ticker := time.NewTicker(postgresSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			_, err := store.dbEngine.Exec(
+				"DELETE FROM "+sessionsTable+" WHERE expires_at <= $1",
+				now,
+			)
+			if err != nil {
+				sessionMaker.logger.Println(err.Error())
+			}
+		case <-store.done:
+			return
+		}
+	}
+}
+
+func (store *postgresStore) Get(uuid string, sess *models.Session) (err error) {
+	var data string
+	ok, err := store.dbEngine.
+		SQL(
+			"SELECT data FROM "+sessionsTable+
+				" WHERE uu_id = $1 AND (expires_at IS NULL OR expires_at > $2)",
+			uuid,
+			time.Now(),
+		).
+		Get(&data)
+	if err != nil {
+		return
+	}
+	if !ok {
+		err = ErrNotFound
+		return
+	}
+	err = json.Unmarshal([]byte(data), sess)
+	return
+}
+
+func (store *postgresStore) Set(sess *models.Session) (err error) {
+	bytes, err := json.Marshal(sess)
+	if err != nil {
+		return
+	}
+	result, err := store.dbEngine.Exec(
+		"UPDATE "+sessionsTable+" SET data = $1"+
+			" WHERE uu_id = $2 AND (expires_at IS NULL OR expires_at > $3)",
+		string(bytes),
+		sess.UuId,
+		time.Now(),
+	)
+	if err != nil {
+		return
+	}
+	affected, err := result.RowsAffected()
+	if err == nil && affected == 0 {
+		err = ErrNotFound
+	}
+	return
+}
+
+func (store *postgresStore) SetWithTTL(
+	sess *models.Session,
+	ttl time.Duration,
+) (err error) {
+	bytes, err := json.Marshal(sess)
+	if err != nil {
+		return
+	}
+	_, err = store.dbEngine.Exec(
+		"INSERT INTO "+sessionsTable+" (uu_id, data, expires_at) VALUES ($1, $2, $3)"+
+			" ON CONFLICT (uu_id) DO UPDATE"+
+			" SET data = EXCLUDED.data, expires_at = EXCLUDED.expires_at",
+		sess.UuId,
+		string(bytes),
+		time.Now().Add(ttl),
+	)
+	return
+}
+
+func (store *postgresStore) Touch(uuid string, ttl time.Duration) (err error) {
+	now := time.Now()
+	result, err := store.dbEngine.Exec(
+		"UPDATE "+sessionsTable+" SET expires_at = $1"+
+			" WHERE uu_id = $2 AND (expires_at IS NULL OR expires_at > $3)",
+		now.Add(ttl),
+		uuid,
+		now,
+	)
+	if err != nil {
+		return
+	}
+	affected, err := result.RowsAffected()
+	if err == nil && affected == 0 {
+		err = ErrNotFound
+	}
+	return
+}
+
+func (store *postgresStore) Delete(uuid string) (err error) {
+	_, err = store.dbEngine.Exec(
+		"DELETE FROM "+sessionsTable+" WHERE uu_id = $1",
+		uuid,
+	)
+	return
+}
+
+func (store *postgresStore) Close() error {
+	store.once.Do(func() {
+		close(store.done)
+	})
+	return store.dbEngine.Close()
+}
+
+const (
+	limiterHitsTable = "limiter_hits"
+	// rows of keys not hit for this long are swept
+	limiterMaxWindow = time.Hour * 24
+)
+
+type limiterHit struct {
+	Key   string    `xorm:"not null 'key'"`
+	HitAt time.Time `xorm:"not null 'hit_at'"`
+}
+
+// limiter_hits table in setup_db.sql, a row per hit
+type postgresLimiter struct {
+	dbEngine *xorm.Engine
+	done     chan struct{}
+	once     sync.Once
+}
+
+func NewPostgresLimiter(dbName string) (limiter Limiter, err error) {
+	dbEngine, err := common.OpenDb(dbName, false, 0)
+	if err != nil {
+		return
+	}
+	err = dbEngine.Ping()
+	if err != nil {
+		dbEngine.Close()
+		return
+	}
+
+	pgLimiter := &postgresLimiter{
+		dbEngine: dbEngine,
+		done:     make(chan struct{}),
+	}
+	go pgLimiter.sweep()
+	limiter = pgLimiter
+	return
+}
+
+func (limiter *postgresLimiter) sweep() {
+	ticker := time.NewTicker(postgresSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			_, err := limiter.dbEngine.Exec(
+				"DELETE FROM "+limiterHitsTable+" WHERE hit_at <= $1",
+				now.Add(-limiterMaxWindow),
+			)
+			if err != nil {
+				sessionLogger().Println(err.Error())
+			}
+		case <-limiter.done:
+			return
+		}
+	}
+}
+
+func (limiter *postgresLimiter) Hit(key string, window time.Duration) (err error) {
+	now := time.Now()
+	_, err = limiter.dbEngine.Exec(
+		"DELETE FROM "+limiterHitsTable+" WHERE key = $1 AND hit_at <= $2",
+		key,
+		now.Add(-window),
+	)
+	if err != nil {
+		return
+	}
+	_, err = limiter.dbEngine.
+		Table(limiterHitsTable).
+		InsertOne(&limiterHit{
+			Key:   key,
+			HitAt: now,
+		})
+	return
+}
+
+func (limiter *postgresLimiter) Peek(key string, window time.Duration,
+) (hits Hits, err error) {
+	var found []limiterHit
+	err = limiter.dbEngine.
+		Table(limiterHitsTable).
+		Where("key = ? AND hit_at > ?", key, time.Now().Add(-window)).
+		Asc("hit_at").
+		Find(&found)
+	if err != nil || len(found) == 0 {
+		return
+	}
+	hits.Count = len(found)
+	hits.Last = found[len(found)-1].HitAt
+	return
+}
+
+func (limiter *postgresLimiter) Reset(key string) (err error) {
+	_, err = limiter.dbEngine.Exec(
+		"DELETE FROM "+limiterHitsTable+" WHERE key = $1",
+		key,
+	)
+	return
+}
+
+func (limiter *postgresLimiter) ResetPrefix(prefix string) (err error) {
+	_, err = limiter.dbEngine.Exec(
+		"DELETE FROM "+limiterHitsTable+" WHERE left(key, char_length($1)) = $1",
+		prefix,
+	)
+	return
+}
+
+func (limiter *postgresLimiter) Close() error {
+	limiter.once.Do(func() {
+		close(limiter.done)
+	})
+	return limiter.dbEngine.Close()
+}
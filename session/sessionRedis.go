@@ -2,92 +2,318 @@ package session
 
 import (
 	"encoding/json"
+	"errors"
+	"learning-web-chatboard4/common"
 	"learning-web-chatboard4/common/models"
+	"os"
+	"strconv"
 	"time"
 
 	"github.com/gomodule/redigo/redis"
 )
 
 const (
-	redisConnectionKind = "tcp"
-	redisAddress        = "localhost:6379"
+	redisConnectionKind  = "tcp"
+	redisDefaultAddress  = "localhost:6379"
+	redisDefaultMaxIdle  = 8
+	redisDefaultIdleTime = time.Minute * 5
+	redisDialTimeout     = time.Second * 5
+	redisIOTimeout       = time.Second * 3
+	// idle connections older than this are pinged before use
+	redisTestAfter = time.Minute
+	// same with DBPASS for postgres, password is not in config file
+	RedisPasswordEnv = "REDISPASS"
 )
 
-// store session with expiration
-func SetToRedisWithExpiration(sess *models.Session) (err error) {
-	sess.LastUpdate = time.Now()
-	bytes, err := json.Marshal(sess)
+// zero values are replaced with defaults,
+// MaxActive 0 means no limit
+type RedisOptions struct {
+	Address     string
+	DB          int
+	MaxIdle     int
+	MaxActive   int
+	IdleTimeout time.Duration
+}
+
+type redisStore struct {
+	pool    *redis.Pool
+	showLog bool
+}
+
+func newRedisPool(options RedisOptions) *redis.Pool {
+	if len(options.Address) == 0 {
+		options.Address = redisDefaultAddress
+	}
+	if options.MaxIdle <= 0 {
+		options.MaxIdle = redisDefaultMaxIdle
+	}
+	if options.IdleTimeout <= 0 {
+		options.IdleTimeout = redisDefaultIdleTime
+	}
+	password := os.Getenv(RedisPasswordEnv)
+
+	return &redis.Pool{
+		MaxIdle:     options.MaxIdle,
+		MaxActive:   options.MaxActive,
+		IdleTimeout: options.IdleTimeout,
+		// wait for a connection instead of failing under load
+		Wait: true,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial(
+				redisConnectionKind,
+				options.Address,
+				redis.DialPassword(password),
+				redis.DialDatabase(options.DB),
+				redis.DialConnectTimeout(redisDialTimeout),
+				redis.DialReadTimeout(redisIOTimeout),
+				redis.DialWriteTimeout(redisIOTimeout),
+			)
+		},
+		// broken connections after redis restarts are dropped here
+		TestOnBorrow: func(conn redis.Conn, lastUsed time.Time) error {
+			if time.Since(lastUsed) < redisTestAfter {
+				return nil
+			}
+			_, err := conn.Do("PING")
+			return err
+		},
+	}
+}
+
+// Set uses KEEPTTL, needs redis 6 or later
+func NewRedisStore(options RedisOptions, showLog bool) (store Store, err error) {
+	pool := newRedisPool(options)
+
+	// fail fast when redis is not there
+	conn := pool.Get()
+	defer conn.Close()
+	_, err = conn.Do("PING")
 	if err != nil {
+		pool.Close()
 		return
 	}
-	r, err := sessionMaker.redisConn.Do(
-		"SETEX",
-		sess.UuId,
-		sessionExpSec,
-		bytes,
-	)
-	if err != nil {
+
+	store = &redisStore{
+		pool:    pool,
+		showLog: showLog,
+	}
+	return
+}
+
+func (store *redisStore) do(
+	commandName string,
+	args ...interface{},
+) (reply interface{}, err error) {
+	conn := store.pool.Get()
+	defer conn.Close()
+
+	reply, err = conn.Do(commandName, args...)
+	if err == nil && store.showLog {
+		sessionMaker.logger.Printf("%s: %v\n", commandName, reply)
+	}
+	return
+}
+
+func (store *redisStore) Get(uuid string, sess *models.Session) (err error) {
+	bytes, err := redis.Bytes(store.do("GET", uuid))
+	if errors.Is(err, redis.ErrNil) {
+		err = ErrNotFound
 		return
 	}
-	if sessionMaker.showRedisLog {
-		sessionMaker.logger.Printf("SETEX: %v\n", r)
+	if err != nil {
+		return
 	}
+	err = json.Unmarshal(bytes, sess)
 	return
 }
 
-func SetToRedis(sess *models.Session) (err error) {
-	sess.LastUpdate = time.Now()
+func (store *redisStore) Set(sess *models.Session) (err error) {
 	bytes, err := json.Marshal(sess)
 	if err != nil {
 		return
 	}
-	r, err := sessionMaker.redisConn.Do(
-		"SET",
-		sess.UuId,
-		bytes,
-	)
+	// XX doesn't create a key without ttl for expired session
+	reply, err := store.do("SET", sess.UuId, bytes, "XX", "KEEPTTL")
+	if err == nil && reply == nil {
+		err = ErrNotFound
+	}
+	return
+}
+
+func (store *redisStore) SetWithTTL(
+	sess *models.Session,
+	ttl time.Duration,
+) (err error) {
+	bytes, err := json.Marshal(sess)
 	if err != nil {
 		return
 	}
-	if sessionMaker.showRedisLog {
-		sessionMaker.logger.Printf("SET %v\n", r)
+	_, err = store.do("SET", sess.UuId, bytes, "PX", ttl.Milliseconds())
+	return
+}
+
+func (store *redisStore) Touch(uuid string, ttl time.Duration) (err error) {
+	r, err := redis.Int64(store.do("PEXPIRE", uuid, ttl.Milliseconds()))
+	if err == nil && r == 0 {
+		err = ErrNotFound
 	}
 	return
 }
 
-func ConfirmExistsFromRedis(uuid string) (exists bool, err error) {
-	var r int64 = 0
-	r, err = redis.Int64(
-		sessionMaker.redisConn.Do("EXISTS", uuid),
-	)
-	exists = r == 1
+func (store *redisStore) Delete(uuid string) (err error) {
+	_, err = store.do("DEL", uuid)
 	return
 }
 
-func GetFromRedis(uuid string, sess *models.Session) (err error) {
-	bytes, err := redis.Bytes(
-		sessionMaker.redisConn.Do("GET", uuid),
-	)
+func (store *redisStore) Close() error {
+	return store.pool.Close()
+}
+
+// keys of limiter are kept apart from session uuids
+const limiterPrefix = "limiter:"
+
+// sorted set per key, scored by unix milliseconds of hits
+type redisLimiter struct {
+	pool *redis.Pool
+}
+
+func NewRedisLimiter(options RedisOptions) (limiter Limiter, err error) {
+	pool := newRedisPool(options)
+
+	conn := pool.Get()
+	defer conn.Close()
+	_, err = conn.Do("PING")
 	if err != nil {
+		pool.Close()
 		return
 	}
-	err = json.Unmarshal(bytes, sess)
+
+	limiter = &redisLimiter{pool: pool}
+	return
+}
+
+// commands are run in one transaction, returns replies of them
+func (limiter *redisLimiter) transaction(
+	commands [][]interface{},
+) (replies []interface{}, err error) {
+	conn := limiter.pool.Get()
+	defer conn.Close()
+
+	err = conn.Send("MULTI")
 	if err != nil {
 		return
 	}
-	if sessionMaker.showRedisLog {
-		sessionMaker.logger.Println(*sess)
+	for _, command := range commands {
+		err = conn.Send(command[0].(string), command[1:]...)
+		if err != nil {
+			return
+		}
 	}
+	replies, err = redis.Values(conn.Do("EXEC"))
+	return
+}
+
+func (limiter *redisLimiter) Hit(key string, window time.Duration) (err error) {
+	now := time.Now()
+	// member has to be unique for hits in the same millisecond
+	random, err := common.GenerateRandomString(8)
+	if err != nil {
+		return
+	}
+	member := strconv.FormatInt(now.UnixNano(), 10) + ":" + random
+
+	key = limiterPrefix + key
+	_, err = limiter.transaction([][]interface{}{
+		{"ZREMRANGEBYSCORE", key, "-inf", now.Add(-window).UnixMilli()},
+		{"ZADD", key, now.UnixMilli(), member},
+		{"PEXPIRE", key, window.Milliseconds()},
+	})
 	return
 }
 
-func DelFromRedis(unique string) (err error) {
-	r, err := sessionMaker.redisConn.Do("DEL", unique)
+func (limiter *redisLimiter) Peek(key string, window time.Duration,
+) (hits Hits, err error) {
+	key = limiterPrefix + key
+	from := time.Now().Add(-window).UnixMilli()
+	replies, err := limiter.transaction([][]interface{}{
+		{"ZCOUNT", key, "(" + strconv.FormatInt(from, 10), "+inf"},
+		{"ZRANGE", key, -1, -1, "WITHSCORES"},
+	})
 	if err != nil {
 		return
 	}
-	if sessionMaker.showRedisLog {
-		sessionMaker.logger.Printf("DEL %v\n", r)
+
+	count, err := redis.Int(replies[0], nil)
+	if err != nil || count == 0 {
+		return
+	}
+	last, err := redis.Int64Map(replies[1], nil)
+	if err != nil {
+		return
 	}
+	hits.Count = count
+	for _, milli := range last {
+		hits.Last = time.UnixMilli(milli)
+	}
+	return
+}
+
+func (limiter *redisLimiter) Reset(key string) (err error) {
+	conn := limiter.pool.Get()
+	defer conn.Close()
+	_, err = conn.Do("DEL", limiterPrefix+key)
 	return
 }
+
+// keys are scanned, so keys hit while scanning may be left
+func (limiter *redisLimiter) ResetPrefix(prefix string) (err error) {
+	conn := limiter.pool.Get()
+	defer conn.Close()
+
+	pattern := escapeGlob(limiterPrefix+prefix) + "*"
+	cursor := "0"
+	for {
+		var replies []interface{}
+		replies, err = redis.Values(
+			conn.Do("SCAN", cursor, "MATCH", pattern, "COUNT", 100),
+		)
+		if err != nil {
+			return
+		}
+		cursor, err = redis.String(replies[0], nil)
+		if err != nil {
+			return
+		}
+		var keys []string
+		keys, err = redis.Strings(replies[1], nil)
+		if err != nil {
+			return
+		}
+		if len(keys) > 0 {
+			_, err = conn.Do("DEL", redis.Args{}.AddFlat(keys)...)
+			if err != nil {
+				return
+			}
+		}
+		if cursor == "0" {
+			return
+		}
+	}
+}
+
+// MATCH pattern which matches s literally
+func escapeGlob(s string) string {
+	escaped := make([]rune, 0, len(s))
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			escaped = append(escaped, '\\')
+		}
+		escaped = append(escaped, r)
+	}
+	return string(escaped)
+}
+
+func (limiter *redisLimiter) Close() error {
+	return limiter.pool.Close()
+}
@@ -0,0 +1,100 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+	"learning-web-chatboard4/common/models"
+	"log"
+	"time"
+)
+
+// kinds of store in config.json
+const (
+	StoreKindRedis    = "redis"
+	StoreKindMemory   = "memory"
+	StoreKindPostgres = "postgres"
+)
+
+var ErrNotFound = errors.New("session not found")
+
+type StoreOptions struct {
+	// one of StoreKind*, empty is redis
+	Kind string
+	// for postgres
+	DbName string
+	Redis  RedisOptions
+}
+
+// Store keeps sessions by uuid. implementations are safe for concurrent use
+type Store interface {
+	// returns ErrNotFound when session does not exist or expired
+	Get(uuid string, sess *models.Session) error
+	// keeps remaining ttl of the stored session,
+	// returns ErrNotFound when session does not exist or expired
+	Set(sess *models.Session) error
+	SetWithTTL(sess *models.Session, ttl time.Duration) error
+	// resets ttl, returns ErrNotFound when session does not exist or expired
+	Touch(uuid string, ttl time.Duration) error
+	Delete(uuid string) error
+	Close() error
+}
+
+// StartSessionMaker should be called before, for logging
+func OpenStore(options StoreOptions, showLog bool) (store Store, err error) {
+	switch options.Kind {
+	case "", StoreKindRedis:
+		store, err = NewRedisStore(options.Redis, showLog)
+	case StoreKindMemory:
+		store = NewMemoryStore()
+	case StoreKindPostgres:
+		store, err = NewPostgresStore(options.DbName, showLog)
+	default:
+		err = fmt.Errorf("unknown session store: %s", options.Kind)
+	}
+	return
+}
+
+// Hits are hits of a key within a sliding window
+type Hits struct {
+	Count int
+	// zero when Count is 0
+	Last time.Time
+}
+
+// Limiter counts hits by key in sliding windows, for throttling.
+// implementations are safe for concurrent use
+type Limiter interface {
+	// records a hit now, hits older than window are forgotten
+	Hit(key string, window time.Duration) error
+	// hits within window, nothing is recorded
+	Peek(key string, window time.Duration) (Hits, error)
+	// forgets every hit of key
+	Reset(key string) error
+	// forgets every hit of keys starting with prefix
+	ResetPrefix(prefix string) error
+	Close() error
+}
+
+// same kinds with OpenStore, redis keys have limiterPrefix.
+// services which don't start session maker can use this
+func OpenLimiter(options StoreOptions) (limiter Limiter, err error) {
+	switch options.Kind {
+	case "", StoreKindRedis:
+		limiter, err = NewRedisLimiter(options.Redis)
+	case StoreKindMemory:
+		limiter = NewMemoryLimiter()
+	case StoreKindPostgres:
+		limiter, err = NewPostgresLimiter(options.DbName)
+	default:
+		err = fmt.Errorf("unknown session store: %s", options.Kind)
+	}
+	return
+}
+
+// sessionMaker logger is nil when it is not started
+func sessionLogger() *log.Logger {
+	if sessionMaker.logger == nil {
+		return log.Default()
+	}
+	return sessionMaker.logger
+}
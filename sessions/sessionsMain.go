@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"learning-web-chatboard4/common"
+	"learning-web-chatboard4/rabbitrpc"
+	"learning-web-chatboard4/session"
+	"log"
+	"time"
+)
+
+var store session.Store
+var config *common.Configuration
+var logger *log.Logger
+var server *rabbitrpc.RabbitClient
+var rpcRouter *rabbitrpc.Router
+
+func main() {
+	var err error
+
+	// config
+	config, err = common.LoadConfig()
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+
+	//log
+	logger, err = common.OpenLogger(
+		config.LogToFile,
+		config.LogFileNameSessions,
+	)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	// keys for state mac
+	err = session.StartSessionMaker(
+		config.UseSecureCookie,
+		config.SetHttpOnlyCookie,
+		config.CookieKeysFile,
+	)
+	if err != nil {
+		common.LogError(logger).Fatalln(err.Error())
+	}
+
+	//store
+	store, err = session.OpenStore(
+		session.StoreOptions{
+			Kind:   config.SessionStore,
+			DbName: config.DbName,
+			Redis: session.RedisOptions{
+				Address:     config.RedisAddress,
+				DB:          config.RedisDB,
+				MaxIdle:     config.RedisMaxIdle,
+				MaxActive:   config.RedisMaxActive,
+				IdleTimeout: time.Duration(config.RedisIdleTimeout) * time.Second,
+			},
+		},
+		config.ShowSQL,
+	)
+	if err != nil {
+		common.LogError(logger).Fatalln(err.Error())
+	}
+
+	//rabbit
+	err = registerFunctions()
+	if err != nil {
+		common.LogError(logger).Fatalln(err.Error())
+	}
+	server = rabbitrpc.NewRPCServer(
+		rabbitrpc.DefaultRabbitURL,
+		config.SessionsResQName,
+		config.SessionsReqQName,
+		config.SessionsExchangeName,
+		rabbitrpc.ExchangeKindDirect,
+		config.SessionsClientKey,
+		config.SessionsServerKey,
+		onRequestReceived,
+	)
+
+	shutdownCTX, stop := common.NotifyShutdown()
+	defer stop()
+	<-shutdownCTX.Done()
+	shutdown()
+}
+
+func shutdown() {
+	common.LogInfo(logger).Println("shutting down...")
+	ctx, cancel := context.WithTimeout(
+		context.Background(),
+		common.ShutdownTimeout,
+	)
+	defer cancel()
+
+	err := rpcRouter.Shutdown(ctx, server)
+	if err != nil {
+		common.LogWarning(logger).Println(err.Error())
+	}
+	err = store.Close()
+	if err != nil {
+		common.LogWarning(logger).Println(err.Error())
+	}
+	common.LogInfo(logger).Println("bye")
+}
+
+func onRequestReceived(raws rabbitrpc.Raws) {
+	rpcRouter.Dispatch(server, raws)
+}
+
+func registerFunctions() error {
+	rpcRouter = rabbitrpc.NewRouter(func(err error) {
+		common.LogError(logger).Println(err.Error())
+	})
+
+	rabbitrpc.Register(rpcRouter, "createSession", createSession)
+	rabbitrpc.Register(rpcRouter, "readSession", readSession)
+	rabbitrpc.Register(rpcRouter, "updateSession", updateSession)
+	rabbitrpc.Register(rpcRouter, "renewSession", renewSession)
+	rabbitrpc.Register(rpcRouter, "deleteSession", deleteSession)
+	rabbitrpc.Register(rpcRouter, "generateState", generateState)
+	rabbitrpc.Register(rpcRouter, "consumeState", consumeState)
+
+	return rpcRouter.Check()
+}
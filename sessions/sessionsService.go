@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"learning-web-chatboard4/common"
+	"learning-web-chatboard4/common/models"
+	"learning-web-chatboard4/rabbitrpc"
+	"learning-web-chatboard4/session"
+	"time"
+)
+
+// new empty session
+func createSession(ctx context.Context, _ *models.Session) (*models.Session, error) {
+	sess := session.NewSession()
+	err := setWithExpirationInternal(sess)
+	if err != nil {
+		return nil, err
+	}
+
+	return sess, nil
+}
+
+// session is read for every request, so ttl restarts
+func readSession(ctx context.Context, sess *models.Session) (*models.Session, error) {
+	err := readSessionInternal(sess)
+	if err != nil {
+		return nil, err
+	}
+	err = touchInternal(sess.UuId)
+	if err != nil {
+		return nil, err
+	}
+
+	return sess, nil
+}
+
+func readSessionInternal(sess *models.Session) (err error) {
+	if common.IsEmpty(sess.UuId) {
+		err = rabbitrpc.NewError(
+			rabbitrpc.CodeInvalidArgument,
+			"need uuid for finding session",
+		)
+		return
+	}
+	err = store.Get(sess.UuId, sess)
+	if errors.Is(err, session.ErrNotFound) {
+		err = rabbitrpc.NewError(rabbitrpc.CodeNotFound, "no such session")
+	}
+	return
+}
+
+func updateSession(ctx context.Context, sess *models.Session) (*models.Session, error) {
+	err := updateSessionInternal(sess)
+	if err != nil {
+		return nil, err
+	}
+
+	return sess, nil
+}
+
+// state is only changed by generateState and consumeState
+func updateSessionInternal(sess *models.Session) (err error) {
+	stored := &models.Session{UuId: sess.UuId}
+	err = readSessionInternal(stored)
+	if err != nil {
+		return
+	}
+
+	sess.State = stored.State
+	sess.CreatedAt = stored.CreatedAt
+	err = setInternal(sess)
+	return
+}
+
+// starts new session with user info in sess,
+// old session of sess.UuId is deleted
+func renewSession(ctx context.Context, sess *models.Session) (*models.Session, error) {
+	err := renewSessionInternal(sess)
+	if err != nil {
+		return nil, err
+	}
+
+	return sess, nil
+}
+
+func renewSessionInternal(sess *models.Session) (err error) {
+	if !common.IsEmpty(sess.UuId) {
+		err = store.Delete(sess.UuId)
+		if err != nil {
+			return
+		}
+	}
+
+	renewed := session.NewSession()
+	renewed.Token = sess.Token
+	renewed.RefreshToken = sess.RefreshToken
+	renewed.UserName = sess.UserName
+	renewed.UserEmail = sess.UserEmail
+	renewed.UserId = sess.UserId
+	renewed.UserVerified = sess.UserVerified
+	err = setWithExpirationInternal(renewed)
+	if err != nil {
+		return
+	}
+	*sess = *renewed
+	return
+}
+
+func deleteSession(ctx context.Context, sess *models.Session) (*models.Session, error) {
+	if common.IsEmpty(sess.UuId) {
+		return nil, rabbitrpc.NewError(
+			rabbitrpc.CodeInvalidArgument,
+			"need uuid for deleting session",
+		)
+	}
+	err := store.Delete(sess.UuId)
+	if err != nil {
+		return nil, err
+	}
+
+	return sess, nil
+}
+
+// returns state exposed to browser as message
+func generateState(ctx context.Context, sess *models.Session) (*common.SimpleMessage, error) {
+	exposed, err := generateStateInternal(sess)
+	if err != nil {
+		return nil, err
+	}
+
+	return &common.SimpleMessage{Message: exposed}, nil
+}
+
+func generateStateInternal(sess *models.Session) (exposed string, err error) {
+	err = readSessionInternal(sess)
+	if err != nil {
+		return
+	}
+
+	sess.State, exposed, err = session.GenerateState()
+	if err != nil {
+		return
+	}
+	err = setInternal(sess)
+	return
+}
+
+// sess.State is value exposed to browser,
+// state is consumed and session is returned when it is valid
+func consumeState(ctx context.Context, sess *models.Session) (*models.Session, error) {
+	err := consumeStateInternal(sess)
+	if err != nil {
+		return nil, err
+	}
+
+	return sess, nil
+}
+
+func consumeStateInternal(sess *models.Session) (err error) {
+	exposed := sess.State
+	err = readSessionInternal(sess)
+	if err != nil {
+		return
+	}
+
+	err = session.VerifyState(exposed, sess.State)
+	if err != nil {
+		err = rabbitrpc.NewError(
+			rabbitrpc.CodeInvalidArgument,
+			"invalid state",
+		)
+		return
+	}
+
+	// state is consumed, delete it
+	sess.State = ""
+	err = setInternal(sess)
+	return
+}
+
+// session may expire after it is read
+func setInternal(sess *models.Session) (err error) {
+	sess.LastUpdate = time.Now()
+	err = store.Set(sess)
+	if errors.Is(err, session.ErrNotFound) {
+		err = rabbitrpc.NewError(rabbitrpc.CodeNotFound, "no such session")
+	}
+	return
+}
+
+func touchInternal(uuid string) (err error) {
+	err = store.Touch(uuid, session.SessionExp)
+	if errors.Is(err, session.ErrNotFound) {
+		err = rabbitrpc.NewError(rabbitrpc.CodeNotFound, "no such session")
+	}
+	return
+}
+
+func setWithExpirationInternal(sess *models.Session) error {
+	sess.LastUpdate = time.Now()
+	return store.SetWithTTL(sess, session.SessionExp)
+}
@@ -1,3 +1,11 @@
+DROP TABLE logins;
+DROP TABLE reports;
+DROP TABLE revoked_tokens;
+DROP TABLE refresh_tokens;
+DROP TABLE recovery_codes;
+DROP TABLE password_resets;
+DROP TABLE limiter_hits;
+DROP TABLE sessions;
 DROP TABLE replies;
 DROP TABLE topics;
 DROP TABLE users;
@@ -8,11 +16,18 @@ CREATE TABLE users (
   name       VARCHAR(255) NOT NULL UNIQUE,
   email      VARCHAR(255) NOT NULL UNIQUE,
   password   TEXT NOT NULL,
-  salt       VARCHAR(255) NOT NULL,
   num_errors SERIAL,
   token      TEXT,
   locked     SERIAL,
   locked_at  TIMESTAMP NOT NULL,
+  role       VARCHAR(32) NOT NULL DEFAULT 'member',
+  verified_at          TIMESTAMP,
+  verification_sent_at TIMESTAMP,
+  totp_secret          VARCHAR(64),
+  totp_enabled_at      TIMESTAMP,
+  totp_num_errors      INTEGER NOT NULL DEFAULT 0,
+  totp_last_step       BIGINT NOT NULL DEFAULT 0,
+  tokens_not_before    TIMESTAMP,
   created_at TIMESTAMP NOT NULL   
 );
 
@@ -24,6 +39,8 @@ CREATE TABLE topics (
   owner       VARCHAR(255),
   user_id     SERIAL REFERENCES users(id),
   last_update TIMESTAMP NOT NULL,
+  edited_at   TIMESTAMP,
+  deleted_at  TIMESTAMP,
   created_at  TIMESTAMP NOT NULL       
 );
 
@@ -34,5 +51,80 @@ CREATE TABLE replies (
   contributor VARCHAR(255),
   user_id     SERIAL REFERENCES users(id),
   topic_id   SERIAL REFERENCES topics(id),
+  edited_at   TIMESTAMP,
+  deleted_at  TIMESTAMP,
   created_at  TIMESTAMP NOT NULL  
 );
+
+CREATE TABLE sessions (
+  uu_id      VARCHAR(255) PRIMARY KEY,
+  data       TEXT NOT NULL,
+  expires_at TIMESTAMP
+);
+
+-- login throttling with postgres session store
+CREATE TABLE limiter_hits (
+  key        VARCHAR(255) NOT NULL,
+  hit_at     TIMESTAMP NOT NULL
+);
+CREATE INDEX limiter_hits_key ON limiter_hits (key, hit_at);
+
+CREATE TABLE password_resets (
+  id         SERIAL PRIMARY KEY,
+  user_id    INTEGER NOT NULL REFERENCES users(id),
+  token_hash VARCHAR(64) NOT NULL UNIQUE,
+  expires_at TIMESTAMP NOT NULL,
+  used_at    TIMESTAMP,
+  created_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE recovery_codes (
+  id         SERIAL PRIMARY KEY,
+  user_id    INTEGER NOT NULL REFERENCES users(id),
+  code_hash  VARCHAR(64) NOT NULL,
+  used_at    TIMESTAMP,
+  created_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE refresh_tokens (
+  id         SERIAL PRIMARY KEY,
+  user_id    INTEGER NOT NULL REFERENCES users(id),
+  token_hash VARCHAR(64) NOT NULL UNIQUE,
+  family     VARCHAR(255) NOT NULL,
+  expires_at TIMESTAMP NOT NULL,
+  used_at    TIMESTAMP,
+  revoked_at TIMESTAMP,
+  created_at TIMESTAMP NOT NULL
+);
+CREATE INDEX refresh_tokens_family ON refresh_tokens (family);
+
+CREATE TABLE revoked_tokens (
+  jti        VARCHAR(255) PRIMARY KEY,
+  expires_at TIMESTAMP NOT NULL,
+  created_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE reports (
+  id           SERIAL PRIMARY KEY,
+  kind         VARCHAR(16) NOT NULL,
+  target_uu_id VARCHAR(255) NOT NULL,
+  user_id      INTEGER NOT NULL REFERENCES users(id),
+  reason       TEXT,
+  resolution   VARCHAR(16),
+  resolved_by  INTEGER,
+  resolved_at  TIMESTAMP,
+  created_at   TIMESTAMP NOT NULL
+);
+CREATE INDEX reports_target ON reports (kind, target_uu_id);
+
+-- user_id is 0 for unknown email
+CREATE TABLE logins (
+  id         SERIAL PRIMARY KEY,
+  user_id    INTEGER NOT NULL DEFAULT 0,
+  email      VARCHAR(255) NOT NULL,
+  result     VARCHAR(32) NOT NULL,
+  ip         VARCHAR(64),
+  user_agent VARCHAR(255),
+  created_at TIMESTAMP NOT NULL
+);
+CREATE INDEX logins_email ON logins (email, id);
@@ -0,0 +1,109 @@
+package totp
+
+// time-based one-time password of RFC 6238,
+// with defaults which authenticator apps expect (sha1, 6 digits, 30 sec)
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	Digits     = 6
+	Period     = time.Second * 30
+	secretSize = 20
+	// steps before and after now, for clock drift
+	skew = 1
+)
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+var ErrInvalidSecret = errors.New("invalid totp secret")
+
+// base32 without padding, same as authenticator apps show
+func GenerateSecret() (secret string, err error) {
+	bytes := make([]byte, secretSize)
+	_, err = rand.Read(bytes)
+	if err != nil {
+		return
+	}
+	secret = encoding.EncodeToString(bytes)
+	return
+}
+
+// otpauth uri for QR codes
+func URI(issuer, account, secret string) string {
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(account)
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(Digits))
+	query.Set("period", fmt.Sprint(int(Period/time.Second)))
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+func StepAt(t time.Time) int64 {
+	return t.Unix() / int64(Period/time.Second)
+}
+
+func CodeAt(secret string, step int64) (code string, err error) {
+	key, err := encoding.DecodeString(strings.ToUpper(secret))
+	if err != nil || len(key) == 0 {
+		err = ErrInvalidSecret
+		return
+	}
+
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+
+	// dynamic truncation of RFC 4226
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < Digits; i++ {
+		mod *= 10
+	}
+	code = fmt.Sprintf("%0*d", Digits, value%mod)
+	return
+}
+
+// Validate checks code around t. step of matched code is returned
+// and should be stored, codes at or before lastStep are refused for replay
+func Validate(
+	secret, code string,
+	t time.Time,
+	lastStep int64,
+) (step int64, ok bool, err error) {
+	if len(code) != Digits {
+		return
+	}
+	now := StepAt(t)
+	for s := now - skew; s <= now+skew; s++ {
+		if s <= lastStep {
+			continue
+		}
+		var expected string
+		expected, err = CodeAt(secret, s)
+		if err != nil {
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			step, ok = s, true
+			return
+		}
+	}
+	return
+}
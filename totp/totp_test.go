@@ -0,0 +1,127 @@
+package totp
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// "12345678901234567890", the sha1 secret of RFC 6238 appendix B
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// last 6 of the 8 digits in RFC 6238 appendix B
+func TestCodeAtRFC6238(t *testing.T) {
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, test := range tests {
+		code, err := CodeAt(rfcSecret, StepAt(time.Unix(test.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != test.want {
+			t.Errorf("code at %d = %s, want %s", test.unix, code, test.want)
+		}
+	}
+}
+
+func TestCodeAtInvalidSecret(t *testing.T) {
+	for _, secret := range []string{"", "not base32!"} {
+		if _, err := CodeAt(secret, 1); err != ErrInvalidSecret {
+			t.Errorf("CodeAt(%q): err = %v, want %v", secret, err, ErrInvalidSecret)
+		}
+	}
+
+	// apps may show lower case
+	code, err := CodeAt(strings.ToLower(rfcSecret), 1)
+	if err != nil || code != "287082" {
+		t.Errorf("lower case secret: code = %s, err = %v", code, err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	at := time.Unix(1234567890, 0)
+	now := StepAt(at)
+
+	tests := []struct {
+		name     string
+		code     string
+		t        time.Time
+		lastStep int64
+		wantStep int64
+		wantOK   bool
+	}{
+		{"now", "005924", at, 0, now, true},
+		{"previous step", "005924", at.Add(Period), 0, now, true},
+		{"next step", "005924", at.Add(-Period), 0, now, true},
+		{"out of skew", "005924", at.Add(Period * 2), 0, 0, false},
+		{"replayed", "005924", at, now, 0, false},
+		{"wrong", "005925", at, 0, 0, false},
+		{"short", "5924", at, 0, 0, false},
+	}
+
+	for _, test := range tests {
+		step, ok, err := Validate(rfcSecret, test.code, test.t, test.lastStep)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if ok != test.wantOK || step != test.wantStep {
+			t.Errorf("%s: step, ok = %d, %v, want %d, %v",
+				test.name, step, ok, test.wantStep, test.wantOK)
+		}
+	}
+}
+
+func TestGenerateSecret(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := encoding.DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(key) != secretSize {
+		t.Errorf("secret is %d bytes, want %d", len(key), secretSize)
+	}
+
+	other, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == secret {
+		t.Error("same secret was generated twice")
+	}
+}
+
+func TestURI(t *testing.T) {
+	uri := URI("Chat Board", "user@example.com", rfcSecret)
+
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Scheme != "otpauth" || parsed.Host != "totp" {
+		t.Errorf("uri = %s, want otpauth://totp/", uri)
+	}
+	if parsed.Path != "/Chat Board:user@example.com" {
+		t.Errorf("label = %q", parsed.Path)
+	}
+	query := parsed.Query()
+	if query.Get("secret") != rfcSecret || query.Get("issuer") != "Chat Board" {
+		t.Errorf("query = %v", query)
+	}
+	if query.Get("digits") != "6" || query.Get("period") != "30" {
+		t.Errorf("query = %v", query)
+	}
+}